@@ -0,0 +1,127 @@
+// Reusable cipher instances and buffers
+// Used by the streams to encrypt and decrypt blocks without allocating for every block
+
+package encrypted_storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"sync"
+)
+
+// Cache of the cipher instances for a key
+// A nil cache is valid, and creates new instances every time
+// Not safe for concurrent use
+type cipher_cache struct {
+	key     []byte // Private copy of the key of the cached instances (wiped when cleared)
+	has_key bool   // True if key is set
+
+	block cipher.Block // AES block cipher
+
+	aead_id FileEncryptionMethod // Method of the cached AEAD instance
+	aead    cipher.AEAD          // AEAD instance
+}
+
+// Returns the AES block cipher for a key
+// key - Encryption key
+func (c *cipher_cache) get_aes_block(key []byte) (cipher.Block, error) {
+	if c == nil {
+		return aes.NewCipher(key)
+	}
+
+	c.check_key(key)
+
+	if c.block == nil {
+		block, err := aes.NewCipher(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.block = block
+	}
+
+	return c.block, nil
+}
+
+// Returns the AEAD instance of a method for a key
+// id - Method ID
+// key - Encryption key
+// new_aead - Function to create the AEAD instance
+func (c *cipher_cache) get_aead(id FileEncryptionMethod, key []byte, new_aead func(key []byte) (cipher.AEAD, error)) (cipher.AEAD, error) {
+	if c == nil {
+		return new_aead(key)
+	}
+
+	c.check_key(key)
+
+	if c.aead == nil || c.aead_id != id {
+		aead, err := new_aead(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.aead = aead
+		c.aead_id = id
+	}
+
+	return c.aead, nil
+}
+
+// Drops the cached instances if the key changed
+// The key is copied, so the caller may modify or wipe it later
+// key - Encryption key
+func (c *cipher_cache) check_key(key []byte) {
+	if c.has_key && subtle.ConstantTimeCompare(c.key, key) == 1 {
+		return
+	}
+
+	c.clear()
+
+	c.key = append(c.key[:0], key...)
+	c.has_key = true
+}
+
+// Drops the cached instances and wipes the copy of the key
+func (c *cipher_cache) clear() {
+	clear(c.key)
+
+	c.key = c.key[:0]
+	c.has_key = false
+	c.block = nil
+	c.aead = nil
+}
+
+const (
+	buffer_pool_max_size = 1 << 20 // Max capacity of the pooled buffers. Bigger buffers are dropped, so they do not stay in memory
+)
+
+// Pool of buffers for intermediate data (compressed data before encrypting, decrypted data before decompressing)
+var buffer_pool sync.Pool
+
+// Gets a buffer from the pool
+// Returns the buffer, with length 0. Call put_buffer when it is no longer used
+func get_buffer() *[]byte {
+	if b, ok := buffer_pool.Get().(*[]byte); ok {
+		*b = (*b)[:0]
+		return b
+	}
+
+	b := make([]byte, 0, 64*1024)
+	return &b
+}
+
+// Returns a buffer to the pool, clearing its contents
+// Buffers bigger than buffer_pool_max_size are dropped
+// b - Buffer
+func put_buffer(b *[]byte) {
+	clear(*b)
+
+	if cap(*b) > buffer_pool_max_size {
+		return
+	}
+
+	buffer_pool.Put(b)
+}
@@ -0,0 +1,58 @@
+// Cipher cache (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipherCache(t *testing.T) {
+	var cache cipher_cache
+
+	key := test_random_key()
+	original_key := bytes.Clone(key)
+
+	block, err := cache.get_aes_block(key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	same_block, err := cache.get_aes_block(bytes.Clone(key))
+
+	if err != nil {
+		t.Error(err)
+		return
+	} else if same_block != block {
+		t.Errorf("Expected the cached instance to be reused for the same key")
+	}
+
+	// The cache keeps its own copy of the key, so changes of the caller are detected
+
+	key[0] ^= 0xFF
+
+	if !bytes.Equal(cache.key, original_key) {
+		t.Errorf("Expected the cache to keep a copy of the key")
+	}
+
+	other_block, err := cache.get_aes_block(key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	} else if other_block == block {
+		t.Errorf("Expected a new instance for a different key")
+	}
+
+	// Clearing the cache wipes the copy
+
+	key_copy := cache.key
+
+	cache.clear()
+
+	if cache.has_key || cache.block != nil || !bytes.Equal(key_copy, make([]byte, len(key_copy))) {
+		t.Errorf("Expected the cache to be wiped")
+	}
+}
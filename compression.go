@@ -0,0 +1,426 @@
+// Compression utilities
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_LEVEL_DEFAULT = 0 // Default compression level of the algorithm
+	COMPRESSION_LEVEL_FASTEST = 1 // Fastest compression level
+	COMPRESSION_LEVEL_BEST    = 9 // Best compression level
+)
+
+// Compression algorithm applied before encryption
+type compression_algorithm int
+
+const (
+	compression_none    compression_algorithm = iota // No compression
+	compression_zlib                                 // ZLIB (RFC 1950)
+	compression_deflate                              // Raw DEFLATE (RFC 1951)
+	compression_gzip                                 // GZIP (RFC 1952)
+	compression_zstd                                 // Zstandard (RFC 8878)
+)
+
+var (
+	zstd_encoders_mu sync.Mutex                    // Mutex for the encoders cache
+	zstd_encoders    = make(map[int]*zstd.Encoder) // Zstandard encoders, by level
+
+	zlib_writers [COMPRESSION_LEVEL_BEST + 1]sync.Pool // Pooled ZLIB writers, by level
+	zlib_readers sync.Pool                             // Pooled ZLIB readers
+)
+
+// Compresses data
+// algorithm - Compression algorithm
+// data - Data to compress
+// level - Compression level, from COMPRESSION_LEVEL_FASTEST to COMPRESSION_LEVEL_BEST, or COMPRESSION_LEVEL_DEFAULT
+// Returns the compressed data
+func compress_data(algorithm compression_algorithm, data []byte, level int) ([]byte, error) {
+	if level < COMPRESSION_LEVEL_DEFAULT || level > COMPRESSION_LEVEL_BEST {
+		return nil, ErrInvalidArgument
+	}
+
+	switch algorithm {
+	case compression_zlib:
+		return compress_zlib_append(nil, data, level)
+	case compression_deflate:
+		return compress_writer(data, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate_level(level))
+		})
+	case compression_gzip:
+		return compress_writer(data, func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, flate_level(level))
+		})
+	case compression_zstd:
+		encoder, err := get_zstd_encoder(level)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return encoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+// Compresses data, appending the result to a buffer
+// dst - Buffer to append the compressed data
+// algorithm - Compression algorithm
+// data - Data to compress
+// level - Compression level
+// Returns the buffer with the compressed data appended
+func compress_data_append(dst []byte, algorithm compression_algorithm, data []byte, level int) ([]byte, error) {
+	if level < COMPRESSION_LEVEL_DEFAULT || level > COMPRESSION_LEVEL_BEST {
+		return nil, ErrInvalidArgument
+	}
+
+	switch algorithm {
+	case compression_zlib:
+		return compress_zlib_append(dst, data, level)
+	case compression_zstd:
+		encoder, err := get_zstd_encoder(level)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return encoder.EncodeAll(data, dst), nil
+	case compression_none:
+		return append(dst, data...), nil
+	default:
+		compressed, err := compress_data(algorithm, data, level)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return append(dst, compressed...), nil
+	}
+}
+
+// Compresses data with ZLIB, using a pooled writer
+// dst - Buffer to append the compressed data
+// data - Data to compress
+// level - Compression level
+// Returns the buffer with the compressed data appended
+func compress_zlib_append(dst []byte, data []byte, level int) ([]byte, error) {
+	w := &append_writer{buf: dst}
+
+	zw, ok := zlib_writers[level].Get().(*zlib.Writer)
+
+	if ok {
+		zw.Reset(w)
+	} else {
+		var err error
+		zw, err = zlib.NewWriterLevel(w, flate_level(level))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := zw.Write(data)
+
+	if err == nil {
+		err = zw.Close()
+	}
+
+	// Do not keep a reference to the buffer
+	zw.Reset(io.Discard)
+	zlib_writers[level].Put(zw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w.buf, nil
+}
+
+// Decompresses data, appending the result to a buffer
+// dst - Buffer to append the original data
+// algorithm - Compression algorithm
+// data - Compressed data
+// max_size - Max size of the original data, in bytes (0 for no limit)
+// Returns the buffer with the original data appended
+func decompress_data_append(dst []byte, algorithm compression_algorithm, data []byte, max_size int64) ([]byte, error) {
+	switch algorithm {
+	case compression_none:
+		if max_size > 0 && int64(len(data)) > max_size {
+			return nil, &SizeLimitError{Limit: max_size}
+		}
+
+		return append(dst, data...), nil
+	case compression_zlib:
+		var r io.ReadCloser
+		var err error
+
+		br := bytes.NewReader(data)
+
+		if pooled, ok := zlib_readers.Get().(io.ReadCloser); ok {
+			r = pooled
+			err = r.(zlib.Resetter).Reset(br, nil)
+		} else {
+			r, err = zlib.NewReader(br)
+		}
+
+		if err != nil {
+			return nil, invalid_data_error(err)
+		}
+
+		dst, err = read_append_limited(dst, r, max_size, invalid_data_error)
+
+		r.Close()
+		zlib_readers.Put(r)
+
+		return dst, err
+	default:
+		plaintext, err := decompress_data(algorithm, data, max_size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return append(dst, plaintext...), nil
+	}
+}
+
+// Decompresses data
+// algorithm - Compression algorithm
+// data - Compressed data
+// max_size - Max size of the original data, in bytes (0 for no limit)
+// Returns the original data
+func decompress_data(algorithm compression_algorithm, data []byte, max_size int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	switch algorithm {
+	case compression_zlib:
+		return decompress_data_append(nil, algorithm, data, max_size)
+	case compression_deflate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case compression_gzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case compression_zstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+
+		if err == nil {
+			r = d.IOReadCloser()
+		}
+	default:
+		if max_size > 0 && int64(len(data)) > max_size {
+			return nil, &SizeLimitError{Limit: max_size}
+		}
+
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, invalid_data_error(err)
+	}
+	defer r.Close()
+
+	return read_all_limited(r, max_size, invalid_data_error)
+}
+
+// Compresses data using a compression writer
+// data - Data to compress
+// new_writer - Function to create the compression writer
+// Returns the compressed data
+func compress_writer(data []byte, new_writer func(w io.Writer) (io.WriteCloser, error)) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := new_writer(&b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Converts a compression level to a DEFLATE level
+// level - Compression level
+func flate_level(level int) int {
+	if level == COMPRESSION_LEVEL_DEFAULT {
+		return flate.DefaultCompression
+	}
+
+	return level
+}
+
+// Gets a Zstandard encoder for a compression level
+// Encoders are cached, since they are expensive to create and safe to use concurrently with EncodeAll
+// level - Compression level
+func get_zstd_encoder(level int) (*zstd.Encoder, error) {
+	zstd_encoders_mu.Lock()
+	defer zstd_encoders_mu.Unlock()
+
+	if encoder, ok := zstd_encoders[level]; ok {
+		return encoder, nil
+	}
+
+	var zstd_level zstd.EncoderLevel
+
+	switch {
+	case level == COMPRESSION_LEVEL_DEFAULT:
+		zstd_level = zstd.SpeedDefault
+	case level <= 2:
+		zstd_level = zstd.SpeedFastest
+	case level <= 5:
+		zstd_level = zstd.SpeedDefault
+	case level <= 7:
+		zstd_level = zstd.SpeedBetterCompression
+	default:
+		zstd_level = zstd.SpeedBestCompression
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd_level), zstd.WithEncoderConcurrency(1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	zstd_encoders[level] = encoder
+
+	return encoder, nil
+}
+
+// Reads all the data from a reader, stopping if it exceeds a limit
+// r - Reader
+// max_size - Max size of the data, in bytes (0 for no limit)
+// wrap_error - Function to wrap the read errors
+// Returns the data, or a *SizeLimitError if the limit is exceeded
+func read_all_limited(r io.Reader, max_size int64, wrap_error func(error) error) ([]byte, error) {
+	return read_append_limited(make([]byte, 0, 512), r, max_size, wrap_error)
+}
+
+// Reads all the data from a reader, appending it to a buffer, stopping if it exceeds a limit
+// dst - Buffer to append the data
+// r - Reader
+// max_size - Max size of the data, in bytes (0 for no limit)
+// wrap_error - Function to wrap the read errors
+// Returns the buffer with the data appended, or a *SizeLimitError if the limit is exceeded
+func read_append_limited(dst []byte, r io.Reader, max_size int64, wrap_error func(error) error) ([]byte, error) {
+	if max_size > 0 {
+		r = io.LimitReader(r, max_size+1)
+	}
+
+	start := len(dst)
+
+	for {
+		if len(dst) == cap(dst) {
+			// Grow the buffer
+			dst = append(dst, 0)[:len(dst)]
+		}
+
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, wrap_error(err)
+		}
+	}
+
+	if max_size > 0 && int64(len(dst)-start) > max_size {
+		return nil, &SizeLimitError{Limit: max_size}
+	}
+
+	return dst, nil
+}
+
+// Writer appending the data to a buffer
+type append_writer struct {
+	buf []byte // Buffer
+}
+
+func (w *append_writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+const (
+	AUTO_COMPRESSION_MIN_SAVINGS = 0.05 // Default min fraction of the size that compression must save in auto mode
+
+	auto_compression_sample_count = 4        // Number of chunks sampled to estimate the compression ratio
+	auto_compression_sample_size  = 8 * 1024 // Size of each sampled chunk, in bytes
+)
+
+// Pool of DEFLATE writers used to estimate the compression ratio
+var estimate_writers = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(io.Discard, flate.BestSpeed)
+		return w
+	},
+}
+
+// Counts the bytes written into it
+type counting_writer struct {
+	n int64 // Bytes written
+}
+
+func (w *counting_writer) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Estimates if compressing data is worth it
+// Compresses a sample of the data (a few chunks spread over it) with the fastest DEFLATE level,
+// so incompressible data (already compressed media, for example) is detected cheaply
+// data - Data to check
+// min_savings - Min fraction of the size that compression must save (0 to 1)
+// Returns true if compressing the data is expected to save at least min_savings
+func is_worth_compressing(data []byte, min_savings float64) bool {
+	sample_total := auto_compression_sample_count * auto_compression_sample_size
+
+	cw := &counting_writer{}
+	w := estimate_writers.Get().(*flate.Writer)
+	defer estimate_writers.Put(w)
+
+	w.Reset(cw)
+
+	sampled := 0
+
+	if len(data) <= sample_total {
+		w.Write(data)
+		sampled = len(data)
+	} else {
+		step := (len(data) - auto_compression_sample_size) / (auto_compression_sample_count - 1)
+
+		for i := 0; i < auto_compression_sample_count; i++ {
+			start := i * step
+			w.Write(data[start : start+auto_compression_sample_size])
+			sampled += auto_compression_sample_size
+		}
+	}
+
+	w.Close()
+
+	saved := float64(int64(sampled)-cw.n) / float64(sampled)
+
+	return saved >= min_savings
+}
@@ -0,0 +1,198 @@
+// Encryption methods registry
+
+package encrypted_storage
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encryption method, used by EncryptFileContents and DecryptFileContents
+// The cipher text of a method is: Method ID (2 bytes) + Header (HeaderSize() bytes) + Body
+// Implementations must be safe for concurrent use
+type EncryptionMethod interface {
+	// Returns the identifier of the method
+	ID() FileEncryptionMethod
+
+	// Returns the size of the header, in bytes
+	HeaderSize() int
+
+	// Encrypts data
+	// data - Data to encrypt (never empty)
+	// key - Encryption key
+	// Returns the header (HeaderSize() bytes) and the body
+	Encrypt(data []byte, key []byte) (header []byte, body []byte, err error)
+
+	// Decrypts data
+	// header - Header (HeaderSize() bytes)
+	// body - Body (rest of the cipher text)
+	// key - Decryption key
+	// Returns the original data
+	Decrypt(header []byte, body []byte, key []byte) ([]byte, error)
+}
+
+// Encryption method able to stop decrypting once the original data exceeds a size limit
+// Used by DecryptFileContentsWithOptions. For methods not implementing it, the limit is checked after decrypting.
+type LimitedDecryptionMethod interface {
+	EncryptionMethod
+
+	// Decrypts data, enforcing a size limit
+	// header - Header (HeaderSize() bytes)
+	// body - Body (rest of the cipher text)
+	// key - Decryption key
+	// max_size - Max size of the original data, in bytes
+	// Returns the original data. If the limit is exceeded, must return a *SizeLimitError
+	DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error)
+}
+
+// Encryption method compressing the data, supporting a compression level
+// Used by EncryptFileContentsWithOptions. For methods not implementing it, the level is ignored.
+type CompressionEncryptionMethod interface {
+	EncryptionMethod
+
+	// Encrypts data, using a compression level
+	// data - Data to encrypt (never empty)
+	// key - Encryption key
+	// level - Compression level, from COMPRESSION_LEVEL_FASTEST to COMPRESSION_LEVEL_BEST, or COMPRESSION_LEVEL_DEFAULT
+	// Returns the header (HeaderSize() bytes) and the body
+	EncryptWithLevel(data []byte, key []byte, level int) (header []byte, body []byte, err error)
+}
+
+// Encryption method able to authenticate associated data: context bound to the cipher text, but not stored in it
+// Used when EncryptOptions.AssociatedData or DecryptOptions.AssociatedData are set.
+// With empty associated data, the result must be the same as Encrypt / Decrypt.
+type AssociatedDataEncryptionMethod interface {
+	EncryptionMethod
+
+	// Encrypts data, authenticating associated data
+	// data - Data to encrypt (may be empty)
+	// key - Encryption key
+	// ad - Associated data
+	// level - Compression level, from COMPRESSION_LEVEL_FASTEST to COMPRESSION_LEVEL_BEST, or COMPRESSION_LEVEL_DEFAULT
+	// Returns the header (HeaderSize() bytes) and the body
+	EncryptWithAD(data []byte, key []byte, ad []byte, level int) (header []byte, body []byte, err error)
+
+	// Decrypts data, verifying associated data
+	// header - Header (HeaderSize() bytes)
+	// body - Body (rest of the cipher text)
+	// key - Decryption key
+	// ad - Associated data. Must be the same used to encrypt, or ErrAuthenticationFailed must be returned
+	// max_size - Max size of the original data, in bytes (0 for no limit). If exceeded, must return a *SizeLimitError
+	// Returns the original data
+	DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error)
+}
+
+// Encryption method writing into caller-supplied buffers, and reusing cipher instances
+// Implemented by the built-in methods, used by EncryptFileContentsTo, DecryptFileContentsTo and the streams
+type append_encryption_method interface {
+	// Encrypts data, appending the header and the body to a buffer
+	// dst - Buffer to append the result
+	// data - Data to encrypt
+	// key - Encryption key
+	// ad - Associated data (may be empty)
+	// level - Compression level
+	// cache - Cache of cipher instances (may be nil)
+	encrypt_append(dst []byte, data []byte, key []byte, ad []byte, level int, cache *cipher_cache) ([]byte, error)
+
+	// Decrypts data, appending the original data to a buffer
+	// dst - Buffer to append the result
+	// header - Header (HeaderSize() bytes)
+	// body - Body (rest of the cipher text)
+	// key - Decryption key
+	// ad - Associated data (may be empty)
+	// max_size - Max size of the original data, in bytes (0 for no limit)
+	// cache - Cache of cipher instances (may be nil)
+	decrypt_append(dst []byte, header []byte, body []byte, key []byte, ad []byte, max_size int64, cache *cipher_cache) ([]byte, error)
+}
+
+var (
+	encryption_methods_mu sync.RWMutex                                      // Mutex for the registry
+	encryption_methods    = make(map[FileEncryptionMethod]EncryptionMethod) // Registered methods, by ID
+)
+
+func init() {
+	register_builtin_method(&aes_cbc_method{id: AES256_ZIP, compression: compression_zlib, size_bytes: 4})
+	register_builtin_method(&aes_cbc_method{id: AES256_FLAT, compression: compression_none, size_bytes: 4})
+	register_builtin_method(&aead_method{id: AES256_GCM, compression: compression_none, nonce_size: AES_GCM_NONCE_SIZE, new_aead: new_aes_gcm, max_size: AES_GCM_MAX_SIZE})
+	register_builtin_method(&aead_method{id: AES256_GCM_ZIP, compression: compression_zlib, nonce_size: AES_GCM_NONCE_SIZE, new_aead: new_aes_gcm, max_size: AES_GCM_MAX_SIZE})
+	register_builtin_method(&aead_method{id: XCHACHA20_POLY1305, compression: compression_none, nonce_size: chacha20poly1305.NonceSizeX, new_aead: chacha20poly1305.NewX, max_size: XCHACHA20_POLY1305_MAX_SIZE})
+	register_builtin_method(&aead_method{id: XCHACHA20_POLY1305_ZIP, compression: compression_zlib, nonce_size: chacha20poly1305.NonceSizeX, new_aead: chacha20poly1305.NewX, max_size: XCHACHA20_POLY1305_MAX_SIZE})
+	register_builtin_method(&aes_cbc_hmac_method{id: AES256_ZIP_HMAC, compression: compression_zlib})
+	register_builtin_method(&aes_cbc_hmac_method{id: AES256_FLAT_HMAC, compression: compression_none})
+	register_builtin_method(&aead_stream_method{id: AES256_GCM_STREAM, compress: false, new_aead: new_aes_gcm})
+	register_builtin_method(&aead_stream_method{id: AES256_GCM_ZIP_STREAM, compress: true, new_aead: new_aes_gcm})
+	register_builtin_method(&aes_cbc_method{id: AES256_ZIP_64, compression: compression_zlib, size_bytes: 8})
+	register_builtin_method(&aes_cbc_method{id: AES256_FLAT_64, compression: compression_none, size_bytes: 8})
+	register_builtin_method(&aead_method{id: AES256_GCM_ZSTD, compression: compression_zstd, nonce_size: AES_GCM_NONCE_SIZE, new_aead: new_aes_gcm, max_size: AES_GCM_MAX_SIZE})
+	register_builtin_method(&aead_method{id: AES256_GCM_DEFLATE, compression: compression_deflate, nonce_size: AES_GCM_NONCE_SIZE, new_aead: new_aes_gcm, max_size: AES_GCM_MAX_SIZE})
+	register_builtin_method(&aead_method{id: AES256_GCM_GZIP, compression: compression_gzip, nonce_size: AES_GCM_NONCE_SIZE, new_aead: new_aes_gcm, max_size: AES_GCM_MAX_SIZE})
+	register_builtin_method(&aead_method{id: XCHACHA20_POLY1305_ZSTD, compression: compression_zstd, nonce_size: chacha20poly1305.NonceSizeX, new_aead: chacha20poly1305.NewX, max_size: XCHACHA20_POLY1305_MAX_SIZE})
+	register_builtin_method(&key_id_method{})
+	register_builtin_method(&recipients_method{})
+	register_builtin_method(&signature_method{})
+	register_builtin_method(&aes_siv_method{id: AES256_SIV, compression: compression_none})
+	register_builtin_method(&aes_siv_method{id: AES256_SIV_ZIP, compression: compression_zlib})
+}
+
+// Methods without compression, equivalent to the built-in methods with compression
+// Used by the auto compression mode to skip compression for incompressible data
+var uncompressed_methods = map[FileEncryptionMethod]FileEncryptionMethod{
+	AES256_ZIP:              AES256_FLAT,
+	AES256_GCM_ZIP:          AES256_GCM,
+	XCHACHA20_POLY1305_ZIP:  XCHACHA20_POLY1305,
+	AES256_ZIP_HMAC:         AES256_FLAT_HMAC,
+	AES256_GCM_ZIP_STREAM:   AES256_GCM_STREAM,
+	AES256_ZIP_64:           AES256_FLAT_64,
+	AES256_GCM_ZSTD:         AES256_GCM,
+	AES256_GCM_DEFLATE:      AES256_GCM,
+	AES256_GCM_GZIP:         AES256_GCM,
+	XCHACHA20_POLY1305_ZSTD: XCHACHA20_POLY1305,
+	AES256_SIV_ZIP:          AES256_SIV,
+}
+
+// Registers an encryption method, making it available for
+// EncryptFileContents, DecryptFileContents and the streams using them
+// method - The method to register
+// Returns an error if the ID is invalid or already in use
+func RegisterEncryptionMethod(method EncryptionMethod) error {
+	if method == nil || method.ID() == 0 {
+		return ErrInvalidMethod
+	}
+
+	if method.HeaderSize() < 0 {
+		return ErrInvalidMethod
+	}
+
+	encryption_methods_mu.Lock()
+	defer encryption_methods_mu.Unlock()
+
+	if _, exists := encryption_methods[method.ID()]; exists {
+		return ErrMethodAlreadyRegistered
+	}
+
+	encryption_methods[method.ID()] = method
+
+	return nil
+}
+
+// Finds a registered encryption method
+// id - Method ID
+// Returns the method, and true if it was found
+func GetEncryptionMethod(id FileEncryptionMethod) (EncryptionMethod, bool) {
+	encryption_methods_mu.RLock()
+	defer encryption_methods_mu.RUnlock()
+
+	m, ok := encryption_methods[id]
+
+	return m, ok
+}
+
+// Registers a built-in method, panicking on failure
+func register_builtin_method(method EncryptionMethod) {
+	err := RegisterEncryptionMethod(method)
+
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,122 @@
+// Tests for the encryption methods registry
+
+package encrypted_storage
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"testing"
+)
+
+const TEST_CUSTOM_METHOD FileEncryptionMethod = 0x8001
+
+// Test method: XOR with the key, storing a checksum byte in the header
+type test_xor_method struct{}
+
+func (m *test_xor_method) ID() FileEncryptionMethod {
+	return TEST_CUSTOM_METHOD
+}
+
+func (m *test_xor_method) HeaderSize() int {
+	return 1
+}
+
+func (m *test_xor_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	body := make([]byte, len(data))
+	sum := byte(0)
+
+	for i := 0; i < len(data); i++ {
+		body[i] = data[i] ^ key[i%len(key)]
+		sum += data[i]
+	}
+
+	return []byte{sum}, body, nil
+}
+
+func (m *test_xor_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	data := make([]byte, len(body))
+	sum := byte(0)
+
+	for i := 0; i < len(body); i++ {
+		data[i] = body[i] ^ key[i%len(key)]
+		sum += data[i]
+	}
+
+	if sum != header[0] {
+		return nil, errors.New("Checksum mismatch")
+	}
+
+	return data, nil
+}
+
+func TestEncryptionMethodRegistry(t *testing.T) {
+	// Built-in methods
+	for _, id := range []FileEncryptionMethod{AES256_ZIP, AES256_FLAT, AES256_GCM, AES256_GCM_ZIP, XCHACHA20_POLY1305, XCHACHA20_POLY1305_ZIP, AES256_ZIP_HMAC, AES256_FLAT_HMAC} {
+		m, ok := GetEncryptionMethod(id)
+
+		if !ok {
+			t.Errorf("Expected method %d to be registered", id)
+			continue
+		}
+
+		if m.ID() != id {
+			t.Errorf("Expected ID() = %d, but got %d", id, m.ID())
+		}
+
+		err := RegisterEncryptionMethod(m)
+
+		if err == nil {
+			t.Errorf("Expected an error when registering method %d twice", id)
+		}
+	}
+
+	// Custom method
+	if _, registered := GetEncryptionMethod(TEST_CUSTOM_METHOD); !registered {
+		err := RegisterEncryptionMethod(&test_xor_method{})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := []byte("Test string for a custom method")
+
+	encrypted, err := EncryptFileContents(original, TEST_CUSTOM_METHOD, key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(encrypted) != 2+1+len(original) {
+		t.Errorf("Expected cipher text length = %d, but got %d", 2+1+len(original), len(encrypted))
+	}
+
+	decrypted, err := DecryptFileContents(encrypted, key)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+		t.Errorf("Test failed | Original: %s | Final: %s", string(original), string(decrypted))
+	}
+
+	// Unknown method
+	_, err = EncryptFileContents(original, 0x7FFF, key)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown method")
+	}
+
+	_, err = DecryptFileContents([]byte{0x7F, 0xFF, 0x00}, key)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown method")
+	}
+}
@@ -0,0 +1,234 @@
+// Envelope encryption for block-encrypted files:
+// each file is encrypted with its own random data key, stored in the header wrapped with a master key.
+// ---
+// Wrapped key (68 bytes):
+//   - ID of the master key (see ComputeKeyID) (8 bytes)
+//   - Nonce (12 bytes)
+//   - Data key, encrypted with AES-256-GCM using the master key (32 bytes)
+//   - Authentication tag (16 bytes)
+// The fixed header of the file and the ID of the master key are authenticated as additional data,
+// so the wrapped key cannot be moved to another file.
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	DATA_KEY_SIZE    = 32                                                                  // Size of the data keys, in bytes
+	WRAPPED_KEY_SIZE = KEY_ID_SIZE + AES_GCM_NONCE_SIZE + DATA_KEY_SIZE + AES_GCM_TAG_SIZE // Size of the wrapped data keys, in bytes
+)
+
+// Generates a random data key, and wraps it with the master key
+// master_key - Master key
+// file_header - Fixed header of the file
+// Returns the data key and the wrapped key
+func generate_data_key(master_key []byte, file_header []byte) (data_key []byte, wrapped_key []byte, err error) {
+	data_key = make([]byte, DATA_KEY_SIZE)
+	_, err = rand.Read(data_key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped_key, err = wrap_data_key(data_key, master_key, file_header)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data_key, wrapped_key, nil
+}
+
+// Wraps a data key with a master key
+// data_key - Data key
+// master_key - Master key
+// file_header - Fixed header of the file
+// Returns the wrapped key (WRAPPED_KEY_SIZE bytes)
+func wrap_data_key(data_key []byte, master_key []byte, file_header []byte) ([]byte, error) {
+	aead, err := new_aes_gcm(master_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	id := ComputeKeyID(master_key)
+
+	result := make([]byte, KEY_ID_SIZE+AES_GCM_NONCE_SIZE, WRAPPED_KEY_SIZE)
+	copy(result, id[:])
+
+	_, err = rand.Read(result[KEY_ID_SIZE:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(result, result[KEY_ID_SIZE:], data_key, wrapped_key_additional_data(id, file_header)), nil
+}
+
+// Unwraps a data key
+// wrapped_key - Wrapped key
+// master_key - Master key
+// file_header - Fixed header of the file
+// Returns the data key
+func unwrap_data_key(wrapped_key []byte, master_key []byte, file_header []byte) ([]byte, error) {
+	if len(wrapped_key) != WRAPPED_KEY_SIZE {
+		return nil, ErrInvalidData
+	}
+
+	var id KeyID
+	copy(id[:], wrapped_key[:KEY_ID_SIZE])
+
+	if id != ComputeKeyID(master_key) {
+		return nil, invalid_key_error(fmt.Errorf("the data key was wrapped with the key %s", id))
+	}
+
+	aead, err := new_aes_gcm(master_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	nonce := wrapped_key[KEY_ID_SIZE : KEY_ID_SIZE+AES_GCM_NONCE_SIZE]
+
+	data_key, err := aead.Open(nil, nonce, wrapped_key[KEY_ID_SIZE+AES_GCM_NONCE_SIZE:], wrapped_key_additional_data(id, file_header))
+
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return data_key, nil
+}
+
+// Returns the additional data to authenticate when wrapping a data key
+// id - ID of the master key
+// file_header - Fixed header of the file
+func wrapped_key_additional_data(id KeyID, file_header []byte) []byte {
+	label := []byte("encrypted-storage wrapped data key")
+
+	ad := make([]byte, 0, len(label)+KEY_ID_SIZE+len(file_header))
+	ad = append(ad, label...)
+	ad = append(ad, id[:]...)
+	ad = append(ad, file_header...)
+
+	return ad
+}
+
+// Returns the ID of the master key used to wrap a data key
+// wrapped_key - Wrapped key
+func wrapped_key_id(wrapped_key []byte) KeyID {
+	var id KeyID
+	copy(id[:], wrapped_key[:KEY_ID_SIZE])
+	return id
+}
+
+// Changes the master key of a block-encrypted file using envelope encryption
+// Only the wrapped data key is rewritten, the blocks are not modified
+// file - Path to the file
+// old_key - Current master key
+// new_key - New master key
+func RewrapFileBlockEncryptKey(file string, old_key []byte, new_key []byte) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	err = RewrapFileBlockEncryptKeyIn(f, old_key, new_key)
+
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Changes the master key of a block-encrypted file using envelope encryption, in a file of a storage backend
+// Only the wrapped data key is rewritten, the blocks are not modified
+// backend - Backend
+// name - Name of the file
+// old_key - Current master key
+// new_key - New master key
+func RewrapFileBlockEncryptKeyInBackend(backend Backend, name string, old_key []byte, new_key []byte) error {
+	f, err := backend.OpenRW(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	err = RewrapFileBlockEncryptKeyIn(f, old_key, new_key)
+
+	if err != nil {
+		return err
+	}
+
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+
+	return nil
+}
+
+// Changes the master key of a block-encrypted file using envelope encryption,
+// in an already open file, a buffer, or a file of a storage backend
+// Only the wrapped data key is rewritten, the blocks are not modified
+// f - File, to read the header and write the new wrapped key
+// old_key - Current master key
+// new_key - New master key
+func RewrapFileBlockEncryptKeyIn(f ReadWriterAt, old_key []byte, new_key []byte) error {
+	// Read the header
+
+	header := make([]byte, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE)
+
+	err := read_at(f, header, 0)
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[0:4], file_block_authenticated_magic) || header[4] != file_block_authenticated_version {
+		return ErrInvalidData
+	}
+
+	extensions := make([]byte, binary.BigEndian.Uint16(header[6:8]))
+
+	err = read_at(f, extensions, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE)
+
+	if err != nil {
+		return err
+	}
+
+	wrapped_key, offset, ok := find_header_extension(extensions, FILE_BLOCK_EXTENSION_WRAPPED_KEY)
+
+	if !ok {
+		// Not using envelope encryption
+		return ErrInvalidData
+	}
+
+	// Rewrap
+
+	data_key, err := unwrap_data_key(wrapped_key, old_key, header)
+
+	if err != nil {
+		return err
+	}
+
+	new_wrapped_key, err := wrap_data_key(data_key, new_key, header)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(new_wrapped_key, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+int64(offset))
+
+	return err
+}
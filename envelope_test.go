@@ -0,0 +1,221 @@
+// Envelope encryption (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEnvelopeEncryption(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_envelope")
+	test_file_2 := path.Join(test_path_base, "test_block_file_envelope_2")
+
+	defer os.Remove(test_file)
+	defer os.Remove(test_file_2)
+
+	master_key := test_random_key()
+	new_master_key := test_random_key()
+
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	write_file := func(file string) error {
+		ws, err := CreateFileBlockEncryptWriteStream(file, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		err = ws.InitializeWithOptions(int64(len(original)), 256, master_key, FileBlockEncryptOptions{Envelope: true})
+
+		if err != nil {
+			return err
+		}
+
+		_, err = ws.Write(original)
+
+		if err != nil {
+			return err
+		}
+
+		return ws.Close()
+	}
+
+	read_file := func(file string, key []byte) ([]byte, error) {
+		rs, err := CreateFileBlockEncryptReadStream(file, key, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rs.Close()
+
+		return io.ReadAll(rs)
+	}
+
+	err = write_file(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := read_file(test_file, master_key)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	_, err = read_file(test_file, new_master_key)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a wrong master key, but got (%v)", err)
+	}
+
+	// Change the master key
+
+	before, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = RewrapFileBlockEncryptKey(test_file, master_key, new_master_key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	after, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	wrapped_key_start := FILE_BLOCK_AUTHENTICATED_HEADER_SIZE + 4
+	wrapped_key_end := wrapped_key_start + WRAPPED_KEY_SIZE
+
+	if len(before) != len(after) || !bytes.Equal(before[:wrapped_key_start], after[:wrapped_key_start]) || !bytes.Equal(before[wrapped_key_end:], after[wrapped_key_end:]) {
+		t.Errorf("Expected only the wrapped key to change")
+	}
+
+	_, err = read_file(test_file, master_key)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for the old master key, but got (%v)", err)
+	}
+
+	data, err = read_file(test_file, new_master_key)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	err = RewrapFileBlockEncryptKey(test_file, master_key, new_master_key)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey when rewrapping with a wrong key, but got (%v)", err)
+	}
+
+	// Keyring
+
+	keyring := NewKeyring()
+	keyring.Add(master_key)
+	keyring.Add(new_master_key)
+
+	rs, err := CreateFileBlockEncryptReadStreamWithKeyring(test_file, keyring, 0600)
+
+	if err != nil {
+		t.Error(err)
+	} else {
+		data, err = io.ReadAll(rs)
+		rs.Close()
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data")
+		}
+	}
+
+	// The wrapped key cannot be moved to another file
+
+	err = write_file(test_file_2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := os.ReadFile(test_file_2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	copy(other[wrapped_key_start:wrapped_key_end], after[wrapped_key_start:wrapped_key_end])
+
+	err = os.WriteFile(test_file_2, other, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file(test_file_2, new_master_key)
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for a wrapped key from another file, but got (%v)", err)
+	}
+
+	// Files without envelope encryption cannot be rewrapped
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file_2, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithOptions(0, 256, master_key, FileBlockEncryptOptions{Authenticated: true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws.Close()
+
+	err = RewrapFileBlockEncryptKey(test_file_2, master_key, new_master_key)
+
+	if !errors.Is(err, ErrInvalidData) {
+		t.Errorf("Expected ErrInvalidData for a file without envelope encryption, but got (%v)", err)
+	}
+}
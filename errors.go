@@ -0,0 +1,146 @@
+// Errors
+
+package encrypted_storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned by the library.
+// They can be wrapped (for example, by BlockError or PackFileError), so check them with errors.Is
+var (
+	// The data was modified, or the key is not the one used to encrypt it (authenticated methods only)
+	ErrAuthenticationFailed = errors.New("Authentication failed: the data was modified or the key is invalid")
+
+	// The key cannot be used by the method (for example, it has the wrong length)
+	ErrInvalidKey = errors.New("Invalid key")
+
+	// The key used to encrypt the data is not in the keyring
+	ErrKeyNotFound = errors.New("Key not found in the keyring")
+
+	// The data is corrupted or is not in the expected format
+	ErrInvalidData = errors.New("Invalid data provided")
+
+	// The data ends before expected
+	ErrTruncatedData = errors.New("Truncated data")
+
+	// The method ID is unknown, or the method is not valid
+	ErrInvalidMethod = errors.New("Invalid method")
+
+	// The method ID is already registered
+	ErrMethodAlreadyRegistered = errors.New("Method ID already registered")
+
+	// The data exceeds the size limit of the method
+	ErrDataTooLarge = errors.New("Data too large for the encryption method")
+
+	// The data exceeds a size limit set in the decryption options
+	ErrSizeLimitExceeded = errors.New("Size limit exceeded")
+
+	// The encryption method does not support the requested operation (for example, associated data for an unauthenticated method)
+	ErrUnsupported = errors.New("Operation not supported by the encryption method")
+
+	// The data is not signed
+	ErrNotSigned = errors.New("The data is not signed")
+
+	// The signature does not match the data
+	ErrInvalidSignature = errors.New("Invalid signature")
+
+	// The data was signed by a signer not in the list of trusted public keys
+	ErrUntrustedSigner = errors.New("The signer is not trusted")
+
+	// Misuse: An argument is not valid
+	ErrInvalidArgument = errors.New("Invalid argument")
+
+	// Misuse: More data was written than the file size set on initialization
+	ErrFileSizeExceeded = errors.New("Exceeded file size limit")
+
+	// Misuse: More files were written than the file count set on initialization
+	ErrFileCountExceeded = errors.New("Exceeded file count limit")
+
+	// Misuse: Index of a block or file out of bounds
+	ErrIndexOutOfBounds = errors.New("Index out of bounds")
+
+	// Misuse: Cursor position out of bounds
+	ErrCursorOutOfBounds = errors.New("Cursor position out of bounds")
+
+	// Misuse: The stream is closed
+	ErrClosed = errors.New("Stream closed")
+)
+
+// Error related to a block of a block-encrypted file
+type BlockError struct {
+	BlockIndex int64 // Index of the block
+	Offset     int64 // Byte offset in the encrypted file where the block (or its index entry) is, or -1 if not applicable
+	Err        error // Cause
+}
+
+func (e *BlockError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("Block %d: %v", e.BlockIndex, e.Err)
+	}
+
+	return fmt.Sprintf("Block %d (offset %d): %v", e.BlockIndex, e.Offset, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// Error related to a file of a multi-file pack
+type PackFileError struct {
+	FileIndex int64 // Index of the file
+	Offset    int64 // Byte offset in the pack where the file (or its table entry) is, or -1 if not applicable
+	Err       error // Cause
+}
+
+func (e *PackFileError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("File %d: %v", e.FileIndex, e.Err)
+	}
+
+	return fmt.Sprintf("File %d (offset %d): %v", e.FileIndex, e.Offset, e.Err)
+}
+
+func (e *PackFileError) Unwrap() error {
+	return e.Err
+}
+
+// Error returned when a size limit set in the decryption options is exceeded
+// Wraps ErrSizeLimitExceeded
+type SizeLimitError struct {
+	Limit      int64 // The limit, in bytes
+	Ciphertext bool  // True if the limit is for the cipher text, false if it is for the plaintext
+}
+
+func (e *SizeLimitError) Error() string {
+	if e.Ciphertext {
+		return fmt.Sprintf("%v: cipher text larger than %d bytes", ErrSizeLimitExceeded, e.Limit)
+	}
+
+	return fmt.Sprintf("%v: plaintext larger than %d bytes", ErrSizeLimitExceeded, e.Limit)
+}
+
+func (e *SizeLimitError) Unwrap() error {
+	return ErrSizeLimitExceeded
+}
+
+// Wraps an error returned when creating a cipher instance for a key
+func invalid_key_error(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+}
+
+// Wraps an error returned when decompressing data
+func invalid_data_error(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidData, err)
+}
+
+// Converts the end of file errors returned by io.ReadFull into ErrTruncatedData
+func read_full_error(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedData
+	}
+
+	return err
+}
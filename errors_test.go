@@ -0,0 +1,219 @@
+// Tests for errors
+
+package encrypted_storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	wrongKey := make([]byte, 32)
+	_, err = rand.Read(wrongKey)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := []byte("Test string for errors")
+
+	// Wrong key
+	encrypted, err := EncryptFileContents(original, AES256_GCM, key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = DecryptFileContents(encrypted, wrongKey)
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed, but got (%v)", err)
+	}
+
+	// Truncated data
+	_, err = DecryptFileContents(encrypted[:5], key)
+	if !errors.Is(err, ErrTruncatedData) {
+		t.Errorf("Expected ErrTruncatedData, but got (%v)", err)
+	}
+
+	// Invalid key
+	_, err = EncryptFileContents(original, AES256_ZIP, key[:10])
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, but got (%v)", err)
+	}
+
+	// Invalid method
+	_, err = EncryptFileContents(original, 0, key)
+	if !errors.Is(err, ErrInvalidMethod) {
+		t.Errorf("Expected ErrInvalidMethod, but got (%v)", err)
+	}
+
+	// Bad size field
+	encrypted, err = EncryptFileContents(original, AES256_FLAT, key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted[2] = 0xFF
+
+	_, err = DecryptFileContents(encrypted, key)
+	if !errors.Is(err, ErrInvalidData) {
+		t.Errorf("Expected ErrInvalidData, but got (%v)", err)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Block-encrypted file
+
+	test_file := path.Join(test_path_base, "test_block_file_errors")
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Initialize(100, 40, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(make([]byte, 120))
+
+	if !errors.Is(err, ErrFileSizeExceeded) {
+		t.Errorf("Expected ErrFileSizeExceeded, but got (%v)", err)
+	}
+
+	ws.Close()
+
+	// Truncate the last block
+	stat, err := os.Stat(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.Truncate(test_file, stat.Size()-1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = rs.Seek(120, 0)
+
+	if !errors.Is(err, ErrCursorOutOfBounds) {
+		t.Errorf("Expected ErrCursorOutOfBounds, but got (%v)", err)
+	}
+
+	_, err = rs.Seek(80, 0)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = rs.Read(make([]byte, 20))
+
+	var blockErr *BlockError
+
+	if !errors.As(err, &blockErr) {
+		t.Errorf("Expected BlockError, but got (%v)", err)
+	} else if blockErr.BlockIndex != 2 || !errors.Is(err, ErrTruncatedData) {
+		t.Errorf("Expected truncated block 2, but got (%v)", err)
+	}
+
+	rs.Close()
+
+	os.Remove(test_file)
+
+	// Multi-file pack
+
+	test_file = path.Join(test_path_base, "test_multi_file_pack_errors")
+
+	wp, err := CreateMultiFilePackWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = wp.Initialize(1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = wp.PutFile([]byte("File contents"))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = wp.PutFile([]byte("File contents"))
+
+	if !errors.Is(err, ErrFileCountExceeded) {
+		t.Errorf("Expected ErrFileCountExceeded, but got (%v)", err)
+	}
+
+	wp.Close()
+
+	rp, err := CreateMultiFilePackReadStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = rp.GetFile(3)
+
+	var packErr *PackFileError
+
+	if !errors.As(err, &packErr) {
+		t.Errorf("Expected PackFileError, but got (%v)", err)
+	} else if packErr.FileIndex != 3 || !errors.Is(err, ErrIndexOutOfBounds) {
+		t.Errorf("Expected index out of bounds for file 3, but got (%v)", err)
+	}
+
+	rp.Close()
+
+	os.Remove(test_file)
+}
@@ -13,35 +13,187 @@
 //      - Block length (Up to the block size defined in the header, can be less) (uint64 big endian) (8 bytes)
 // Blocks (rest of the file)
 // Every block is encrypted
+// ---
+// Authenticated file structure (version 2):
+// Header:
+//   - Magic (0xFF 'E' 'B' 'F') (4 bytes). Since the first byte is 0xFF, it is never a valid file size of the first format.
+//   - Version (2) (1 byte)
+//   - Flags (1 byte). Bit 0 (0x01): The block index is stored in a footer
+//   - Extensions length (uint16 big endian) (2 bytes)
+//   - File size in bytes (uint64 big endian) (8 bytes). All bits set (0xFF...) if the block index is stored in a footer
+//   - Block size in bytes (uint64 big endian) (8 bytes)
+//   - File ID (random, unless chosen by the caller) (16 bytes)
+// Extensions. Sequence of entries, each one:
+//   - Type (uint16 big endian) (2 bytes)
+//   - Length (uint16 big endian) (2 bytes)
+//   - Value (Length bytes)
+//   Unknown types are skipped. Known types:
+//   - 1: Wrapped data key (see envelope.go)
+//   - 2: Recipients header (see recipients.go). The blocks are encrypted with a key derived from the file key and the recipients header
+//   - 3: Signature (see signature.go)
+//   - 4: Block method. Method ID (uint16 big endian) (2 bytes) + Flags (1 byte, 0x01 = auto compression). Informative only,
+//        every block declares its own method
+// Block Index (same as the first format). Not present if it is stored in a footer
+// Blocks (rest of the file)
+// Every block is encrypted with an authenticated method (AES256_GCM_ZIP by default), using the fixed header (40 bytes)
+// and the block index (uint64 big endian) as associated data,
+// so blocks cannot be moved to another position or to another file.
+// ---
+// Footer (authenticated format, if the flag is set, for files written without knowing the size up front):
+//   - Encrypted footer, using the fixed header and 0xFFFFFFFFFFFFFFFF as associated data. Contents:
+//      - File size in bytes (uint64 big endian) (8 bytes)
+//      - Block count (uint64 big endian) (8 bytes)
+//      - Block Index (same as the first format)
+//   - Length of the encrypted footer (uint64 big endian) (8 bytes)
 
 package encrypted_storage
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 )
 
+const (
+	FILE_BLOCK_HEADER_SIZE               = 16 // Size of the header of the block-encrypted files, in bytes
+	FILE_BLOCK_AUTHENTICATED_HEADER_SIZE = 40 // Size of the fixed header of the authenticated block-encrypted files, in bytes
+	FILE_BLOCK_FILE_ID_SIZE              = 16 // Size of the file ID of the authenticated block-encrypted files, in bytes
+
+	file_block_authenticated_version = 2              // Version of the authenticated format
+	file_block_authenticated_method  = AES256_GCM_ZIP // Method used for the blocks of the authenticated format
+)
+
+const (
+	FILE_BLOCK_EXTENSION_WRAPPED_KEY = 1 // Header extension: Data key, wrapped with the master key
+	FILE_BLOCK_EXTENSION_RECIPIENTS  = 2 // Header extension: Recipients header, with the data key wrapped for each recipient
+	FILE_BLOCK_EXTENSION_SIGNATURE   = 3 // Header extension: Public key of the signer + Ed25519 signature
+	FILE_BLOCK_EXTENSION_METHOD      = 4 // Header extension: Method chosen to encrypt the blocks
+
+	file_block_method_auto_compression = 0x01 // Flag of the method extension: Auto compression enabled
+
+	FILE_BLOCK_FLAG_FOOTER_INDEX = 0x01 // Header flag: The block index is stored in a footer (see FileBlockEncryptOptions.UnknownSize)
+
+	file_block_footer_index = -1 // Index used in the associated data of the footer
+)
+
+// Magic number of the authenticated block-encrypted files
+var file_block_authenticated_magic = []byte{0xFF, 'E', 'B', 'F'}
+
+// Options for block-encrypted files
+type FileBlockEncryptOptions struct {
+	// Use the authenticated format (version 2): blocks are encrypted with AES256_GCM_ZIP and bound to the file and their position,
+	// so they cannot be modified, reordered, removed or copied from another file.
+	Authenticated bool
+
+	// Keyring. If set, the active key is used instead of the key, and every block contains the ID of the key (see KEY_ID_WRAPPER).
+	// Read the file with CreateFileBlockEncryptReadStreamWithKeyring.
+	Keyring *Keyring
+
+	// Envelope encryption. If true, the blocks are encrypted with a random data key, stored in the header wrapped with the key
+	// (the master key), so the master key can be changed with RewrapFileBlockEncryptKey without encrypting the blocks again.
+	// It requires the authenticated format, that is used even if Authenticated is false.
+	// If Keyring is set, the active key is used as master key, and the blocks do not contain key IDs.
+	Envelope bool
+
+	// Recipients. If set, the blocks are encrypted with a random data key, wrapped for each recipient and stored in the header.
+	// The key is ignored, and the file can only be read with the identity of a recipient (see CreateFileBlockEncryptReadStreamWithIdentities).
+	// It requires the authenticated format, that is used even if Authenticated is false. It cannot be combined with Envelope.
+	Recipients []Recipient
+
+	// Signer. If set, the file is signed with this Ed25519 private key on Close, so VerifyFileBlockEncryptSignature
+	// can report who produced it. The signature covers the fixed header, the block index and the blocks.
+	// It requires the authenticated format, that is used even if Authenticated is false.
+	Signer ed25519.PrivateKey
+
+	// Unknown size. If true, the file size is not required (the file_size argument is ignored), so the data can come
+	// from a pipe or a live source. The block index is written as an encrypted footer on Close.
+	// It requires the authenticated format, that is used even if Authenticated is false.
+	UnknownSize bool
+
+	// Method to encrypt the blocks. If not set, AES256_ZIP is used for the original format, and AES256_GCM_ZIP for the authenticated format.
+	// It must support associated data (for example, AES256_GCM for already compressed data, like videos).
+	// The method is recorded in the header (see FileBlockEncryptReadStream.BlockMethod).
+	// It requires the authenticated format, that is used even if Authenticated is false.
+	Method FileEncryptionMethod
+
+	// Auto compression. If true, each block is compressed only if it saves enough space (see EncryptOptions.AutoCompression),
+	// so blocks of incompressible data are encrypted with the equivalent method without compression.
+	// It is recorded in the header, like Method. It requires the authenticated format, that is used even if Authenticated is false.
+	AutoCompression bool
+
+	// Number of goroutines encrypting the blocks in parallel. If greater than 1, the blocks are encrypted concurrently,
+	// and written into the file in order by another goroutine, so the format is the same.
+	// Up to 2 blocks per worker are kept in memory. Errors of a block are returned by a later Write, or by Close.
+	Workers int
+
+	// Compression level of the blocks, from COMPRESSION_LEVEL_FASTEST (1) to COMPRESSION_LEVEL_BEST (9).
+	// Set to 0 for the default level. Ignored by methods without compression
+	CompressionLevel int
+
+	// File ID (FILE_BLOCK_FILE_ID_SIZE bytes). If not set, a random ID is generated for every file.
+	// The file ID is part of the associated data of the blocks, so a stable ID, together with a deterministic method (AES256_SIV),
+	// makes unchanged blocks of different versions of a file encrypt to the same data, so they can be deduplicated.
+	// The rest of the fixed header must also match: use UnknownSize, so the file size is not part of it.
+	// Reuse the ID of a previous version with FileBlockEncryptReadStream.FileID. Files sharing an ID are not distinguished,
+	// so blocks can be moved between them. Envelope and Recipients use a random data key, so they cannot be deduplicated.
+	// It requires the authenticated format, that is used even if Authenticated is false.
+	FileID []byte
+}
+
 //////////////////////////
 //     WRITE STREAM    //
 /////////////////////////
 
 // Status of a write stream
 type FileBlockEncryptWriteStream struct {
-	f *os.File // File descriptor
+	w      io.WriterAt        // Destination (nil if it is written sequentially)
+	f      write_seeker_at    // Destination, with a cursor
+	seq    *sequential_writer // Destination written sequentially (nil if it is written at any position)
+	closer io.Closer          // File closed with the stream (nil if it was provided by the caller)
 
 	file_size   int64 // File size in bytes
 	block_size  int64 // Block size in bytes
 	block_count int64 // Block count
 
-	key []byte // Encryption key
+	key        []byte     // Encryption key
+	key_id     *KeyID     // ID of the key, if it was taken from a keyring
+	secret_key *SecretKey // Secret key the key was taken from, checked before every block (nil if not used)
+	owns_key   bool       // True if the key is a data key generated by the stream, wiped on Close
+
+	compression_level int // Compression level of the blocks
+
+	header_size int64  // Size of the header (including extensions), in bytes
+	ad_header   []byte // Header used as associated data for the blocks (nil for the non-authenticated format)
 
 	current_write_index int64 // Current block being written
 	current_write_pt    int64 // Position of the file to write the next block
 
+	next_index int64               // Index of the next block to encrypt (ahead of current_write_index if the blocks are encrypted in parallel)
+	workers    *file_block_workers // Workers encrypting the blocks in parallel (nil if not used)
+
+	method           FileEncryptionMethod // Method to encrypt the blocks
+	auto_compression bool                 // True to enable auto compression for every block
+
+	unknown_size bool   // True if the file size is unknown, so the block index is written as a footer
+	footer_index []byte // Block index, written as a footer on Close (unknown size only)
+
+	signer           ed25519.PrivateKey // Private key to sign the file on Close (nil if not signed)
+	signature_offset int64              // Position of the signature extension value in the file
+	index_hash       hash.Hash          // Hash of the block index, for the signature
+	blocks_hash      hash.Hash          // Hash of the blocks, for the signature
+
 	buf []byte // Write buffer
+
+	cache   cipher_cache // Cipher instances reused for every block
+	enc_buf []byte       // Buffer reused to encrypt the blocks
+	ad_buf  []byte       // Buffer reused for the associated data of the blocks
 }
 
 // Creates a write stream
@@ -54,11 +206,55 @@ func CreateFileBlockEncryptWriteStream(file string, perm fs.FileMode) (*FileBloc
 		return nil, err
 	}
 
+	i := NewFileBlockEncryptWriteStream(f)
+	i.closer = f
+
+	return i, nil
+}
+
+// Creates a write stream, writing into an already open file, a buffer, or a file of a storage backend
+// The data is written from the start. If the destination has a Truncate method, it is truncated on Initialize.
+// It is not closed with the stream
+// w - Destination
+func NewFileBlockEncryptWriteStream(w io.WriterAt) *FileBlockEncryptWriteStream {
 	i := FileBlockEncryptWriteStream{
-		f: f,
+		w: w,
+		f: io.NewOffsetWriter(w, 0),
 	}
 
-	return &i, nil
+	return &i
+}
+
+// Creates a write stream, creating the file in a storage backend. The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+func OpenFileBlockEncryptWriteStream(backend Backend, name string) (*FileBlockEncryptWriteStream, error) {
+	f, err := backend.Create(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := NewFileBlockEncryptWriteStream(f)
+	i.closer = f
+
+	return i, nil
+}
+
+// Creates a write stream, writing sequentially into a writer (for example, an upload to an object storage)
+// If the writer implements io.Seeker, the stream seeks it to write the block index and the signature.
+// Otherwise, the file must have an unknown size (FileBlockEncryptOptions.UnknownSize), and it cannot be signed (ErrInvalidArgument is returned on Initialize).
+// Positions are relative to the position of the writer when the stream is initialized. It is not closed with the stream
+// w - Destination
+func NewFileBlockEncryptSequentialWriteStream(w io.Writer) *FileBlockEncryptWriteStream {
+	seq := new_sequential_writer(w)
+
+	i := FileBlockEncryptWriteStream{
+		f:   seq,
+		seq: seq,
+	}
+
+	return &i
 }
 
 // Initializes the file
@@ -67,252 +263,1143 @@ func CreateFileBlockEncryptWriteStream(file string, perm fs.FileMode) (*FileBloc
 // block_size - Block size in bytes
 // key - Encryption key
 func (file *FileBlockEncryptWriteStream) Initialize(file_size int64, block_size int64, key []byte) error {
+	return file.InitializeWithOptions(file_size, block_size, key, FileBlockEncryptOptions{})
+}
+
+// Initializes the file, with a secret key and options
+// Must be called before any writes
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, writing fails with ErrInvalidKey.
+// file_size - Size of the original file to encrypt
+// block_size - Block size in bytes
+// key - Secret key. Ignored if options.Keyring is set
+// options - Options
+func (file *FileBlockEncryptWriteStream) InitializeWithSecretKey(file_size int64, block_size int64, key *SecretKey, options FileBlockEncryptOptions) error {
+	if key == nil {
+		return ErrInvalidKey
+	}
+
+	key_bytes, err := key.acquire()
+
+	if err != nil {
+		return err
+	}
+
+	defer key.release()
+
+	err = file.InitializeWithOptions(file_size, block_size, key_bytes, options)
+
+	if err != nil {
+		return err
+	}
+
+	if !file.owns_key && file.key_id == nil {
+		// The blocks are encrypted with the secret key
+		file.secret_key = key
+	}
+
+	return nil
+}
+
+// Initializes the file, with options
+// Must be called before any writes
+// file_size - Size of the original file to encrypt
+// block_size - Block size in bytes
+// key - Encryption key. Ignored if options.Keyring is set
+// options - Options
+func (file *FileBlockEncryptWriteStream) InitializeWithOptions(file_size int64, block_size int64, key []byte, options FileBlockEncryptOptions) error {
+	if options.UnknownSize {
+		// Counted as the blocks are written
+		file_size = 0
+	}
+
+	if file_size < 0 || block_size <= 0 {
+		return ErrInvalidArgument
+	}
+
+	if file.workers != nil {
+		file.workers.stop()
+		file.workers = nil
+	}
+
+	file.drop_key()
+	file.signer = nil
+
+	if options.Envelope && len(options.Recipients) > 0 {
+		return ErrInvalidArgument
+	}
+
+	if options.Signer != nil && len(options.Signer) != ed25519.PrivateKeySize {
+		return ErrInvalidKey
+	}
+
+	if options.Method != 0 && !is_file_block_method(options.Method) {
+		return ErrInvalidMethod
+	}
+
+	if options.FileID != nil && len(options.FileID) != FILE_BLOCK_FILE_ID_SIZE {
+		return ErrInvalidArgument
+	}
+
+	if options.CompressionLevel < COMPRESSION_LEVEL_DEFAULT || options.CompressionLevel > COMPRESSION_LEVEL_BEST {
+		return ErrInvalidArgument
+	}
+
+	if file.seq != nil && !file.seq.seekable() && (!options.UnknownSize || options.Signer != nil) {
+		// The block index and the signature are written before the blocks
+		return ErrInvalidArgument
+	}
+
+	if options.Keyring != nil && len(options.Recipients) == 0 {
+		id, active_key, err := options.Keyring.active_key()
+
+		if err != nil {
+			return err
+		}
+
+		key = active_key
+		file.key_id = &id
+	}
+
+	if len(options.Recipients) == 0 && !is_valid_key_size(len(key)) {
+		return ErrInvalidKey
+	}
+
 	blockCount := file_size / block_size
 
 	if file_size%block_size != 0 {
 		blockCount++
 	}
 
-	file.file_size = file_size
-	file.block_count = blockCount
-	file.block_size = block_size
-	file.key = key
+	file.file_size = file_size
+	file.block_count = blockCount
+	file.block_size = block_size
+	file.key = key
+
+	// Build the header
+
+	var header []byte
+
+	file.unknown_size = options.UnknownSize
+	file.footer_index = nil
+
+	if options.UnknownSize {
+		// The block index is written as a footer
+		blockCount = 0
+		file.footer_index = make([]byte, 0)
+	}
+
+	file.method = AES256_ZIP
+	file.auto_compression = options.AutoCompression
+	file.compression_level = options.CompressionLevel
+
+	if options.Authenticated || options.Envelope || len(options.Recipients) > 0 || options.Signer != nil || options.UnknownSize || options.Method != 0 || options.AutoCompression || options.FileID != nil {
+		file.method = file_block_authenticated_method
+
+		if options.Method != 0 {
+			file.method = options.Method
+		}
+
+		header = make([]byte, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE)
+
+		copy(header[0:4], file_block_authenticated_magic)
+		header[4] = file_block_authenticated_version
+		header[5] = 0                              // Flags
+		binary.BigEndian.PutUint16(header[6:8], 0) // Extensions length (set below)
+		binary.BigEndian.PutUint64(header[8:16], uint64(file_size))
+		binary.BigEndian.PutUint64(header[16:24], uint64(block_size))
+
+		if options.UnknownSize {
+			header[5] |= FILE_BLOCK_FLAG_FOOTER_INDEX
+			binary.BigEndian.PutUint64(header[8:16], ^uint64(0))
+		}
+
+		if options.FileID != nil {
+			copy(header[24:40], options.FileID)
+		} else {
+			// Random file ID
+			_, err := rand.Read(header[24:40])
+
+			if err != nil {
+				return err
+			}
+		}
+
+		// The extensions length must be set before wrapping the data key, since the header is authenticated
+
+		// Size of the extensions after the key extension (signature and method)
+		extensions_size := 0
+
+		if options.Signer != nil {
+			extensions_size += 4 + FILE_BLOCK_SIGNATURE_SIZE
+		}
+
+		var method_extension []byte
+
+		if options.Method != 0 || options.AutoCompression {
+			method_extension = binary.BigEndian.AppendUint16(make([]byte, 0, 3), uint16(file.method))
+
+			if options.AutoCompression {
+				method_extension = append(method_extension, file_block_method_auto_compression)
+			} else {
+				method_extension = append(method_extension, 0)
+			}
+
+			extensions_size += 4 + len(method_extension)
+		}
+
+		binary.BigEndian.PutUint16(header[6:8], uint16(extensions_size))
+
+		if options.Envelope {
+			binary.BigEndian.PutUint16(header[6:8], uint16(4+WRAPPED_KEY_SIZE+extensions_size))
+
+			data_key, wrapped_key, err := generate_data_key(key, header)
+
+			if err != nil {
+				return err
+			}
+
+			// The blocks are encrypted with the data key
+			file.key = data_key
+			file.key_id = nil
+			file.owns_key = true
+
+			header = append(header, encode_header_extension(FILE_BLOCK_EXTENSION_WRAPPED_KEY, wrapped_key)...)
+		} else if len(options.Recipients) > 0 {
+			data_key, recipients_header, err := generate_file_key_for_recipients(options.Recipients)
+
+			if err != nil {
+				return err
+			}
+
+			if 4+len(recipients_header)+extensions_size > 0xFFFF {
+				return ErrDataTooLarge
+			}
+
+			binary.BigEndian.PutUint16(header[6:8], uint16(4+len(recipients_header)+extensions_size))
+
+			// The blocks are encrypted with a key derived from the data key, bound to the recipients header
+			block_key, err := derive_recipients_block_key(data_key, recipients_header)
+			clear(data_key)
+
+			if err != nil {
+				return err
+			}
+
+			file.key = block_key
+			file.key_id = nil
+			file.owns_key = true
+
+			header = append(header, encode_header_extension(FILE_BLOCK_EXTENSION_RECIPIENTS, recipients_header)...)
+		}
+
+		if options.Signer != nil {
+			// Reserve the space for the signature, written on Close
+			file.signer = options.Signer
+			file.signature_offset = int64(len(header)) + 4
+			file.index_hash = sha256.New()
+			file.blocks_hash = sha256.New()
+
+			header = append(header, encode_header_extension(FILE_BLOCK_EXTENSION_SIGNATURE, make([]byte, FILE_BLOCK_SIGNATURE_SIZE))...)
+		}
+
+		if method_extension != nil {
+			header = append(header, encode_header_extension(FILE_BLOCK_EXTENSION_METHOD, method_extension)...)
+		}
+
+		file.ad_header = header[:FILE_BLOCK_AUTHENTICATED_HEADER_SIZE:FILE_BLOCK_AUTHENTICATED_HEADER_SIZE]
+	} else {
+		header = make([]byte, FILE_BLOCK_HEADER_SIZE)
+
+		binary.BigEndian.PutUint64(header[0:8], uint64(file_size))
+		binary.BigEndian.PutUint64(header[8:16], uint64(block_size))
+
+		file.ad_header = nil
+	}
+
+	file.header_size = int64(len(header))
+
+	// Set the size of the file
+	if t, ok := file.w.(truncater); ok {
+		err := t.Truncate(file.header_size + (16)*blockCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Rewind to the start of the file
+	_, err := file.f.Seek(0, 0)
+
+	if err != nil {
+		return err
+	}
+
+	// Write header
+	_, err = file.f.Write(header)
+	if err != nil {
+		return err
+	}
+
+	// Write default block values
+	b := make([]byte, 8)
+	for i := int64(0); i < blockCount; i++ {
+		_, err = file.f.Write(b)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.f.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	file.current_write_index = 0
+	file.current_write_pt = file.header_size + (16)*blockCount
+	file.next_index = 0
+	file.buf = make([]byte, 0)
+
+	if options.Workers > 1 {
+		file.workers = start_file_block_workers(file, options.Workers)
+	}
+
+	return nil
+}
+
+// Writes data (implements io.Writer)
+// Full blocks are encrypted and written as soon as they are available. The rest is buffered until the next write, or Close.
+// data - Chunk of data to write
+// Returns the number of bytes written. If the data exceeds the file size, nothing is written and ErrFileSizeExceeded is returned
+func (file *FileBlockEncryptWriteStream) Write(data []byte) (int, error) {
+	if !file.unknown_size && file.next_index*file.block_size+int64(len(file.buf))+int64(len(data)) > file.file_size {
+		return 0, ErrFileSizeExceeded
+	}
+
+	n := 0
+
+	for len(data) > 0 {
+		if len(file.buf) == 0 && int64(len(data)) >= file.block_size {
+			// Full block, encrypt it without copying it into the buffer
+			err := file.write_block(data[:file.block_size])
+
+			if err != nil {
+				return n, err
+			}
+
+			data = data[file.block_size:]
+			n += int(file.block_size)
+
+			continue
+		}
+
+		// Fill the buffer, up to the block size
+		c := int(min(file.block_size-int64(len(file.buf)), int64(len(data))))
+
+		file.buf = append(file.buf, data[:c]...)
+		data = data[c:]
+		n += c
+
+		if int64(len(file.buf)) == file.block_size {
+			err := file.write_block(file.buf)
+
+			if err != nil {
+				return n, err
+			}
+
+			file.buf = file.buf[:0]
+		}
+	}
+
+	return n, nil
+}
+
+// Writes data, returning only the error
+// Deprecated: Use Write, that implements io.Writer
+// data - Chunk of data to write
+func (file *FileBlockEncryptWriteStream) WriteData(data []byte) error {
+	_, err := file.Write(data)
+	return err
+}
+
+// Reads data from a reader until EOF, and writes it (implements io.ReaderFrom, used by io.Copy)
+// The data is read directly into a buffer of the block size, so no intermediate buffer is needed
+// r - Reader
+// Returns the number of bytes read. If the data exceeds the file size, ErrFileSizeExceeded is returned
+func (file *FileBlockEncryptWriteStream) ReadFrom(r io.Reader) (int64, error) {
+	if int64(cap(file.buf)) < file.block_size {
+		buf := make([]byte, len(file.buf), file.block_size)
+		copy(buf, file.buf)
+		file.buf = buf
+	}
+
+	total := int64(0)
+
+	for {
+		space := file.block_size - int64(len(file.buf))
+
+		if !file.unknown_size {
+			remaining := file.file_size - file.next_index*file.block_size - int64(len(file.buf))
+
+			if remaining <= 0 {
+				// The file is complete, check the reader has no more data
+				n, err := io.ReadFull(r, make([]byte, 1))
+
+				if n > 0 {
+					return total, ErrFileSizeExceeded
+				}
+
+				if err == io.EOF {
+					return total, nil
+				}
+
+				return total, err
+			}
+
+			space = min(space, remaining)
+		}
+
+		n, err := r.Read(file.buf[len(file.buf) : int64(len(file.buf))+space])
+
+		file.buf = file.buf[:len(file.buf)+n]
+		total += int64(n)
+
+		if int64(len(file.buf)) == file.block_size {
+			write_err := file.write_block(file.buf)
+
+			if write_err != nil {
+				return total, write_err
+			}
+
+			file.buf = file.buf[:0]
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Closes the file, writing any pending data in the buffer
+func (file *FileBlockEncryptWriteStream) Close() error {
+	if len(file.buf) > 0 {
+		var err error
+
+		if !file.unknown_size && file.next_index >= file.block_count {
+			err = ErrFileSizeExceeded
+		} else {
+			err = file.write_block(file.buf)
+		}
+
+		if err != nil {
+			return file.close_with_error(err)
+		}
+
+		file.buf = file.buf[:0]
+	}
+
+	if file.workers != nil {
+		// Wait for the pending blocks
+		err := file.workers.stop()
+		file.workers = nil
+
+		if err != nil {
+			return file.close_with_error(err)
+		}
+	}
+
+	if file.unknown_size {
+		err := file.write_footer()
+
+		if err != nil {
+			return file.close_with_error(err)
+		}
+	}
+
+	file.drop_key()
+
+	if file.signer != nil {
+		err := file.write_signature()
+
+		if err != nil {
+			return file.close_with_error(err)
+		}
+	}
+
+	return file.close_file()
+}
+
+// Releases the resources of the stream after an error: stops the workers, drops the key and closes the file
+// err - Error
+// Returns the error, joined with the error closing the file, if any
+func (file *FileBlockEncryptWriteStream) close_with_error(err error) error {
+	if file.workers != nil {
+		file.workers.stop()
+		file.workers = nil
+	}
+
+	file.drop_key()
+
+	return errors.Join(err, file.close_file())
+}
+
+// Closes the file owned by the stream, only once
+// Returns the error closing the file
+func (file *FileBlockEncryptWriteStream) close_file() error {
+	closer := file.closer
+	file.closer = nil
+
+	return close_storage(closer)
+}
+
+// Drops the references to the key, wiping it if it was generated by the stream
+func (file *FileBlockEncryptWriteStream) drop_key() {
+	if file.owns_key {
+		clear(file.key)
+	}
+
+	file.key = nil
+	file.key_id = nil
+	file.secret_key = nil
+	file.owns_key = false
+	file.cache.clear()
+}
+
+// Writes the block index as an encrypted footer, followed by its length (unknown size only)
+func (file *FileBlockEncryptWriteStream) write_footer() error {
+	footer := make([]byte, 16, 16+len(file.footer_index))
+
+	binary.BigEndian.PutUint64(footer[0:8], uint64(file.file_size))            // File size
+	binary.BigEndian.PutUint64(footer[8:16], uint64(file.current_write_index)) // Block count
+
+	footer = append(footer, file.footer_index...)
+
+	content, err := file.encrypt_block(footer, file_block_footer_index)
+
+	if err != nil {
+		return err
+	}
+
+	content = binary.BigEndian.AppendUint64(content, uint64(len(content)))
+
+	_, err = file.f.Seek(file.current_write_pt, 0)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.f.Write(content)
+
+	if err != nil {
+		return err
+	}
+
+	if file.signer != nil {
+		// The footer takes the place of the block index
+		file.index_hash.Write(content)
+	}
+
+	file.current_write_pt += int64(len(content))
+
+	return nil
+}
+
+// Signs the file, writing the signature into its header extension
+func (file *FileBlockEncryptWriteStream) write_signature() error {
+	// Blocks not written have an empty index entry
+	empty_entry := make([]byte, 16)
+
+	for i := file.current_write_index; i < file.block_count; i++ {
+		file.index_hash.Write(empty_entry)
+	}
+
+	public_key := file.signer.Public().(ed25519.PublicKey)
+	message := file_block_signature_message(public_key, file.ad_header, file.index_hash.Sum(nil), file.blocks_hash.Sum(nil))
+
+	value := make([]byte, 0, FILE_BLOCK_SIGNATURE_SIZE)
+	value = append(value, public_key...)
+	value = append(value, ed25519.Sign(file.signer, message)...)
+
+	_, err := file.f.WriteAt(value, file.signature_offset)
+
+	return err
+}
+
+// Encrypts a block and writes it into the file, with its index entry
+// If the blocks are encrypted in parallel, it is queued instead
+// data - Block data
+func (file *FileBlockEncryptWriteStream) write_block(data []byte) error {
+	if file.workers != nil {
+		err := file.workers.submit(file.next_index, data)
+
+		if err != nil {
+			return err
+		}
+
+		file.next_index++
+
+		return nil
+	}
+
+	content, err := file.encrypt_block(data, file.current_write_index)
+
+	if err != nil {
+		return &BlockError{BlockIndex: file.current_write_index, Offset: file.current_write_pt, Err: err}
+	}
+
+	err = file.commit_block(content, int64(len(data)))
+
+	if err != nil {
+		return err
+	}
+
+	file.next_index = file.current_write_index
+
+	return nil
+}
+
+// Writes an encrypted block into the file, with its index entry, after the previous one
+// content - Encrypted block
+// data_size - Size of the block data, before encrypting it
+func (file *FileBlockEncryptWriteStream) commit_block(content []byte, data_size int64) error {
+	// Save metadata
+
+	entry := make([]byte, 16)
+
+	binary.BigEndian.PutUint64(entry[0:8], uint64(file.current_write_pt)) // Start pointer
+	binary.BigEndian.PutUint64(entry[8:16], uint64(len(content)))         // Length
+
+	if file.unknown_size {
+		// Written on Close
+		file.footer_index = append(file.footer_index, entry...)
+		file.file_size += data_size
+	} else {
+		_, err := file.f.Seek(file.header_size+file.current_write_index*16, 0)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = file.f.Write(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write data
+
+	_, err := file.f.Seek(file.current_write_pt, 0)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.f.Write(content)
+	if err != nil {
+		return err
+	}
+
+	if file.signer != nil {
+		if !file.unknown_size {
+			file.index_hash.Write(entry)
+		}
+
+		file.blocks_hash.Write(content)
+	}
+
+	file.current_write_index++
+	file.current_write_pt += int64(len(content))
+
+	return nil
+}
+
+// Encrypts a block (or the footer)
+// data - Data to encrypt
+// index - Index of the block, for the associated data
+// Returns the encrypted data, stored in the encryption buffer (valid until the next call)
+func (file *FileBlockEncryptWriteStream) encrypt_block(data []byte, index int64) ([]byte, error) {
+	content, err := file.encrypt_block_to(file.enc_buf[:0], &file.ad_buf, data, index, &file.cache)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file.enc_buf = content
+
+	return content, nil
+}
+
+// Encrypts a block (or the footer), with the given buffers and cipher instances
+// Safe to call from several goroutines, with different buffers and caches
+// dst - Buffer to append the encrypted data to
+// ad_buf - Buffer for the associated data
+// data - Data to encrypt
+// index - Index of the block, for the associated data
+// cache - Cipher instances
+// Returns the encrypted data, appended to dst
+func (file *FileBlockEncryptWriteStream) encrypt_block_to(dst []byte, ad_buf *[]byte, data []byte, index int64, cache *cipher_cache) ([]byte, error) {
+	if file.secret_key != nil {
+		// Prevent the key from being destroyed while the block is encrypted
+		_, err := file.secret_key.acquire()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.secret_key.release()
+	}
+
+	method := file.method
+	options := EncryptOptions{
+		CompressionLevel: file.compression_level,
+		AutoCompression:  file.auto_compression,
+	}
+
+	if file.ad_header != nil {
+		*ad_buf = append_indexed_associated_data((*ad_buf)[:0], file.ad_header, index)
+		options.AssociatedData = *ad_buf
+	}
+
+	if file.key_id != nil {
+		return encrypt_with_key_id(dst, data, method, file.key, *file.key_id, options, cache)
+	}
+
+	return encrypt_file_contents(dst, data, method, file.key, options, cache)
+}
+
+// Checks a method can be used to encrypt the blocks of the authenticated format
+// method - Method ID
+func is_file_block_method(method FileEncryptionMethod) bool {
+	if method == KEY_ID_WRAPPER || method == RECIPIENTS_WRAPPER || method == SIGNATURE_WRAPPER {
+		return false
+	}
+
+	m, ok := GetEncryptionMethod(method)
+
+	if !ok {
+		return false
+	}
+
+	_, ok = m.(AssociatedDataEncryptionMethod)
+
+	return ok
+}
+
+// Encodes a header extension
+// ext_type - Type of extension
+// value - Value
+// Returns the encoded extension
+func encode_header_extension(ext_type uint16, value []byte) []byte {
+	result := make([]byte, 4+len(value))
+	binary.BigEndian.PutUint16(result[0:2], ext_type)
+	binary.BigEndian.PutUint16(result[2:4], uint16(len(value)))
+	copy(result[4:], value)
+	return result
+}
+
+// Finds a header extension
+// extensions - Extensions area of the header
+// ext_type - Type of extension
+// Returns the value, its offset in the extensions area, and true if it was found
+func find_header_extension(extensions []byte, ext_type uint16) ([]byte, int, bool) {
+	offset := 0
+
+	for offset+4 <= len(extensions) {
+		t := binary.BigEndian.Uint16(extensions[offset : offset+2])
+		l := int(binary.BigEndian.Uint16(extensions[offset+2 : offset+4]))
+
+		if offset+4+l > len(extensions) {
+			return nil, 0, false
+		}
+
+		if t == ext_type {
+			return extensions[offset+4 : offset+4+l], offset + 4, true
+		}
+
+		offset += 4 + l
+	}
+
+	return nil, 0, false
+}
+
+//////////////////////////
+//     READ STREAM     //
+/////////////////////////
+
+// Status of a read stream
+type FileBlockEncryptReadStream struct {
+	f      *io.SectionReader // Source
+	f_size int64             // Size of the encrypted file in bytes
+	closer io.Closer         // File closed with the stream (nil if it was provided by the caller)
+
+	file_size   int64 // Original (unencrypted) file size in bytes
+	block_size  int64 // Block size in bytes
+	block_count int64 // Total number of blocks
+
+	key        []byte     // Decryption key
+	keyring    *Keyring   // Keyring to find the decryption key of each block (nil to use the key)
+	secret_key *SecretKey // Secret key the key was taken from, checked before every block (nil if not used)
+	owns_key   bool       // True if the key is a data key unwrapped by the stream, wiped on Close
+
+	header_size int64  // Size of the header (including extensions), in bytes
+	ad_header   []byte // Header used as associated data for the blocks (nil for the non-authenticated format)
+	index       []byte // Block index, read from the footer (nil if the block index is after the header)
+
+	block_method     FileEncryptionMethod // Method chosen to encrypt the blocks, recorded in the header
+	auto_compression bool                 // True if auto compression was enabled, recorded in the header
+
+	cur_pos int64 // Current position of the read cursor
+
+	cur_block      int64  // Current block the cursor is reading
+	cur_block_data []byte // Buffer to store the current block (Decrypted)
+
+	cache    cipher_cache // Cipher instances reused for every block
+	read_buf []byte       // Buffer reused to read the encrypted blocks
+	ad_buf   []byte       // Buffer reused for the associated data of the blocks
+}
+
+// Creates a read stream
+// file - Path to the file
+// key - Decryption key
+// perm - File mode
+func CreateFileBlockEncryptReadStream(file string, key []byte, perm fs.FileMode) (*FileBlockEncryptReadStream, error) {
+	return open_file_block_encrypt_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStream(r, size, key)
+	})
+}
+
+// Creates a read stream, with a secret key
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// file - Path to the file
+// key - Secret key
+// perm - File mode
+func CreateFileBlockEncryptReadStreamWithSecretKey(file string, key *SecretKey, perm fs.FileMode) (*FileBlockEncryptReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	return open_file_block_encrypt_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithSecretKey(r, size, key)
+	})
+}
+
+// Creates a read stream, finding the decryption key of each block in a keyring
+// file - Path to the file
+// keyring - Keyring
+// perm - File mode
+func CreateFileBlockEncryptReadStreamWithKeyring(file string, keyring *Keyring, perm fs.FileMode) (*FileBlockEncryptReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	return open_file_block_encrypt_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithKeyring(r, size, keyring)
+	})
+}
+
+// Creates a read stream for a file encrypted for recipients
+// file - Path to the file
+// identities - Identities. Any of them can be used to decrypt
+// perm - File mode
+func CreateFileBlockEncryptReadStreamWithIdentities(file string, identities []Identity, perm fs.FileMode) (*FileBlockEncryptReadStream, error) {
+	if len(identities) == 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	return open_file_block_encrypt_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithIdentities(r, size, identities)
+	})
+}
 
-	// Set the size of the file
-	err := file.f.Truncate(16 + (16)*blockCount)
-	if err != nil {
-		return err
+// Creates a read stream, opening a file in a storage backend. The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+// key - Decryption key
+func OpenFileBlockEncryptReadStream(backend Backend, name string, key []byte) (*FileBlockEncryptReadStream, error) {
+	return open_file_block_encrypt_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStream(r, size, key)
+	})
+}
+
+// Creates a read stream with a secret key, opening a file in a storage backend. The file is closed with the stream
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// backend - Backend
+// name - Name of the file
+// key - Secret key
+func OpenFileBlockEncryptReadStreamWithSecretKey(backend Backend, name string, key *SecretKey) (*FileBlockEncryptReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
 	}
 
-	// Rewind to the start of the file
-	_, err = file.f.Seek(0, 0)
+	return open_file_block_encrypt_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithSecretKey(r, size, key)
+	})
+}
 
-	if err != nil {
-		return err
+// Creates a read stream finding the decryption key of each block in a keyring, opening a file in a storage backend
+// The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+// keyring - Keyring
+func OpenFileBlockEncryptReadStreamWithKeyring(backend Backend, name string, keyring *Keyring) (*FileBlockEncryptReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
 	}
 
-	// Write size
-	b := make([]byte, 8)
+	return open_file_block_encrypt_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithKeyring(r, size, keyring)
+	})
+}
 
-	binary.BigEndian.PutUint64(b, uint64(file_size))
-	_, err = file.f.Write(b)
-	if err != nil {
-		return err
+// Creates a read stream for a file encrypted for recipients, opening a file in a storage backend
+// The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+// identities - Identities. Any of them can be used to decrypt
+func OpenFileBlockEncryptReadStreamWithIdentities(backend Backend, name string, identities []Identity) (*FileBlockEncryptReadStream, error) {
+	if len(identities) == 0 {
+		return nil, ErrInvalidArgument
 	}
 
-	// Write block size
-	binary.BigEndian.PutUint64(b, uint64(block_size))
-	_, err = file.f.Write(b)
+	return open_file_block_encrypt_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error) {
+		return NewFileBlockEncryptReadStreamWithIdentities(r, size, identities)
+	})
+}
+
+// Opens a file, and creates a read stream for it. The file is closed with the stream
+// open - Function to open the file
+// create - Function to create the read stream
+func open_file_block_encrypt_read_stream_file(open storage_opener, create func(r io.ReaderAt, size int64) (*FileBlockEncryptReadStream, error)) (*FileBlockEncryptReadStream, error) {
+	f, size, err := open()
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Write default block values
-	binary.BigEndian.PutUint64(b, 0)
-	for i := int64(0); i < blockCount; i++ {
-		_, err = file.f.Write(b)
-		if err != nil {
-			return err
-		}
+	i, err := create(f, size)
 
-		_, err = file.f.Write(b)
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
-	file.current_write_index = 0
-	file.current_write_pt = 16 + (16)*blockCount
-	file.buf = make([]byte, 0)
+	i.closer = f
 
-	return nil
+	return i, nil
 }
 
-// Writes data
-// data - Chunk of data to write
-func (file *FileBlockEncryptWriteStream) Write(data []byte) error {
-	if file.current_write_index >= file.block_count {
-		return errors.New("Exceeded file size limit")
+// Creates a read stream, reading from an already open file, a buffer, or a file of a storage backend
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+// key - Decryption key
+func NewFileBlockEncryptReadStream(r io.ReaderAt, size int64, key []byte) (*FileBlockEncryptReadStream, error) {
+	return open_file_block_encrypt_read_stream(r, size, key, nil, nil)
+}
+
+// Creates a read stream with a secret key, reading from an already open file, a buffer, or a file of a storage backend
+// The source is not closed with the stream.
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// r - Source
+// size - Size of the source, in bytes
+// key - Secret key
+func NewFileBlockEncryptReadStreamWithSecretKey(r io.ReaderAt, size int64, key *SecretKey) (*FileBlockEncryptReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
 	}
 
-	file.buf = append(file.buf, data...)
+	key_bytes, err := key.acquire()
 
-	for int64(len(file.buf)) >= file.block_size {
-		if file.current_write_index >= file.block_count {
-			return errors.New("Exceeded file size limit")
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		blockData := file.buf[:file.block_size]
-		file.buf = file.buf[file.block_size:]
+	defer key.release()
 
-		content, err := EncryptFileContents(blockData, AES256_ZIP, file.key)
+	rs, err := open_file_block_encrypt_read_stream(r, size, key_bytes, nil, nil)
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// Save metadata
-		_, err = file.f.Seek(16+file.current_write_index*16, 0)
+	if !rs.owns_key {
+		// The blocks are decrypted with the secret key
+		rs.secret_key = key
+	}
 
-		if err != nil {
-			return err
-		}
+	return rs, nil
+}
 
-		b := make([]byte, 8)
+// Creates a read stream finding the decryption key of each block in a keyring, reading from an already open file,
+// a buffer, or a file of a storage backend
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+// keyring - Keyring
+func NewFileBlockEncryptReadStreamWithKeyring(r io.ReaderAt, size int64, keyring *Keyring) (*FileBlockEncryptReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
 
-		// Write start pointer
-		binary.BigEndian.PutUint64(b, uint64(file.current_write_pt))
-		_, err = file.f.Write(b)
-		if err != nil {
-			return err
-		}
+	return open_file_block_encrypt_read_stream(r, size, nil, keyring, nil)
+}
 
-		// Write length
-		binary.BigEndian.PutUint64(b, uint64(len(content)))
-		_, err = file.f.Write(b)
-		if err != nil {
-			return err
-		}
+// Creates a read stream for a file encrypted for recipients, reading from an already open file, a buffer,
+// or a file of a storage backend
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+// identities - Identities. Any of them can be used to decrypt
+func NewFileBlockEncryptReadStreamWithIdentities(r io.ReaderAt, size int64, identities []Identity) (*FileBlockEncryptReadStream, error) {
+	if len(identities) == 0 {
+		return nil, ErrInvalidArgument
+	}
 
-		// Write data
+	return open_file_block_encrypt_read_stream(r, size, nil, nil, identities)
+}
 
-		_, err = file.f.Seek(file.current_write_pt, 0)
+// Opens a read stream
+// r - Source
+// size - Size of the source, in bytes
+// key - Decryption key
+// keyring - Keyring (if set, key is ignored)
+// identities - Identities (if set, the file must be encrypted for recipients)
+func open_file_block_encrypt_read_stream(r io.ReaderAt, size int64, key []byte, keyring *Keyring, identities []Identity) (*FileBlockEncryptReadStream, error) {
+	if keyring == nil && identities == nil && !is_valid_key_size(len(key)) {
+		return nil, ErrInvalidKey
+	}
 
-		if err != nil {
-			return err
-		}
+	if size < 0 {
+		return nil, ErrInvalidArgument
+	}
 
-		_, err = file.f.Write(content)
-		if err != nil {
-			return err
-		}
+	f := io.NewSectionReader(r, 0, size)
 
-		file.current_write_index++
-		file.current_write_pt += int64(len(content))
+	i := FileBlockEncryptReadStream{
+		f:      f,
+		f_size: size,
 	}
 
-	return nil
-}
+	header := make([]byte, FILE_BLOCK_HEADER_SIZE)
 
-// Closes the file, writing any pending data in the buffer
-func (file *FileBlockEncryptWriteStream) Close() error {
-	if len(file.buf) > 0 {
-		if file.current_write_index >= file.block_count {
-			return errors.New("Exceeded file size limit")
-		}
+	_, err := io.ReadFull(f, header)
 
-		content, err := EncryptFileContents(file.buf, AES256_ZIP, file.key)
+	if err != nil {
+		return nil, read_full_error(err)
+	}
 
-		if err != nil {
-			return err
-		}
+	if bytes.Equal(header[0:4], file_block_authenticated_magic) {
+		// Authenticated format
+		header = append(header, make([]byte, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE-FILE_BLOCK_HEADER_SIZE)...)
 
-		// Save metadata
-		_, err = file.f.Seek(16+file.current_write_index*16, 0)
+		_, err = io.ReadFull(f, header[FILE_BLOCK_HEADER_SIZE:])
 
 		if err != nil {
-			return err
+			return nil, read_full_error(err)
 		}
 
-		b := make([]byte, 8)
-
-		// Write start pointer
-		binary.BigEndian.PutUint64(b, uint64(file.current_write_pt))
-		_, err = file.f.Write(b)
-		if err != nil {
-			return err
+		if header[4] != file_block_authenticated_version || header[5]&^FILE_BLOCK_FLAG_FOOTER_INDEX != 0 {
+			return nil, ErrInvalidData
 		}
 
-		// Write length
-		binary.BigEndian.PutUint64(b, uint64(len(content)))
-		_, err = file.f.Write(b)
+		extensions := make([]byte, binary.BigEndian.Uint16(header[6:8]))
+
+		_, err = io.ReadFull(f, extensions)
+
 		if err != nil {
-			return err
+			return nil, read_full_error(err)
 		}
 
-		// Write data
+		i.block_method = file_block_authenticated_method
 
-		_, err = file.f.Seek(file.current_write_pt, 0)
+		if method_extension, _, ok := find_header_extension(extensions, FILE_BLOCK_EXTENSION_METHOD); ok {
+			if len(method_extension) != 3 {
+				return nil, ErrInvalidData
+			}
 
-		if err != nil {
-			return err
+			i.block_method = FileEncryptionMethod(binary.BigEndian.Uint16(method_extension[0:2]))
+			i.auto_compression = method_extension[2]&file_block_method_auto_compression != 0
 		}
 
-		_, err = file.f.Write(content)
-		if err != nil {
-			return err
-		}
+		if wrapped_key, _, ok := find_header_extension(extensions, FILE_BLOCK_EXTENSION_WRAPPED_KEY); ok {
+			// Envelope encryption, unwrap the data key
+			master_key := key
 
-		file.current_write_index++
-		file.current_write_pt += int64(len(content))
-	}
+			if keyring != nil {
+				master_key, ok = keyring.Get(wrapped_key_id(wrapped_key))
 
-	file.f.Close()
+				if !ok {
+					return nil, ErrKeyNotFound
+				}
+			}
 
-	return nil
-}
+			data_key, err := unwrap_data_key(wrapped_key, master_key, header)
 
-//////////////////////////
-//     READ STREAM     //
-/////////////////////////
+			if err != nil {
+				return nil, err
+			}
 
-// Status of a read stream
-type FileBlockEncryptReadStream struct {
-	f *os.File // File descriptor
+			key = data_key
+			keyring = nil
+			i.owns_key = true
+		} else if recipients_header, _, ok := find_header_extension(extensions, FILE_BLOCK_EXTENSION_RECIPIENTS); ok {
+			// Encrypted for recipients, unwrap the data key
+			if identities == nil {
+				return nil, ErrInvalidKey
+			}
 
-	file_size   int64 // Original (unencrypted) file size in bytes
-	block_size  int64 // Block size in bytes
-	block_count int64 // Total number of blocks
+			data_key, _, err := unwrap_file_key_for_identities(recipients_header, identities)
 
-	key []byte // Decryption key
+			if err != nil {
+				return nil, err
+			}
 
-	cur_pos int64 // Current position of the read cursor
+			block_key, err := derive_recipients_block_key(data_key, recipients_header)
+			clear(data_key)
 
-	cur_block      int64  // Current block the cursor is reading
-	cur_block_data []byte // Buffer to store the current block (Decrypted)
-}
+			if err != nil {
+				return nil, err
+			}
 
-// Creates a read stream
-// file - Path to the file
-// key - Decryption key
-// perm - File mode
-func CreateFileBlockEncryptReadStream(file string, key []byte, perm fs.FileMode) (*FileBlockEncryptReadStream, error) {
-	f, err := os.OpenFile(file, os.O_RDONLY, perm)
+			key = block_key
+			keyring = nil
+			identities = nil
+			i.owns_key = true
+		}
 
-	if err != nil {
-		return nil, err
+		i.file_size = int64(binary.BigEndian.Uint64(header[8:16]))
+		i.block_size = int64(binary.BigEndian.Uint64(header[16:24]))
+		i.header_size = FILE_BLOCK_AUTHENTICATED_HEADER_SIZE + int64(len(extensions))
+		i.ad_header = header
+	} else {
+		i.file_size = int64(binary.BigEndian.Uint64(header[0:8]))
+		i.block_size = int64(binary.BigEndian.Uint64(header[8:16]))
+		i.header_size = FILE_BLOCK_HEADER_SIZE
+		i.block_method = AES256_ZIP
 	}
 
-	i := FileBlockEncryptReadStream{
-		f: f,
+	if identities != nil {
+		// The file is not encrypted for recipients, so there is no key to decrypt it
+		return nil, ErrInvalidKey
 	}
 
-	b := make([]byte, 8)
-
-	// Read original file size
+	i.key = key
+	i.keyring = keyring
 
-	_, err = f.Read(b)
+	if i.ad_header != nil && i.ad_header[5]&FILE_BLOCK_FLAG_FOOTER_INDEX != 0 {
+		err = i.read_footer()
 
-	if err != nil {
-		f.Close()
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	i.file_size = int64(binary.BigEndian.Uint64(b))
-
-	// Read block size
-
-	_, err = f.Read(b)
-
-	if err != nil {
-		f.Close()
-		return nil, err
+	if i.file_size < 0 || i.block_size <= 0 {
+		return nil, ErrInvalidData
 	}
 
-	i.block_size = int64(binary.BigEndian.Uint64(b))
-
-	i.key = key
-
 	i.block_count = i.file_size / i.block_size
 
 	if i.file_size%i.block_size != 0 {
@@ -340,67 +1427,237 @@ func (file *FileBlockEncryptReadStream) BlockCount() int64 {
 	return file.block_count
 }
 
+// Returns true if the file uses the authenticated format
+// Check it if the file may come from an untrusted source, since files in the non-authenticated format can be modified
+func (file *FileBlockEncryptReadStream) Authenticated() bool {
+	return file.ad_header != nil
+}
+
+// Returns the method chosen to encrypt the blocks, as recorded in the header
+// It is informative only: each block is decrypted with the method it declares
+func (file *FileBlockEncryptReadStream) BlockMethod() FileEncryptionMethod {
+	return file.block_method
+}
+
+// Returns true if the blocks were encrypted with auto compression, as recorded in the header
+// If so, blocks of incompressible data use the equivalent method without compression
+func (file *FileBlockEncryptReadStream) AutoCompression() bool {
+	return file.auto_compression
+}
+
+// Returns a copy of the file ID (nil for the non-authenticated format)
+// Pass it as FileBlockEncryptOptions.FileID to write a new version of the file, deduplicating the unchanged blocks
+func (file *FileBlockEncryptReadStream) FileID() []byte {
+	if file.ad_header == nil {
+		return nil
+	}
+
+	return bytes.Clone(file.ad_header[24:40])
+}
+
 // Returns the cursor position
 func (file *FileBlockEncryptReadStream) Cursor() int64 {
 	return file.cur_pos
 }
 
-// Fetches a block and decrypt its contents, making it the current block
-// block_num - Block number
-func (file *FileBlockEncryptReadStream) fetch_block(block_num int64) error {
-	if block_num < 0 || block_num >= file.block_count {
-		return errors.New("Block index out of bounds")
+// Reads the block index from the footer (files written with an unknown size)
+// Sets the file size, the block count and the block index
+func (file *FileBlockEncryptReadStream) read_footer() error {
+	if file.block_size <= 0 || binary.BigEndian.Uint64(file.ad_header[8:16]) != ^uint64(0) {
+		return ErrInvalidData
 	}
 
-	// Read block metadata
-
-	_, err := file.f.Seek(16+block_num*16, 0)
+	footer_pt, err := find_file_block_footer(file.f, file.f_size, file.header_size)
 
 	if err != nil {
 		return err
 	}
 
-	ptBytes := make([]byte, 8)
-	lenBytes := make([]byte, 8)
+	footer := make([]byte, file.f_size-8-footer_pt)
 
-	_, err = file.f.Read(ptBytes)
+	err = read_at(file.f, footer, footer_pt)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = file.f.Read(lenBytes)
+	// Every block takes more space in the file than its index entry (16 bytes)
+	footer, err = file.decrypt_block(nil, footer, file_block_footer_index, 16+file.f_size)
 
 	if err != nil {
 		return err
 	}
 
-	pt := int64(binary.BigEndian.Uint64(ptBytes))
+	if len(footer) < 16 {
+		return ErrInvalidData
+	}
 
-	_, err = file.f.Seek(pt, 0)
+	file_size := int64(binary.BigEndian.Uint64(footer[0:8]))
+	block_count := int64(binary.BigEndian.Uint64(footer[8:16]))
+
+	if file_size < 0 || (len(footer)-16)%16 != 0 || int64((len(footer)-16)/16) != block_count {
+		return ErrInvalidData
+	}
+
+	expected_block_count := file_size / file.block_size
+
+	if file_size%file.block_size != 0 {
+		expected_block_count++
+	}
+
+	if block_count != expected_block_count {
+		return ErrInvalidData
+	}
+
+	file.file_size = file_size
+	file.block_count = block_count
+	file.index = footer[16:]
+
+	return nil
+}
+
+// Finds the footer of a block-encrypted file written with an unknown size
+// f - File
+// f_size - Size of the file, in bytes
+// header_size - Size of the header (including extensions), in bytes
+// Returns the position of the encrypted footer (it takes the rest of the file, except the last 8 bytes)
+func find_file_block_footer(f io.ReaderAt, f_size int64, header_size int64) (int64, error) {
+	if f_size-header_size < 8 {
+		return 0, ErrTruncatedData
+	}
+
+	trailer := make([]byte, 8)
+
+	err := read_at(f, trailer, f_size-8)
 
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	footer_length := int64(binary.BigEndian.Uint64(trailer))
+
+	if footer_length < 0 || footer_length > f_size-8-header_size {
+		return 0, ErrTruncatedData
+	}
+
+	return f_size - 8 - footer_length, nil
+}
+
+// Decrypts a block (or the footer)
+// dst - Buffer to append the decrypted data (ignored with a keyring)
+// data - Encrypted data
+// index - Index of the block, for the associated data
+// max_size - Max size of the decrypted data
+// Returns the decrypted data
+func (file *FileBlockEncryptReadStream) decrypt_block(dst []byte, data []byte, index int64, max_size int64) ([]byte, error) {
+	options := DecryptOptions{MaxPlaintextSize: max_size}
+
+	if file.ad_header != nil {
+		file.ad_buf = append_indexed_associated_data(file.ad_buf[:0], file.ad_header, index)
+		options.AssociatedData = file.ad_buf
+	}
+
+	if file.keyring != nil {
+		return DecryptFileContentsWithKeyringOptions(data, file.keyring, options)
+	}
+
+	return decrypt_file_contents(dst, data, file.key, options, &file.cache)
+}
+
+// Fetches a block and decrypt its contents, making it the current block
+// block_num - Block number
+func (file *FileBlockEncryptReadStream) fetch_block(block_num int64) error {
+	if block_num < 0 || block_num >= file.block_count {
+		return &BlockError{BlockIndex: block_num, Offset: -1, Err: ErrIndexOutOfBounds}
+	}
+
+	if file.secret_key != nil {
+		// Prevent the key from being destroyed while the block is decrypted
+		_, err := file.secret_key.acquire()
+
+		if err != nil {
+			return &BlockError{BlockIndex: block_num, Offset: -1, Err: err}
+		}
+
+		defer file.secret_key.release()
+	}
+
+	// Read block metadata
+
+	index_pt := file.header_size + block_num*16
+
+	var ptBytes, lenBytes []byte
+	var err error
+
+	if file.index != nil {
+		// Index read from the footer
+		ptBytes = file.index[block_num*16 : block_num*16+8]
+		lenBytes = file.index[block_num*16+8 : block_num*16+16]
+	} else {
+		_, err = file.f.Seek(index_pt, 0)
+
+		if err != nil {
+			return &BlockError{BlockIndex: block_num, Offset: index_pt, Err: err}
+		}
+
+		ptBytes = make([]byte, 8)
+		lenBytes = make([]byte, 8)
+
+		_, err = io.ReadFull(file.f, ptBytes)
+
+		if err != nil {
+			return &BlockError{BlockIndex: block_num, Offset: index_pt, Err: read_full_error(err)}
+		}
+
+		_, err = io.ReadFull(file.f, lenBytes)
+
+		if err != nil {
+			return &BlockError{BlockIndex: block_num, Offset: index_pt, Err: read_full_error(err)}
+		}
 	}
 
+	pt := int64(binary.BigEndian.Uint64(ptBytes))
 	l := int64(binary.BigEndian.Uint64(lenBytes))
 
+	if pt < 0 || l < 0 {
+		return &BlockError{BlockIndex: block_num, Offset: index_pt, Err: ErrInvalidData}
+	}
+
+	if pt > file.f_size || l > file.f_size-pt {
+		// Do not allocate more than the file size
+		return &BlockError{BlockIndex: block_num, Offset: pt, Err: ErrTruncatedData}
+	}
+
+	_, err = file.f.Seek(pt, 0)
+
+	if err != nil {
+		return &BlockError{BlockIndex: block_num, Offset: pt, Err: err}
+	}
+
 	// Read encrypted data
 
-	data := make([]byte, l)
+	if int64(cap(file.read_buf)) < l {
+		file.read_buf = make([]byte, l)
+	}
+
+	data := file.read_buf[:l]
 
-	_, err = file.f.Read(data)
+	_, err = io.ReadFull(file.f, data)
 
 	if err != nil {
-		return err
+		return &BlockError{BlockIndex: block_num, Offset: pt, Err: read_full_error(err)}
 	}
 
 	// Decrypt block data
 
-	data, err = DecryptFileContents(data, file.key)
+	// The buffer of the current block is reused, so it is no longer valid
+	file.cur_block = -1
+
+	// Blocks cannot be larger than the block size
+	data, err = file.decrypt_block(file.cur_block_data[:0], data, block_num, file.block_size)
 
 	if err != nil {
-		return err
+		return &BlockError{BlockIndex: block_num, Offset: pt, Err: err}
 	}
 
 	// Assign current block
@@ -434,6 +1691,12 @@ func (file *FileBlockEncryptReadStream) Read(buf []byte) (int, error) {
 		}
 
 		blockLen := len(file.cur_block_data)
+
+		if blockOffset >= blockLen {
+			// The block is smaller than expected
+			return 0, &BlockError{BlockIndex: blockIndex, Offset: -1, Err: ErrTruncatedData}
+		}
+
 		bytesToCopy := blockLen - blockOffset
 		bytesCanFit := len(buf) - filedLength
 
@@ -466,7 +1729,7 @@ func (file *FileBlockEncryptReadStream) Seek(pos int64, whence int) (int64, erro
 	}
 
 	if pos < 0 || pos > file.file_size {
-		return file.cur_pos, errors.New("Cursor position out of bounds")
+		return file.cur_pos, ErrCursorOutOfBounds
 	}
 
 	file.cur_pos = pos
@@ -476,5 +1739,16 @@ func (file *FileBlockEncryptReadStream) Seek(pos int64, whence int) (int64, erro
 
 // Closes the read stream
 func (file *FileBlockEncryptReadStream) Close() {
-	file.f.Close()
+	close_storage(file.closer)
+
+	// Drop the references to the key, wiping it if it was unwrapped by the stream
+	if file.owns_key {
+		clear(file.key)
+	}
+
+	file.key = nil
+	file.keyring = nil
+	file.secret_key = nil
+	file.owns_key = false
+	file.cache.clear()
 }
@@ -3,7 +3,12 @@
 package encrypted_storage
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
 	"os"
 	"path"
 	"testing"
@@ -52,7 +57,7 @@ func TestFileBlockEncrypt(t *testing.T) {
 	}
 
 	for i := 0; i < 48; i++ {
-		err = ws.Write(buf)
+		_, err = ws.Write(buf)
 		if err != nil {
 			t.Error(err)
 			return
@@ -113,3 +118,862 @@ func TestFileBlockEncrypt(t *testing.T) {
 
 	os.Remove(test_file)
 }
+
+func TestFileBlockEncryptAuthenticated(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_enc_auth")
+	test_file_2 := path.Join(test_path_base, "test_block_file_enc_auth_2")
+
+	defer os.Remove(test_file)
+	defer os.Remove(test_file_2)
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	write_file := func(file string) error {
+		ws, err := CreateFileBlockEncryptWriteStream(file, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		err = ws.InitializeWithOptions(int64(len(original)), 100, key, FileBlockEncryptOptions{Authenticated: true})
+
+		if err != nil {
+			return err
+		}
+
+		_, err = ws.Write(original)
+
+		if err != nil {
+			return err
+		}
+
+		return ws.Close()
+	}
+
+	read_file := func(file string) ([]byte, error) {
+		rs, err := CreateFileBlockEncryptReadStream(file, key, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rs.Close()
+
+		if !rs.Authenticated() {
+			t.Errorf("Expected the file to be authenticated")
+		}
+
+		return io.ReadAll(rs)
+	}
+
+	err = write_file(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = write_file(test_file_2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := read_file(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	contents, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	contents_2, err := os.ReadFile(test_file_2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Swap the index entries of blocks 3 and 7
+
+	swapped := bytes.Clone(contents)
+	copy(swapped[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+3*16:], contents[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+7*16:FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+8*16])
+	copy(swapped[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+7*16:], contents[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+3*16:FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+4*16])
+
+	err = os.WriteFile(test_file, swapped, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file(test_file)
+
+	var block_err *BlockError
+
+	if !errors.Is(err, ErrAuthenticationFailed) || !errors.As(err, &block_err) || block_err.BlockIndex != 3 {
+		t.Errorf("Expected ErrAuthenticationFailed for block 3 after swapping blocks, but got (%v)", err)
+	}
+
+	// Copy the blocks from another file (same key)
+
+	mixed := bytes.Clone(contents)
+	copy(mixed[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE:], contents_2[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE:])
+
+	err = os.WriteFile(test_file, mixed, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file(test_file)
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed after copying blocks from another file, but got (%v)", err)
+	}
+
+	// Change the file size in the header
+
+	resized := bytes.Clone(contents)
+	resized[15]--
+
+	err = os.WriteFile(test_file, resized, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file(test_file)
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed after modifying the header, but got (%v)", err)
+	}
+}
+
+func TestFileBlockEncryptUnknownSize(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_unknown_size")
+	defer os.Remove(test_file)
+
+	key := test_random_key()
+
+	write_file := func(original []byte, options FileBlockEncryptOptions) error {
+		ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		options.UnknownSize = true
+
+		// The file size is ignored
+		err = ws.InitializeWithOptions(-1, 100, key, options)
+
+		if err != nil {
+			return err
+		}
+
+		// Write in chunks of different sizes, like a pipe
+		for offset, chunk := 0, 1; offset < len(original); chunk = chunk*3 + 1 {
+			end := min(offset+chunk, len(original))
+
+			_, err = ws.Write(original[offset:end])
+
+			if err != nil {
+				return err
+			}
+
+			offset = end
+		}
+
+		return ws.Close()
+	}
+
+	read_file := func() ([]byte, error) {
+		rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rs.Close()
+
+		if !rs.Authenticated() {
+			t.Errorf("Expected the file to be authenticated")
+		}
+
+		return io.ReadAll(rs)
+	}
+
+	for _, size := range []int{0, 1, 100, 1000, 1234} {
+		original := make([]byte, size)
+		_, err = rand.Read(original)
+
+		if err != nil {
+			panic(err)
+		}
+
+		err = write_file(original, FileBlockEncryptOptions{})
+
+		if err != nil {
+			t.Errorf("Size %d: %v", size, err)
+			continue
+		}
+
+		data, err := read_file()
+
+		if err != nil {
+			t.Errorf("Size %d: %v", size, err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Size %d: Decrypted data does not match the original data", size)
+		}
+	}
+
+	original := make([]byte, 1234)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = write_file(original, FileBlockEncryptOptions{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Seek
+
+	rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if rs.FileSize() != int64(len(original)) {
+		t.Errorf("Expected file size %d, but got %d", len(original), rs.FileSize())
+	}
+
+	_, err = rs.Seek(555, io.SeekStart)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(rs, buf)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(buf, original[555:655]) {
+		t.Errorf("Data read after seeking does not match the original data")
+	}
+
+	rs.Close()
+
+	// Truncation and modification of the footer are detected
+
+	contents, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.WriteFile(test_file, contents[:len(contents)-10], 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file()
+
+	if !errors.Is(err, ErrTruncatedData) && !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrTruncatedData or ErrAuthenticationFailed for a truncated file, but got (%v)", err)
+	}
+
+	modified := bytes.Clone(contents)
+	modified[len(modified)-9] ^= 0x01
+
+	err = os.WriteFile(test_file, modified, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_file()
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for a modified footer, but got (%v)", err)
+	}
+
+	// Signed, with envelope encryption
+
+	node_public, node_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = write_file(original, FileBlockEncryptOptions{Envelope: true, Signer: node_private})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	data, err := read_file()
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Signed: Decrypted data does not match the original data")
+	}
+
+	contents, err = os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	contents[len(contents)-9] ^= 0x01
+
+	err = os.WriteFile(test_file, contents, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a modified footer, but got (%v)", err)
+	}
+}
+
+func TestFileBlockEncryptWriter(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_writer")
+	defer os.Remove(test_file)
+
+	key := test_random_key()
+
+	original := make([]byte, 1234)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	read_file := func() ([]byte, error) {
+		rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rs.Close()
+
+		return io.ReadAll(rs)
+	}
+
+	for _, options := range []FileBlockEncryptOptions{{}, {Authenticated: true}, {UnknownSize: true}} {
+		ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ws.InitializeWithOptions(int64(len(original)), 100, key, options)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var w io.WriteCloser = ws
+
+		// Hide WriteTo from the source, so io.Copy uses ReadFrom
+		n, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(original)})
+
+		if err != nil {
+			t.Error(err)
+		} else if n != int64(len(original)) {
+			t.Errorf("Expected %d bytes to be copied, but got %d", len(original), n)
+		}
+
+		err = w.Close()
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		data, err := read_file()
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data (%+v)", options)
+		}
+	}
+
+	// Partial writes, and the compatibility shim
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Initialize(int64(len(original)), 100, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, err := ws.Write(original[:150])
+
+	if err != nil || n != 150 {
+		t.Errorf("Expected 150 bytes to be written, but got %d (%v)", n, err)
+	}
+
+	err = ws.WriteData(original[150:1000])
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ws.ReadFrom(bytes.NewReader(original[1000:]))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	data, err := read_file()
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data (partial writes)")
+	}
+
+	// More data than the file size
+
+	ws, err = CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer ws.Close()
+
+	err = ws.Initialize(int64(len(original)-1), 100, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.ReadFrom(bytes.NewReader(original))
+
+	if !errors.Is(err, ErrFileSizeExceeded) {
+		t.Errorf("Expected ErrFileSizeExceeded, but got (%v)", err)
+	}
+}
+
+func TestFileBlockEncryptMethod(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_method")
+	defer os.Remove(test_file)
+
+	key := test_random_key()
+
+	// Random data, that cannot be compressed
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	write_file := func(options FileBlockEncryptOptions) error {
+		ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		defer ws.Close()
+
+		err = ws.InitializeWithOptions(int64(len(original)), 100, key, options)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = ws.Write(original)
+
+		if err != nil {
+			return err
+		}
+
+		return ws.Close()
+	}
+
+	// Returns the method declared by the first block
+	first_block_method := func() FileEncryptionMethod {
+		rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+
+		defer rs.Close()
+
+		contents, err := os.ReadFile(test_file)
+
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+
+		pt := binary.BigEndian.Uint64(contents[rs.header_size : rs.header_size+8])
+
+		return FileEncryptionMethod(binary.BigEndian.Uint16(contents[pt : pt+2]))
+	}
+
+	tests := []struct {
+		options         FileBlockEncryptOptions
+		expected_method FileEncryptionMethod // Method recorded in the header
+		block_method    FileEncryptionMethod // Method used by the blocks
+	}{
+		{FileBlockEncryptOptions{}, AES256_ZIP, AES256_ZIP},
+		{FileBlockEncryptOptions{Authenticated: true}, AES256_GCM_ZIP, AES256_GCM_ZIP},
+		{FileBlockEncryptOptions{Method: AES256_GCM}, AES256_GCM, AES256_GCM},
+		{FileBlockEncryptOptions{Method: XCHACHA20_POLY1305_ZSTD}, XCHACHA20_POLY1305_ZSTD, XCHACHA20_POLY1305_ZSTD},
+		{FileBlockEncryptOptions{Method: AES256_SIV, Envelope: true}, AES256_SIV, AES256_SIV},
+		{FileBlockEncryptOptions{AutoCompression: true}, AES256_GCM_ZIP, AES256_GCM},
+		{FileBlockEncryptOptions{CompressionLevel: COMPRESSION_LEVEL_BEST}, AES256_ZIP, AES256_ZIP},
+		{FileBlockEncryptOptions{Method: XCHACHA20_POLY1305_ZSTD, CompressionLevel: COMPRESSION_LEVEL_FASTEST}, XCHACHA20_POLY1305_ZSTD, XCHACHA20_POLY1305_ZSTD},
+	}
+
+	for _, test := range tests {
+		err = write_file(test.options)
+
+		if err != nil {
+			t.Errorf("%+v: %v", test.options, err)
+			continue
+		}
+
+		rs, err := CreateFileBlockEncryptReadStream(test_file, key, 0600)
+
+		if err != nil {
+			t.Errorf("%+v: %v", test.options, err)
+			continue
+		}
+
+		if rs.BlockMethod() != test.expected_method {
+			t.Errorf("%+v: Expected method %d, but got %d", test.options, test.expected_method, rs.BlockMethod())
+		}
+
+		if rs.AutoCompression() != test.options.AutoCompression {
+			t.Errorf("%+v: Expected auto compression to be %v", test.options, test.options.AutoCompression)
+		}
+
+		data, err := io.ReadAll(rs)
+		rs.Close()
+
+		if err != nil {
+			t.Errorf("%+v: %v", test.options, err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("%+v: Decrypted data does not match the original data", test.options)
+		}
+
+		if m := first_block_method(); m != test.block_method {
+			t.Errorf("%+v: Expected the blocks to use method %d, but got %d", test.options, test.block_method, m)
+		}
+	}
+
+	// Methods without associated data, and wrappers, cannot be used
+
+	for _, method := range []FileEncryptionMethod{AES256_ZIP, AES256_FLAT, KEY_ID_WRAPPER, SIGNATURE_WRAPPER, 9999} {
+		err = write_file(FileBlockEncryptOptions{Method: method})
+
+		if !errors.Is(err, ErrInvalidMethod) {
+			t.Errorf("Method %d: Expected ErrInvalidMethod, but got (%v)", method, err)
+		}
+	}
+
+	// Invalid compression levels
+
+	for _, level := range []int{-1, COMPRESSION_LEVEL_BEST + 1} {
+		err = write_file(FileBlockEncryptOptions{CompressionLevel: level})
+
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Compression level %d: Expected ErrInvalidArgument, but got (%v)", level, err)
+		}
+	}
+}
+
+func TestFileBlockEncryptCloseError(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_close_error")
+	defer os.Remove(test_file)
+
+	for _, workers := range []int{0, 2} {
+		secret_key, err := GenerateSecretKey()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ws.InitializeWithSecretKey(100, 16, secret_key, FileBlockEncryptOptions{Workers: workers})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The last block is written on close
+		_, err = ws.Write(make([]byte, 10))
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		f := ws.closer.(*os.File)
+
+		secret_key.Destroy()
+
+		err = ws.Close()
+
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey after destroying the key, but got (%v) (workers: %d)", err, workers)
+		}
+
+		// The key is dropped and the file is closed
+
+		if ws.secret_key != nil {
+			t.Errorf("Expected the stream to drop the key (workers: %d)", workers)
+		}
+
+		_, err = f.Stat()
+
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected the file to be closed, but got (%v) (workers: %d)", err, workers)
+		}
+	}
+}
+
+func TestFileBlockEncryptFileID(t *testing.T) {
+	key := test_random_key()
+
+	original := make([]byte, 1000)
+	_, err := rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// New version, changing the last block
+	modified := bytes.Clone(original)
+	modified[len(modified)-1] ^= 0xFF
+
+	write_file := func(data []byte, options FileBlockEncryptOptions) ([]byte, error) {
+		f := NewMemoryFile("test", nil)
+		ws := NewFileBlockEncryptWriteStream(f)
+
+		err := ws.InitializeWithOptions(0, 100, key, options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = ws.Write(data)
+
+		if err != nil {
+			ws.Close()
+			return nil, err
+		}
+
+		err = ws.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return f.Bytes(), nil
+	}
+
+	first, err := write_file(original, FileBlockEncryptOptions{Method: AES256_SIV, UnknownSize: true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rs, err := NewFileBlockEncryptReadStream(bytes.NewReader(first), int64(len(first)), key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	file_id := rs.FileID()
+	rs.Close()
+
+	if len(file_id) != FILE_BLOCK_FILE_ID_SIZE || !bytes.Equal(file_id, first[24:40]) {
+		t.Errorf("Unexpected file ID: %x", file_id)
+		return
+	}
+
+	// Same file ID: the unchanged blocks are the same
+
+	second, err := write_file(modified, FileBlockEncryptOptions{Method: AES256_SIV, UnknownSize: true, FileID: file_id})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(second) != len(first) || !bytes.Equal(first[:len(first)/2], second[:len(second)/2]) || bytes.Equal(first, second) {
+		t.Errorf("Expected the unchanged blocks to match")
+	}
+
+	rs, err = NewFileBlockEncryptReadStream(bytes.NewReader(second), int64(len(second)), key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := io.ReadAll(rs)
+	rs.Close()
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, modified) {
+		t.Errorf("Decrypted data does not match the modified data")
+	}
+
+	// Random file ID: the blocks are different
+
+	third, err := write_file(original, FileBlockEncryptOptions{Method: AES256_SIV, UnknownSize: true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Equal(first[40:len(first)/2], third[40:len(third)/2]) {
+		t.Errorf("Expected different blocks for a random file ID")
+	}
+
+	// Invalid file ID
+
+	_, err = write_file(original, FileBlockEncryptOptions{FileID: make([]byte, 8)})
+
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument for an invalid file ID, but got (%v)", err)
+	}
+}
@@ -0,0 +1,189 @@
+// Parallel encryption of the blocks of a block-encrypted file
+// The blocks are encrypted by a pool of worker goroutines,
+// while a single writer goroutine writes them into the file (index entry and data) in order,
+// so the result has the same format as a file written sequentially.
+// The number of blocks in flight is limited, so the memory usage is bounded.
+
+package encrypted_storage
+
+import (
+	"sync"
+)
+
+const (
+	file_block_blocks_per_worker = 2 // Blocks in flight for each worker (being encrypted, or waiting to be written)
+)
+
+// Block being encrypted in parallel
+type file_block_job struct {
+	index int64 // Index of the block
+
+	data    []byte // Block data (owned by the job, since the caller may reuse its buffer)
+	content []byte // Encrypted block
+
+	err error // Encryption error
+
+	done chan struct{} // Signaled when the block is encrypted
+}
+
+// Pool of workers encrypting the blocks of a write stream
+type file_block_workers struct {
+	file *FileBlockEncryptWriteStream // Write stream
+
+	jobs    chan *file_block_job // Blocks to encrypt
+	pending chan *file_block_job // Blocks to write, in order
+	free    chan *file_block_job // Jobs ready to be reused
+
+	all_jobs []*file_block_job // All the jobs, to wipe them when stopped
+
+	workers_wg sync.WaitGroup // Wait group for the workers
+	writer_wg  sync.WaitGroup // Wait group for the writer
+
+	mu  sync.Mutex // Mutex for the error
+	err error      // First error encrypting or writing a block
+}
+
+// Starts the workers of a write stream
+// Must be called after initializing the header, since the writer goroutine writes into the file
+// file - Write stream
+// workers - Number of worker goroutines
+func start_file_block_workers(file *FileBlockEncryptWriteStream, workers int) *file_block_workers {
+	in_flight := workers * file_block_blocks_per_worker
+
+	w := &file_block_workers{
+		file:     file,
+		jobs:     make(chan *file_block_job, in_flight),
+		pending:  make(chan *file_block_job, in_flight),
+		free:     make(chan *file_block_job, in_flight),
+		all_jobs: make([]*file_block_job, in_flight),
+	}
+
+	for i := 0; i < in_flight; i++ {
+		job := &file_block_job{
+			done: make(chan struct{}, 1),
+		}
+
+		w.all_jobs[i] = job
+		w.free <- job
+	}
+
+	w.workers_wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go w.run_worker()
+	}
+
+	w.writer_wg.Add(1)
+
+	go w.run_writer()
+
+	return w
+}
+
+// Queues a block to be encrypted and written
+// Blocks if there are too many blocks in flight
+// index - Index of the block
+// data - Block data (copied)
+// Returns the error of a previous block, if any. In that case, the block is not queued
+func (w *file_block_workers) submit(index int64, data []byte) error {
+	job := <-w.free
+
+	err := w.get_error()
+
+	if err != nil {
+		w.free <- job
+		return err
+	}
+
+	job.index = index
+	job.data = append(job.data[:0], data...)
+	job.err = nil
+
+	// Queued in order for the writer. The channels have room for all the jobs, so this never blocks
+	w.pending <- job
+	w.jobs <- job
+
+	return nil
+}
+
+// Waits for the queued blocks to be written, and stops the goroutines
+// Returns the first error encrypting or writing a block
+func (w *file_block_workers) stop() error {
+	close(w.jobs)
+	close(w.pending)
+
+	w.workers_wg.Wait()
+	w.writer_wg.Wait()
+
+	// Wipe the data
+	for _, job := range w.all_jobs {
+		clear(job.data)
+		clear(job.content)
+	}
+
+	return w.get_error()
+}
+
+// Returns the first error encrypting or writing a block
+func (w *file_block_workers) get_error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Sets the error, if there was none
+// err - Error
+func (w *file_block_workers) set_error(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Encrypts blocks until the jobs channel is closed
+// Each worker has its own cipher instances and buffers
+func (w *file_block_workers) run_worker() {
+	defer w.workers_wg.Done()
+
+	var cache cipher_cache
+	var ad_buf []byte
+
+	for job := range w.jobs {
+		job.content, job.err = w.file.encrypt_block_to(job.content[:0], &ad_buf, job.data, job.index, &cache)
+
+		if job.err != nil {
+			job.content = nil
+		}
+
+		job.done <- struct{}{}
+	}
+
+	cache.clear()
+}
+
+// Writes the encrypted blocks in order until the pending channel is closed
+// After an error, the remaining blocks are discarded
+func (w *file_block_workers) run_writer() {
+	defer w.writer_wg.Done()
+
+	for job := range w.pending {
+		<-job.done
+
+		if w.get_error() == nil {
+			if job.err != nil {
+				w.set_error(&BlockError{BlockIndex: job.index, Offset: w.file.current_write_pt, Err: job.err})
+			} else {
+				err := w.file.commit_block(job.content, int64(len(job.data)))
+
+				if err != nil {
+					w.set_error(err)
+				}
+			}
+		}
+
+		w.free <- job
+	}
+}
@@ -0,0 +1,195 @@
+// Parallel block encryption (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileBlockEncryptParallel(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_parallel")
+	defer os.Remove(test_file)
+
+	test_file_sequential := path.Join(test_path_base, "test_block_file_parallel_sequential")
+	defer os.Remove(test_file_sequential)
+
+	key := test_random_key()
+
+	signer_public, signer_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := make([]byte, 64*1024+123)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	write_file := func(file string, options FileBlockEncryptOptions) error {
+		ws, err := CreateFileBlockEncryptWriteStream(file, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		err = ws.InitializeWithOptions(int64(len(original)), 1000, key, options)
+
+		if err != nil {
+			return err
+		}
+
+		// Uneven writes, so some blocks are buffered and others are taken from the data directly
+		for i := 0; i < len(original); i += 2500 {
+			_, err = ws.Write(original[i:min(i+2500, len(original))])
+
+			if err != nil {
+				ws.Close()
+				return err
+			}
+		}
+
+		return ws.Close()
+	}
+
+	read_file := func(file string) ([]byte, error) {
+		rs, err := CreateFileBlockEncryptReadStream(file, key, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rs.Close()
+
+		return io.ReadAll(rs)
+	}
+
+	for _, options := range []FileBlockEncryptOptions{
+		{Workers: 4},
+		{Authenticated: true, Workers: 4},
+		{UnknownSize: true, Workers: 4},
+		{Signer: signer_private, Workers: 3},
+		{Method: AES256_SIV, AutoCompression: true, Workers: 8},
+	} {
+		err = write_file(test_file, options)
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		data, err := read_file(test_file)
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data (workers: %d)", options.Workers)
+		}
+
+		if options.Signer != nil {
+			_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{signer_public})
+
+			if err != nil {
+				t.Errorf("Expected a valid signature, but got (%v)", err)
+			}
+		}
+	}
+
+	// Same format as a file written sequentially (the encrypted blocks have the same length)
+
+	err = write_file(test_file, FileBlockEncryptOptions{Workers: 4})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = write_file(test_file_sequential, FileBlockEncryptOptions{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	parallel_file, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sequential_file, err := os.ReadFile(test_file_sequential)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	index_end := FILE_BLOCK_HEADER_SIZE + 16*((len(original)+999)/1000)
+
+	if len(parallel_file) != len(sequential_file) || !bytes.Equal(parallel_file[:index_end], sequential_file[:index_end]) {
+		t.Errorf("Expected the header and the block index to match the sequential file")
+	}
+
+	// Errors of the workers are reported
+
+	secret_key, err := GenerateSecretKey()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithSecretKey(int64(len(original)), 1000, secret_key, FileBlockEncryptOptions{Workers: 4})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	secret_key.Destroy()
+
+	_, err = ws.Write(original)
+
+	if err == nil {
+		err = ws.Close()
+	} else {
+		ws.Close()
+	}
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey after destroying the key, but got (%v)", err)
+	}
+
+	var block_err *BlockError
+
+	if !errors.As(err, &block_err) {
+		t.Errorf("Expected a BlockError, but got (%v)", err)
+	}
+}
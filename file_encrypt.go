@@ -3,124 +3,234 @@
 package encrypted_storage
 
 import (
-	"bytes"
-	"compress/zlib"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"crypto/ed25519"
 	"encoding/binary"
-	"errors"
-	"io"
 )
 
 type FileEncryptionMethod uint16
 
 const (
-	AES256_ZIP  FileEncryptionMethod = 1 // Compress data, then encrypt it with AES-256-CBC
-	AES256_FLAT FileEncryptionMethod = 2 // Just encrypt the data with AES-256-CBC
+	AES256_ZIP     FileEncryptionMethod = 1 // Compress data, then encrypt it with AES-256-CBC
+	AES256_FLAT    FileEncryptionMethod = 2 // Just encrypt the data with AES-256-CBC
+	AES256_GCM     FileEncryptionMethod = 3 // Encrypt and authenticate the data with AES-256-GCM
+	AES256_GCM_ZIP FileEncryptionMethod = 4 // Compress data, then encrypt and authenticate it with AES-256-GCM
+
+	XCHACHA20_POLY1305     FileEncryptionMethod = 5 // Encrypt and authenticate the data with XChaCha20-Poly1305
+	XCHACHA20_POLY1305_ZIP FileEncryptionMethod = 6 // Compress data, then encrypt and authenticate it with XChaCha20-Poly1305
+
+	AES256_ZIP_HMAC  FileEncryptionMethod = 7 // Compress data, then encrypt it with AES-256-CBC and authenticate it with HMAC-SHA256
+	AES256_FLAT_HMAC FileEncryptionMethod = 8 // Encrypt the data with AES-256-CBC and authenticate it with HMAC-SHA256
+
+	AES256_GCM_STREAM     FileEncryptionMethod = 9  // Encrypt and authenticate the data with AES-256-GCM, in segments (supports streaming)
+	AES256_GCM_ZIP_STREAM FileEncryptionMethod = 10 // Compress data, then encrypt and authenticate it with AES-256-GCM, in segments (supports streaming)
+
+	AES256_ZIP_64  FileEncryptionMethod = 11 // Same as AES256_ZIP, with a 64-bit size field (for data larger than 4 GiB)
+	AES256_FLAT_64 FileEncryptionMethod = 12 // Same as AES256_FLAT, with a 64-bit size field (for data larger than 4 GiB)
+
+	AES256_GCM_ZSTD         FileEncryptionMethod = 13 // Compress data with Zstandard, then encrypt and authenticate it with AES-256-GCM
+	AES256_GCM_DEFLATE      FileEncryptionMethod = 14 // Compress data with raw DEFLATE, then encrypt and authenticate it with AES-256-GCM
+	AES256_GCM_GZIP         FileEncryptionMethod = 15 // Compress data with GZIP, then encrypt and authenticate it with AES-256-GCM
+	XCHACHA20_POLY1305_ZSTD FileEncryptionMethod = 16 // Compress data with Zstandard, then encrypt and authenticate it with XChaCha20-Poly1305
+
+	KEY_ID_WRAPPER     FileEncryptionMethod = 17 // Wraps the cipher text of another method, adding the ID of the key (see Keyring)
+	RECIPIENTS_WRAPPER FileEncryptionMethod = 18 // Wraps the cipher text of another method, encrypted with a file key wrapped for one or more recipients (see EncryptFileContentsToRecipients)
+	SIGNATURE_WRAPPER  FileEncryptionMethod = 19 // Wraps the cipher text of another method, adding an Ed25519 signature (see EncryptOptions.Signer)
+
+	AES256_SIV     FileEncryptionMethod = 20 // Deterministic: Encrypt and authenticate the data with AES-SIV. Same data and key produce the same cipher text
+	AES256_SIV_ZIP FileEncryptionMethod = 21 // Deterministic: Compress data, then encrypt and authenticate it with AES-SIV
 )
 
+// Options for encryption
+type EncryptOptions struct {
+	CompressionLevel int // Compression level, from COMPRESSION_LEVEL_FASTEST (1) to COMPRESSION_LEVEL_BEST (9). Set to 0 for the default level. Ignored by methods without compression
+
+	// Auto compression mode. If true, and the method compresses the data, a sample of the data is compressed first.
+	// If the estimated savings are below MinCompressionSavings, the equivalent method without compression is used instead
+	// (for example, AES256_FLAT instead of AES256_ZIP). The cipher text contains the ID of the method actually used.
+	// Ignored by custom methods.
+	AutoCompression bool
+
+	MinCompressionSavings float64 // Min fraction of the size (0 to 1) that compression must save in auto mode. Set to 0 for the default (AUTO_COMPRESSION_MIN_SAVINGS)
+
+	// Associated data: context (file ID, block index, etc) bound to the cipher text, but not stored in it.
+	// The same associated data must be provided to decrypt. Requires a method implementing AssociatedDataEncryptionMethod,
+	// otherwise ErrUnsupported is returned. If set, empty data is also encrypted, instead of producing an empty cipher text.
+	AssociatedData []byte
+
+	// Signer. If set, the cipher text is signed with this Ed25519 private key (see SIGNATURE_WRAPPER),
+	// so VerifyFileContentsSignature can report who produced it.
+	Signer ed25519.PrivateKey
+}
+
 // Encrypts file contents
 // data - File data
 // method - algorithm to use
 // key - Encryption key
 // Returns the cipher text, or an error
 func EncryptFileContents(data []byte, method FileEncryptionMethod, key []byte) (ret_cipher_text []byte, ret_error error) {
-	if len(data) == 0 {
-		return make([]byte, 0), nil
-	}
+	return EncryptFileContentsWithOptions(data, method, key, EncryptOptions{})
+}
+
+// Encrypts file contents, with options
+// data - File data
+// method - algorithm to use
+// key - Encryption key
+// options - Encryption options
+// Returns the cipher text, or an error
+func EncryptFileContentsWithOptions(data []byte, method FileEncryptionMethod, key []byte, options EncryptOptions) (ret_cipher_text []byte, ret_error error) {
+	return encrypt_file_contents(make([]byte, 0), data, method, key, options, nil)
+}
 
-	result := make([]byte, 2)
+// Encrypts file contents, appending the cipher text to a buffer
+// Reuse the buffer between calls to avoid allocations. The built-in methods write directly into it.
+// dst - Buffer to append the cipher text (may be nil). Must not overlap with data
+// data - File data
+// method - algorithm to use
+// key - Encryption key
+// options - Encryption options
+// Returns the buffer with the cipher text appended, or an error
+func EncryptFileContentsTo(dst []byte, data []byte, method FileEncryptionMethod, key []byte, options EncryptOptions) ([]byte, error) {
+	return encrypt_file_contents(dst, data, method, key, options, nil)
+}
 
-	binary.BigEndian.PutUint16(result, uint16(method)) // Include method
+// Encrypts file contents, appending the cipher text to a buffer
+// dst - Buffer to append the cipher text
+// data - File data
+// method - algorithm to use
+// key - Encryption key
+// options - Encryption options
+// cache - Cache of cipher instances (may be nil)
+// Returns the buffer with the cipher text appended, or an error
+func encrypt_file_contents(dst []byte, data []byte, method FileEncryptionMethod, key []byte, options EncryptOptions, cache *cipher_cache) ([]byte, error) {
+	if options.Signer != nil {
+		signer := options.Signer
+		options.Signer = nil
 
-	if method == AES256_ZIP {
-		// Compress the data
-		var b bytes.Buffer
-		w := zlib.NewWriter(&b)
-		_, err := w.Write(data)
+		cipher_text, err := encrypt_file_contents(nil, data, method, key, options, cache)
 
 		if err != nil {
 			return nil, err
 		}
 
-		err = w.Close()
+		signed, err := SignFileContents(cipher_text, signer)
 
 		if err != nil {
 			return nil, err
 		}
 
-		final_data := b.Bytes()
+		return append(dst, signed...), nil
+	}
 
-		// Include pre-encryption size to the header
-		header := make([]byte, 20)
-		binary.BigEndian.PutUint32(header[:4], uint32(len(final_data)))
+	if len(data) == 0 && len(options.AssociatedData) == 0 {
+		return dst, nil
+	}
 
-		// Pad data
-		final_data = add_padding(final_data, 16)
+	if options.MinCompressionSavings < 0 || options.MinCompressionSavings > 1 {
+		return nil, ErrInvalidArgument
+	}
 
-		// Generate IV
-		iv := make([]byte, 16)
-		_, err = rand.Read(iv)
+	if options.AutoCompression {
+		method = choose_auto_compression_method(data, method, options)
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	m, ok := GetEncryptionMethod(method)
 
-		// Include IV into the header
-		copy(header[4:20], iv)
+	if !ok {
+		return nil, ErrInvalidMethod
+	}
 
-		// Encrypt
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
-		cipher_text := make([]byte, len(final_data))
-		mode := cipher.NewCBCEncrypter(block, iv)
-		mode.CryptBlocks(cipher_text, final_data)
+	adm, supports_ad := m.(AssociatedDataEncryptionMethod)
 
-		// Include in result
+	if len(options.AssociatedData) > 0 && !supports_ad {
+		return nil, ErrUnsupported
+	}
 
-		result = append(result, header...)
-		result = append(result, cipher_text...)
-	} else if method == AES256_FLAT {
-		// Include pre-encryption size to the header
-		header := make([]byte, 20)
-		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(method)) // Include method
 
-		// Pad data
-		final_data := add_padding(data, 16)
+	if am, ok := m.(append_encryption_method); ok {
+		return am.encrypt_append(dst, data, key, options.AssociatedData, options.CompressionLevel, cache)
+	}
 
-		// Generate IV
-		iv := make([]byte, 16)
-		_, err := rand.Read(iv)
+	var header []byte
+	var body []byte
+	var err error
 
-		if err != nil {
-			return nil, err
-		}
+	if len(options.AssociatedData) > 0 {
+		header, body, err = adm.EncryptWithAD(data, key, options.AssociatedData, options.CompressionLevel)
+	} else if cm, ok := m.(CompressionEncryptionMethod); ok {
+		header, body, err = cm.EncryptWithLevel(data, key, options.CompressionLevel)
+	} else {
+		header, body, err = m.Encrypt(data, key)
+	}
 
-		// Include IV into the header
-		copy(header[4:20], iv)
+	if err != nil {
+		return nil, err
+	}
 
-		// Encrypt
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
-		cipher_text := make([]byte, len(final_data))
-		mode := cipher.NewCBCEncrypter(block, iv)
-		mode.CryptBlocks(cipher_text, final_data)
+	dst = append(dst, header...)
+	dst = append(dst, body...)
 
-		// Include in result
+	return dst, nil
+}
 
-		result = append(result, header...)
-		result = append(result, cipher_text...)
+// Encrypts file contents, binding them to associated data
+// Use it to prevent a cipher text from being moved to another context (for example, another file or block)
+// data - File data
+// method - algorithm to use. Must implement AssociatedDataEncryptionMethod (AES256_GCM, XCHACHA20_POLY1305, AES256_FLAT_HMAC, etc)
+// key - Encryption key
+// ad - Associated data (not stored in the cipher text)
+// Returns the cipher text, or an error
+func EncryptFileContentsWithAD(data []byte, method FileEncryptionMethod, key []byte, ad []byte) (ret_cipher_text []byte, ret_error error) {
+	return EncryptFileContentsWithOptions(data, method, key, EncryptOptions{AssociatedData: ad})
+}
 
-	} else {
-		return nil, errors.New("Invalid method")
+// Builds the associated data for an element of a container (a block of a file, or a file of a pack)
+// header - Header of the container, identifying it
+// index - Index of the element
+func indexed_associated_data(header []byte, index int64) []byte {
+	return append_indexed_associated_data(make([]byte, 0, len(header)+8), header, index)
+}
+
+// Builds the associated data for an element of a container, appending it to a buffer
+// dst - Buffer to append the associated data
+// header - Header of the container, identifying it
+// index - Index of the element
+func append_indexed_associated_data(dst []byte, header []byte, index int64) []byte {
+	dst = append(dst, header...)
+	return binary.BigEndian.AppendUint64(dst, uint64(index))
+}
+
+// Chooses the method to use in auto compression mode
+// data - Data to encrypt
+// method - Requested method
+// options - Encryption options
+// Returns the requested method, or its equivalent without compression if compressing is not worth it
+func choose_auto_compression_method(data []byte, method FileEncryptionMethod, options EncryptOptions) FileEncryptionMethod {
+	uncompressed, ok := uncompressed_methods[method]
+
+	if !ok {
+		return method
+	}
+
+	min_savings := options.MinCompressionSavings
+
+	if min_savings == 0 {
+		min_savings = AUTO_COMPRESSION_MIN_SAVINGS
+	}
+
+	if is_worth_compressing(data, min_savings) {
+		return method
 	}
 
-	return result, nil
+	return uncompressed
+}
+
+// Options for decryption
+type DecryptOptions struct {
+	MaxPlaintextSize  int64 // Max size of the original data, in bytes. Set to 0 for no limit
+	MaxCiphertextSize int64 // Max size of the cipher text, in bytes. Set to 0 for no limit
+
+	AssociatedData []byte // Associated data, the same provided to encrypt. Requires a method implementing AssociatedDataEncryptionMethod
 }
 
 // Decrypts file contents
@@ -128,93 +238,113 @@ func EncryptFileContents(data []byte, method FileEncryptionMethod, key []byte) (
 // key - Decryption key
 // Returns the original file data, or an error
 func DecryptFileContents(data []byte, key []byte) (ret_pain_text []byte, ret_error error) {
+	return DecryptFileContentsWithOptions(data, key, DecryptOptions{})
+}
+
+// Decrypts file contents, verifying the associated data
+// data - Cipher text
+// key - Decryption key
+// ad - Associated data, the same provided to encrypt
+// Returns the original file data, or an error. If the associated data does not match, returns ErrAuthenticationFailed
+func DecryptFileContentsWithAD(data []byte, key []byte, ad []byte) (ret_pain_text []byte, ret_error error) {
+	return DecryptFileContentsWithOptions(data, key, DecryptOptions{AssociatedData: ad})
+}
+
+// Decrypts file contents, with options
+// Use it for untrusted data, setting size limits to prevent decompression bombs from exhausting the memory
+// data - Cipher text
+// key - Decryption key
+// options - Decryption options
+// Returns the original file data, or an error. If a limit is exceeded, the error is a *SizeLimitError
+func DecryptFileContentsWithOptions(data []byte, key []byte, options DecryptOptions) (ret_pain_text []byte, ret_error error) {
+	return decrypt_file_contents(make([]byte, 0), data, key, options, nil)
+}
+
+// Decrypts file contents, appending the original data to a buffer
+// Reuse the buffer between calls to avoid allocations. The built-in methods write directly into it.
+// dst - Buffer to append the original data (may be nil). Must not overlap with data
+// data - Cipher text
+// key - Decryption key
+// options - Decryption options
+// Returns the buffer with the original data appended, or an error
+func DecryptFileContentsTo(dst []byte, data []byte, key []byte, options DecryptOptions) ([]byte, error) {
+	return decrypt_file_contents(dst, data, key, options, nil)
+}
+
+// Decrypts file contents, appending the original data to a buffer
+// dst - Buffer to append the original data
+// data - Cipher text
+// key - Decryption key
+// options - Decryption options
+// cache - Cache of cipher instances (may be nil)
+// Returns the buffer with the original data appended, or an error
+func decrypt_file_contents(dst []byte, data []byte, key []byte, options DecryptOptions, cache *cipher_cache) ([]byte, error) {
+	if options.MaxCiphertextSize > 0 && int64(len(data)) > options.MaxCiphertextSize {
+		return nil, &SizeLimitError{Limit: options.MaxCiphertextSize, Ciphertext: true}
+	}
+
 	if len(data) < 2 {
-		if len(data) == 0 {
-			return make([]byte, 0), nil
+		if len(data) == 0 && len(options.AssociatedData) > 0 {
+			// Data encrypted with associated data is never empty
+			return nil, ErrAuthenticationFailed
+		} else if len(data) == 0 {
+			return dst, nil
 		} else {
-			return nil, errors.New("Invalid data provided")
+			return nil, ErrTruncatedData
 		}
 	}
 
-	method := FileEncryptionMethod(binary.BigEndian.Uint16(data[:2]))
+	m, ok := GetEncryptionMethod(FileEncryptionMethod(binary.BigEndian.Uint16(data[:2])))
 
-	if method == AES256_ZIP {
-		if len(data) < 23 {
-			return nil, errors.New("Invalid data provided")
-		}
+	if !ok {
+		return nil, ErrInvalidMethod
+	}
 
-		// Read params
-		pre_encoded_data_length := int(binary.BigEndian.Uint32(data[2:6]))
-		iv := data[6:22]
-		cipher_text := data[22:]
+	header_size := m.HeaderSize()
 
-		if pre_encoded_data_length < 0 || pre_encoded_data_length > len(cipher_text) {
-			return nil, errors.New("Invalid method")
-		}
+	if len(data) < 2+header_size {
+		return nil, ErrTruncatedData
+	}
 
-		// Decrypt
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
-		mode := cipher.NewCBCDecrypter(block, iv)
-		plaintext := make([]byte, len(cipher_text))
-		mode.CryptBlocks(plaintext, cipher_text)
+	header := data[2 : 2+header_size]
+	body := data[2+header_size:]
 
-		// Remove padding
-		plaintext = plaintext[:pre_encoded_data_length]
+	adm, supports_ad := m.(AssociatedDataEncryptionMethod)
 
-		// Decompress the data
-		b_source := bytes.NewReader(plaintext)
-		r, err := zlib.NewReader(b_source)
-		if err != nil {
-			return nil, err
-		}
-		result, err := io.ReadAll(r)
-		if err != nil {
-			return nil, err
-		}
-		r.Close()
+	if len(options.AssociatedData) > 0 && !supports_ad {
+		return nil, ErrUnsupported
+	}
 
-		return result, nil
-	} else if method == AES256_FLAT {
-		if len(data) < 23 {
-			return nil, errors.New("Invalid data provided")
-		}
+	if am, ok := m.(append_encryption_method); ok {
+		return am.decrypt_append(dst, header, body, key, options.AssociatedData, options.MaxPlaintextSize, cache)
+	}
 
-		// Read params
-		pre_encoded_data_length := int(binary.BigEndian.Uint32(data[2:6]))
-		iv := data[6:22]
-		cipher_text := data[22:]
+	var plaintext []byte
+	var err error
 
-		if pre_encoded_data_length < 0 || pre_encoded_data_length > len(cipher_text) {
-			return nil, errors.New("Invalid method")
-		}
+	if len(options.AssociatedData) > 0 {
+		plaintext, err = adm.DecryptWithAD(header, body, key, options.AssociatedData, options.MaxPlaintextSize)
+	} else if options.MaxPlaintextSize <= 0 {
+		plaintext, err = m.Decrypt(header, body, key)
+	} else if lm, ok := m.(LimitedDecryptionMethod); ok {
+		plaintext, err = lm.DecryptLimited(header, body, key, options.MaxPlaintextSize)
+	} else {
+		// The method does not support limits, check after decrypting
+		plaintext, err = m.Decrypt(header, body, key)
 
-		// Decrypt
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
+		if err == nil && int64(len(plaintext)) > options.MaxPlaintextSize {
+			return nil, &SizeLimitError{Limit: options.MaxPlaintextSize}
 		}
-		mode := cipher.NewCBCDecrypter(block, iv)
-		plaintext := make([]byte, len(cipher_text))
-		mode.CryptBlocks(plaintext, cipher_text)
+	}
 
-		// Remove padding
-		plaintext = plaintext[:pre_encoded_data_length]
+	if err != nil {
+		return nil, err
+	}
 
+	if len(dst) == 0 {
+		// Avoid copying the result
 		return plaintext, nil
-	} else {
-		return nil, errors.New("Invalid method")
 	}
-}
 
-// Add padding to the data, so a block cipher can encrypt it
-// cipher_text - data to pad
-// blockSize - Size of the blocks to encrypt
-// Returns the padded data
-func add_padding(cipher_text []byte, blockSize int) []byte {
-	padding := (blockSize - len(cipher_text)%blockSize)
-	pad_text := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(cipher_text, pad_text...)
+	return append(dst, plaintext...), nil
 }
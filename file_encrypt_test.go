@@ -3,8 +3,13 @@
 package encrypted_storage
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
 	"testing"
 )
 
@@ -75,3 +80,582 @@ func TestFileEncryption(t *testing.T) {
 		t.Errorf("Test failed for size = %d bytes", len(original))
 	}
 }
+
+func TestFileEncryptionAuthenticated(t *testing.T) {
+	// Generate random key
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	wrongKey := make([]byte, 32)
+	_, err = rand.Read(wrongKey)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := make([]byte, 64*1024)
+	_, err = rand.Read(original)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, method := range []FileEncryptionMethod{AES256_GCM, AES256_GCM_ZIP, XCHACHA20_POLY1305, XCHACHA20_POLY1305_ZIP, AES256_ZIP_HMAC, AES256_FLAT_HMAC} {
+		encrypted, err := EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		decrypted, err := DecryptFileContents(encrypted, key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+			t.Errorf("Test failed for method = %d, size = %d bytes", method, len(original))
+		}
+
+		// Wrong key
+		_, err = DecryptFileContents(encrypted, wrongKey)
+		if err != ErrAuthenticationFailed {
+			t.Errorf("Method %d: Expected authentication failure with the wrong key, but got (%v)", method, err)
+		}
+
+		// Swapped method ID
+		swapped := make([]byte, len(encrypted))
+		copy(swapped, encrypted)
+		switch method {
+		case AES256_GCM:
+			swapped[1] = byte(AES256_GCM_ZIP)
+		case AES256_GCM_ZIP:
+			swapped[1] = byte(AES256_GCM)
+		case XCHACHA20_POLY1305:
+			swapped[1] = byte(XCHACHA20_POLY1305_ZIP)
+		case XCHACHA20_POLY1305_ZIP:
+			swapped[1] = byte(XCHACHA20_POLY1305)
+		case AES256_ZIP_HMAC:
+			swapped[1] = byte(AES256_FLAT_HMAC)
+		case AES256_FLAT_HMAC:
+			swapped[1] = byte(AES256_ZIP_HMAC)
+		}
+
+		_, err = DecryptFileContents(swapped, key)
+		if err != ErrAuthenticationFailed {
+			t.Errorf("Method %d: Expected authentication failure after changing the method ID, but got (%v)", method, err)
+		}
+
+		// Tampered data (header, cipher text and tag)
+		for _, pos := range []int{5, len(encrypted) / 2, len(encrypted) - 1} {
+			tampered := make([]byte, len(encrypted))
+			copy(tampered, encrypted)
+			tampered[pos] ^= 0x01
+
+			_, err = DecryptFileContents(tampered, key)
+			if err == nil {
+				t.Errorf("Method %d: Expected an error after modifying byte %d", method, pos)
+			}
+		}
+
+		// Truncated data
+		_, err = DecryptFileContents(encrypted[:len(encrypted)-1], key)
+		if err != ErrAuthenticationFailed {
+			t.Errorf("Method %d: Expected authentication failure for truncated data, but got (%v)", method, err)
+		}
+	}
+}
+
+func TestFileEncryptionSizeField(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := make([]byte, 100*1024)
+	_, err = rand.Read(original)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, method := range []FileEncryptionMethod{AES256_ZIP_64, AES256_FLAT_64} {
+		encrypted, err := EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		decrypted, err := DecryptFileContents(encrypted, key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+			t.Errorf("Test failed for method = %d, size = %d bytes", method, len(original))
+		}
+	}
+
+	// Size limits (checked without allocating the data)
+	if strconv.IntSize == 64 {
+		big_size := uint64(math.MaxUint32) + 1
+
+		err = put_size_field(make([]byte, 4), int(big_size))
+		if err == nil {
+			t.Errorf("Expected an error when storing a size of %d bytes in a 32-bit field", big_size)
+		}
+
+		field := make([]byte, 8)
+		err = put_size_field(field, int(big_size))
+		if err != nil {
+			t.Error(err)
+		}
+
+		size, ok := read_size_field(field, int(big_size))
+		if !ok || uint64(size) != big_size {
+			t.Errorf("Expected size = %d, but got %d", big_size, size)
+		}
+	}
+
+	err = put_size_field(make([]byte, 4), math.MaxUint16)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecryptOptions(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Highly compressible data
+	original := make([]byte, 1024*1024)
+
+	methods := []FileEncryptionMethod{AES256_ZIP, AES256_FLAT, AES256_GCM, AES256_GCM_ZIP, XCHACHA20_POLY1305_ZIP, AES256_ZIP_HMAC, AES256_GCM_ZIP_STREAM, AES256_ZIP_64, AES256_GCM_ZSTD, AES256_GCM_DEFLATE, AES256_GCM_GZIP}
+
+	for _, method := range methods {
+		encrypted, err := EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		// Plaintext limit
+		_, err = DecryptFileContentsWithOptions(encrypted, key, DecryptOptions{MaxPlaintextSize: 1000})
+
+		var limitErr *SizeLimitError
+
+		if !errors.As(err, &limitErr) || limitErr.Ciphertext || limitErr.Limit != 1000 {
+			t.Errorf("Method %d: Expected a plaintext SizeLimitError, but got (%v)", method, err)
+		}
+
+		if !errors.Is(err, ErrSizeLimitExceeded) {
+			t.Errorf("Method %d: Expected ErrSizeLimitExceeded, but got (%v)", method, err)
+		}
+
+		// Cipher text limit
+		_, err = DecryptFileContentsWithOptions(encrypted, key, DecryptOptions{MaxCiphertextSize: int64(len(encrypted) - 1)})
+
+		if !errors.As(err, &limitErr) || !limitErr.Ciphertext {
+			t.Errorf("Method %d: Expected a cipher text SizeLimitError, but got (%v)", method, err)
+		}
+
+		// Exact limits
+		decrypted, err := DecryptFileContentsWithOptions(encrypted, key, DecryptOptions{MaxPlaintextSize: int64(len(original)), MaxCiphertextSize: int64(len(encrypted))})
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+			t.Errorf("Test failed for method = %d, size = %d bytes", method, len(original))
+		}
+	}
+}
+
+func TestFileEncryptionCompression(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Compressible data
+	original := bytes.Repeat([]byte("Compressible test data, "), 10*1024)
+
+	methods := []FileEncryptionMethod{AES256_ZIP, AES256_GCM_ZIP, AES256_GCM_ZSTD, AES256_GCM_DEFLATE, AES256_GCM_GZIP, XCHACHA20_POLY1305_ZSTD, AES256_GCM_ZIP_STREAM}
+
+	for _, method := range methods {
+		for level := COMPRESSION_LEVEL_DEFAULT; level <= COMPRESSION_LEVEL_BEST; level++ {
+			encrypted, err := EncryptFileContentsWithOptions(original, method, key, EncryptOptions{CompressionLevel: level})
+			if err != nil {
+				t.Errorf("Method %d, level %d: %v", method, level, err)
+				continue
+			}
+
+			if len(encrypted) >= len(original)/10 {
+				t.Errorf("Method %d, level %d: Expected the data to be compressed, but got %d bytes", method, level, len(encrypted))
+			}
+
+			decrypted, err := DecryptFileContents(encrypted, key)
+			if err != nil {
+				t.Errorf("Method %d, level %d: %v", method, level, err)
+				continue
+			}
+
+			if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+				t.Errorf("Test failed for method = %d, level = %d", method, level)
+			}
+		}
+
+		_, err = EncryptFileContentsWithOptions(original, method, key, EncryptOptions{CompressionLevel: COMPRESSION_LEVEL_BEST + 1})
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Method %d: Expected ErrInvalidArgument for an invalid level, but got (%v)", method, err)
+		}
+	}
+}
+
+func TestFileEncryptionAutoCompression(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	compressible := bytes.Repeat([]byte("Compressible test data, "), 10*1024)
+	random := make([]byte, 200*1024)
+	_, err = rand.Read(random)
+
+	if err != nil {
+		panic(err)
+	}
+
+	small_random := random[:100]
+
+	for method, uncompressed := range uncompressed_methods {
+		cases := []struct {
+			data     []byte
+			expected FileEncryptionMethod
+		}{
+			{compressible, method},
+			{random, uncompressed},
+			{small_random, uncompressed},
+		}
+
+		for i, c := range cases {
+			encrypted, err := EncryptFileContentsWithOptions(c.data, method, key, EncryptOptions{AutoCompression: true})
+			if err != nil {
+				t.Errorf("Method %d, case %d: %v", method, i, err)
+				continue
+			}
+
+			used := FileEncryptionMethod(binary.BigEndian.Uint16(encrypted[:2]))
+
+			if used != c.expected {
+				t.Errorf("Method %d, case %d: Expected method %d, but got %d", method, i, c.expected, used)
+			}
+
+			decrypted, err := DecryptFileContents(encrypted, key)
+			if err != nil {
+				t.Errorf("Method %d, case %d: %v", method, i, err)
+				continue
+			}
+
+			if subtle.ConstantTimeCompare(decrypted, c.data) != 1 {
+				t.Errorf("Test failed for method = %d, case %d", method, i)
+			}
+		}
+	}
+
+	// A threshold of 1 can never be reached
+	encrypted, err := EncryptFileContentsWithOptions(compressible, AES256_ZIP, key, EncryptOptions{AutoCompression: true, MinCompressionSavings: 1})
+	if err != nil {
+		t.Error(err)
+	} else if FileEncryptionMethod(binary.BigEndian.Uint16(encrypted[:2])) != AES256_FLAT {
+		t.Errorf("Expected AES256_FLAT with a threshold of 1")
+	}
+
+	// Methods without compression are not changed
+	encrypted, err = EncryptFileContentsWithOptions(compressible, AES256_GCM, key, EncryptOptions{AutoCompression: true})
+	if err != nil {
+		t.Error(err)
+	} else if FileEncryptionMethod(binary.BigEndian.Uint16(encrypted[:2])) != AES256_GCM {
+		t.Errorf("Expected AES256_GCM to be kept")
+	}
+
+	_, err = EncryptFileContentsWithOptions(compressible, AES256_ZIP, key, EncryptOptions{AutoCompression: true, MinCompressionSavings: 1.5})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument for an invalid threshold, but got (%v)", err)
+	}
+}
+
+func TestFileEncryptionAssociatedData(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := []byte("Test data bound to a context")
+	ad := []byte("file-1/block-3")
+
+	methods := []FileEncryptionMethod{AES256_GCM, AES256_GCM_ZIP, XCHACHA20_POLY1305, XCHACHA20_POLY1305_ZIP, AES256_ZIP_HMAC, AES256_FLAT_HMAC, AES256_GCM_STREAM, AES256_GCM_ZIP_STREAM, AES256_GCM_ZSTD, AES256_GCM_DEFLATE, AES256_GCM_GZIP, XCHACHA20_POLY1305_ZSTD}
+
+	for _, method := range methods {
+		encrypted, err := EncryptFileContentsWithAD(original, method, key, ad)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		decrypted, err := DecryptFileContentsWithAD(encrypted, key, ad)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+			t.Errorf("Test failed for method = %d", method)
+		}
+
+		// Different context
+		_, err = DecryptFileContentsWithAD(encrypted, key, []byte("file-1/block-7"))
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed for a different associated data, but got (%v)", method, err)
+		}
+
+		// Missing context
+		_, err = DecryptFileContents(encrypted, key)
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed without associated data, but got (%v)", method, err)
+		}
+
+		// Cipher text without associated data
+		encrypted, err = EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		_, err = DecryptFileContentsWithAD(encrypted, key, ad)
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed for unexpected associated data, but got (%v)", method, err)
+		}
+
+		// Empty associated data is the same as no associated data
+		encrypted, err = EncryptFileContentsWithAD(original, method, key, nil)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		_, err = DecryptFileContents(encrypted, key)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		}
+
+		// Empty data is encrypted when there is associated data
+		encrypted, err = EncryptFileContentsWithAD([]byte{}, method, key, ad)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		if len(encrypted) == 0 {
+			t.Errorf("Method %d: Expected a non-empty cipher text for empty data", method)
+		}
+
+		decrypted, err = DecryptFileContentsWithAD(encrypted, key, ad)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if len(decrypted) != 0 {
+			t.Errorf("Method %d: Expected empty data, but got %d bytes", method, len(decrypted))
+		}
+	}
+
+	// An empty cipher text cannot be authenticated
+	_, err = DecryptFileContentsWithAD([]byte{}, key, ad)
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for an empty cipher text, but got (%v)", err)
+	}
+
+	// Methods without authentication
+	for _, method := range []FileEncryptionMethod{AES256_ZIP, AES256_FLAT, AES256_ZIP_64, AES256_FLAT_64} {
+		_, err = EncryptFileContentsWithAD(original, method, key, ad)
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Method %d: Expected ErrUnsupported, but got (%v)", method, err)
+		}
+
+		encrypted, err := EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		_, err = DecryptFileContentsWithAD(encrypted, key, ad)
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Method %d: Expected ErrUnsupported, but got (%v)", method, err)
+		}
+	}
+}
+
+func TestFileEncryptionToBuffer(t *testing.T) {
+	key := test_random_key()
+	original := bytes.Repeat([]byte("Test data encrypted into a reused buffer. "), 100)
+	prefix := []byte("prefix")
+
+	methods := []FileEncryptionMethod{AES256_ZIP, AES256_FLAT, AES256_GCM, AES256_GCM_ZIP, XCHACHA20_POLY1305, XCHACHA20_POLY1305_ZIP, AES256_ZIP_HMAC, AES256_FLAT_HMAC, AES256_GCM_STREAM, AES256_GCM_ZIP_STREAM, AES256_ZIP_64, AES256_FLAT_64, AES256_GCM_ZSTD, AES256_GCM_DEFLATE, AES256_GCM_GZIP, XCHACHA20_POLY1305_ZSTD, AES256_SIV, AES256_SIV_ZIP}
+
+	enc_buf := make([]byte, 0)
+	dec_buf := make([]byte, 0)
+
+	for _, method := range methods {
+		for i := 0; i < 2; i++ {
+			var err error
+
+			// Existing contents of the buffer are kept
+			enc_buf, err = EncryptFileContentsTo(append(enc_buf[:0], prefix...), original, method, key, EncryptOptions{})
+
+			if err != nil {
+				t.Errorf("Method %d: %v", method, err)
+				break
+			}
+
+			if !bytes.Equal(enc_buf[:len(prefix)], prefix) {
+				t.Errorf("Method %d: The buffer prefix was modified", method)
+			}
+
+			dec_buf, err = DecryptFileContentsTo(append(dec_buf[:0], prefix...), enc_buf[len(prefix):], key, DecryptOptions{})
+
+			if err != nil {
+				t.Errorf("Method %d: %v", method, err)
+				break
+			}
+
+			if !bytes.Equal(dec_buf[:len(prefix)], prefix) {
+				t.Errorf("Method %d: The buffer prefix was modified (decryption)", method)
+			} else if !bytes.Equal(dec_buf[len(prefix):], original) {
+				t.Errorf("Method %d: Decrypted data does not match the original data", method)
+			}
+
+			// Same format as EncryptFileContents
+			decrypted, err := DecryptFileContents(enc_buf[len(prefix):], key)
+
+			if err != nil {
+				t.Errorf("Method %d: %v", method, err)
+			} else if !bytes.Equal(decrypted, original) {
+				t.Errorf("Method %d: Decrypted data does not match the original data (DecryptFileContents)", method)
+			}
+		}
+	}
+
+	// The data to encrypt is not modified, even with spare capacity (padding)
+	data := make([]byte, 10, 64)
+	copy(data, "0123456789")
+	spare := data[:64]
+
+	_, err := EncryptFileContentsTo(nil, data, AES256_FLAT, key, EncryptOptions{})
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(spare[10:], make([]byte, 54)) {
+		t.Errorf("The spare capacity of the data was modified")
+	}
+}
+
+func TestFileEncryptionToBufferAllocations(t *testing.T) {
+	if race_enabled {
+		t.Skip("Allocations cannot be counted with the race detector enabled")
+	}
+
+	key := test_random_key()
+	original := bytes.Repeat([]byte("Test data encrypted into a reused buffer. "), 100)
+
+	for _, method := range []FileEncryptionMethod{AES256_GCM, AES256_GCM_ZIP, AES256_ZIP} {
+		enc_buf, err := EncryptFileContentsTo(nil, original, method, key, EncryptOptions{})
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		dec_buf, err := DecryptFileContentsTo(nil, enc_buf, key, DecryptOptions{})
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		encrypted := bytes.Clone(enc_buf)
+
+		allocs := testing.AllocsPerRun(20, func() {
+			enc_buf, _ = EncryptFileContentsTo(enc_buf[:0], original, method, key, EncryptOptions{})
+			dec_buf, _ = DecryptFileContentsTo(dec_buf[:0], encrypted, key, DecryptOptions{})
+		})
+
+		// Only the cipher instances are allocated, the data buffers are reused
+		if allocs > 16 {
+			t.Errorf("Method %d: Too many allocations per run: %v", method, allocs)
+		}
+	}
+
+	// Packs reuse the cipher instances and the buffers for every file
+
+	pack := NewMemoryFile("pack", nil)
+	pws := NewMultiFilePackWriteStream(pack)
+
+	err := pws.InitializeWithOptions(100, MultiFilePackOptions{Key: key})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	allocs := testing.AllocsPerRun(20, func() {
+		err = pws.PutFile(original)
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Only small allocations of a fixed size remain (associated data, decompressor state)
+	if allocs > 4 {
+		t.Errorf("Pack write: Too many allocations per run: %v", allocs)
+	}
+
+	prs, err := NewMultiFilePackReadStreamWithKey(pack, pack.Size(), key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer prs.Close()
+
+	file_buf, err := prs.GetFileTo(nil, 0)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	allocs = testing.AllocsPerRun(20, func() {
+		file_buf, err = prs.GetFileTo(file_buf[:0], 1)
+	})
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(file_buf, original) {
+		t.Errorf("Pack read: Data does not match the original data")
+	}
+
+	if allocs > 4 {
+		t.Errorf("Pack read: Too many allocations per run: %v", allocs)
+	}
+}
@@ -1,3 +1,10 @@
 module github.com/AgustinSRG/encrypted-storage
 
-go 1.20
+go 1.24
+
+require (
+	github.com/klauspost/compress v1.17.9
+	golang.org/x/crypto v0.33.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,190 @@
+// Password-based key derivation
+
+package encrypted_storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Key derivation function
+type KeyDerivationFunction uint8
+
+const (
+	KDF_ARGON2ID KeyDerivationFunction = 1 // Argon2id (RFC 9106)
+)
+
+const (
+	KDF_DEFAULT_TIME       = 3         // Default number of passes over the memory
+	KDF_DEFAULT_MEMORY     = 64 * 1024 // Default memory, in KiB (64 MiB)
+	KDF_DEFAULT_THREADS    = 4         // Default number of threads
+	KDF_DEFAULT_KEY_LENGTH = KEY_SIZE  // Length of the derived key, in bytes (the only one accepted, since the methods require it)
+	KDF_DEFAULT_SALT_SIZE  = 16        // Default size of the salt, in bytes
+
+	// Limits for the decoded parameters, so a modified parameter blob cannot make a derivation take more than 1 GiB of memory,
+	// or more than 10 passes over it
+	KDF_MAX_TIME      = 10          // Max number of passes over the memory
+	KDF_MAX_MEMORY    = 1024 * 1024 // Max memory, in KiB (1 GiB)
+	KDF_MIN_SALT_SIZE = 8           // Min size of the salt, in bytes
+	KDF_MAX_SALT_SIZE = 64          // Max size of the salt, in bytes
+)
+
+// Size of the encoded parameters, without the salt length and the salt
+const kdf_params_fixed = 1 + 4 + 4 + 1 + 2
+
+// Parameters to derive a key from a password
+// Store them (see Encode) next to the encrypted data, in order to derive the same key again
+type KeyDerivationParams struct {
+	KDF       KeyDerivationFunction // Key derivation function
+	Time      uint32                // Number of passes over the memory
+	Memory    uint32                // Memory, in KiB
+	Threads   uint8                 // Number of threads
+	KeyLength uint16                // Length of the derived key, in bytes. Must be KEY_SIZE
+	Salt      []byte                // Random salt
+}
+
+// Creates parameters to derive a new key, with a random salt and the default costs
+// Returns the parameters
+func NewKeyDerivationParams() (*KeyDerivationParams, error) {
+	salt := make([]byte, KDF_DEFAULT_SALT_SIZE)
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyDerivationParams{
+		KDF:       KDF_ARGON2ID,
+		Time:      KDF_DEFAULT_TIME,
+		Memory:    KDF_DEFAULT_MEMORY,
+		Threads:   KDF_DEFAULT_THREADS,
+		KeyLength: KDF_DEFAULT_KEY_LENGTH,
+		Salt:      salt,
+	}, nil
+}
+
+// Checks the parameters are valid and within the limits
+// Returns ErrInvalidArgument if they are not
+func (p *KeyDerivationParams) validate() error {
+	if p.KDF != KDF_ARGON2ID {
+		return ErrInvalidArgument
+	}
+
+	if p.Time < 1 || p.Time > KDF_MAX_TIME {
+		return ErrInvalidArgument
+	}
+
+	if p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.Memory > KDF_MAX_MEMORY {
+		return ErrInvalidArgument
+	}
+
+	if p.KeyLength != KEY_SIZE {
+		return ErrInvalidArgument
+	}
+
+	if len(p.Salt) < KDF_MIN_SALT_SIZE || len(p.Salt) > KDF_MAX_SALT_SIZE {
+		return ErrInvalidArgument
+	}
+
+	return nil
+}
+
+// Encodes the parameters as binary data, to be stored next to the encrypted data
+// Returns the encoded parameters
+func (p *KeyDerivationParams) Encode() []byte {
+	result := make([]byte, kdf_params_fixed+1+len(p.Salt))
+
+	result[0] = byte(p.KDF)
+	binary.BigEndian.PutUint32(result[1:5], p.Time)
+	binary.BigEndian.PutUint32(result[5:9], p.Memory)
+	result[9] = p.Threads
+	binary.BigEndian.PutUint16(result[10:12], p.KeyLength)
+	result[12] = byte(len(p.Salt))
+	copy(result[13:], p.Salt)
+
+	return result
+}
+
+// Decodes parameters encoded with KeyDerivationParams.Encode
+// data - Encoded parameters
+// Returns the parameters. If they are not valid, or exceed the limits, returns ErrInvalidData (or ErrTruncatedData)
+func DecodeKeyDerivationParams(data []byte) (*KeyDerivationParams, error) {
+	if len(data) < kdf_params_fixed+1 {
+		return nil, ErrTruncatedData
+	}
+
+	salt_length := int(data[12])
+
+	if len(data) != kdf_params_fixed+1+salt_length {
+		return nil, ErrInvalidData
+	}
+
+	p := &KeyDerivationParams{
+		KDF:       KeyDerivationFunction(data[0]),
+		Time:      binary.BigEndian.Uint32(data[1:5]),
+		Memory:    binary.BigEndian.Uint32(data[5:9]),
+		Threads:   data[9],
+		KeyLength: binary.BigEndian.Uint16(data[10:12]),
+		Salt:      append([]byte(nil), data[13:]...),
+	}
+
+	if p.validate() != nil {
+		return nil, ErrInvalidData
+	}
+
+	return p, nil
+}
+
+// Derives a key from a password
+// password - Password
+// params - Parameters. Use NewKeyDerivationParams for a new key, or DecodeKeyDerivationParams for an existing one
+// Returns the key
+func DeriveKeyFromPassword(password []byte, params *KeyDerivationParams) ([]byte, error) {
+	if params == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	err := params.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return argon2.IDKey(password, params.Salt, params.Time, params.Memory, params.Threads, uint32(params.KeyLength)), nil
+}
+
+// Derives a new key from a password, with a random salt and the default parameters
+// password - Password
+// Returns the key, and the encoded parameters to store next to the encrypted data.
+// To derive the key again, call DeriveKeyFromPasswordWithEncodedParams with the encoded parameters.
+func DeriveNewKeyFromPassword(password []byte) (key []byte, encoded_params []byte, err error) {
+	params, err := NewKeyDerivationParams()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err = DeriveKeyFromPassword(password, params)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, params.Encode(), nil
+}
+
+// Derives a key from a password, using encoded parameters
+// password - Password
+// encoded_params - Parameters, encoded with KeyDerivationParams.Encode
+// Returns the key
+func DeriveKeyFromPasswordWithEncodedParams(password []byte, encoded_params []byte) ([]byte, error) {
+	params, err := DecodeKeyDerivationParams(encoded_params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DeriveKeyFromPassword(password, params)
+}
@@ -0,0 +1,148 @@
+// Password-based key derivation (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyDerivation(t *testing.T) {
+	password := []byte("correct horse battery staple")
+
+	// Default parameters
+
+	key, encoded_params, err := DeriveNewKeyFromPassword(password)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(key) != KDF_DEFAULT_KEY_LENGTH {
+		t.Errorf("Expected a key of %d bytes, but got %d", KDF_DEFAULT_KEY_LENGTH, len(key))
+	}
+
+	key2, err := DeriveKeyFromPasswordWithEncodedParams(password, encoded_params)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(key, key2) {
+		t.Errorf("Expected the same key to be derived from the encoded parameters")
+	}
+
+	encrypted, err := EncryptFileContents([]byte("Test data"), AES256_GCM, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = DecryptFileContents(encrypted, key2)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Cheap parameters for the rest of the test
+
+	params, err := NewKeyDerivationParams()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	params.Time = 1
+	params.Memory = 1024
+	params.Threads = 1
+
+	decoded, err := DecodeKeyDerivationParams(params.Encode())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if decoded.KDF != params.KDF || decoded.Time != params.Time || decoded.Memory != params.Memory || decoded.Threads != params.Threads || decoded.KeyLength != params.KeyLength || !bytes.Equal(decoded.Salt, params.Salt) {
+		t.Errorf("Decoded parameters do not match: %+v, %+v", decoded, params)
+	}
+
+	key, err = DeriveKeyFromPassword(password, params)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key2, err = DeriveKeyFromPassword([]byte("wrong password"), params)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Equal(key, key2) {
+		t.Errorf("Expected different keys for different passwords")
+	}
+
+	params2 := *params
+	params2.Salt = bytes.Repeat([]byte{1}, KDF_DEFAULT_SALT_SIZE)
+
+	key2, err = DeriveKeyFromPassword(password, &params2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Equal(key, key2) {
+		t.Errorf("Expected different keys for different salts")
+	}
+
+	// Invalid parameters
+
+	encoded := params.Encode()
+
+	_, err = DecodeKeyDerivationParams(encoded[:5])
+
+	if !errors.Is(err, ErrTruncatedData) {
+		t.Errorf("Expected ErrTruncatedData, but got (%v)", err)
+	}
+
+	_, err = DecodeKeyDerivationParams(encoded[:len(encoded)-1])
+
+	if !errors.Is(err, ErrInvalidData) {
+		t.Errorf("Expected ErrInvalidData for a truncated salt, but got (%v)", err)
+	}
+
+	invalid_params := []KeyDerivationParams{
+		{KDF: 0, Time: 1, Memory: 1024, Threads: 1, KeyLength: 32, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 0, Memory: 1024, Threads: 1, KeyLength: 32, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: KDF_MAX_TIME + 1, Memory: 1024, Threads: 1, KeyLength: 32, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: KDF_MAX_MEMORY + 1, Threads: 1, KeyLength: 32, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 0, KeyLength: 32, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 1, KeyLength: 8, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 1, KeyLength: 16, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 1, KeyLength: 64, Salt: params.Salt},
+		{KDF: KDF_ARGON2ID, Time: 1, Memory: 1024, Threads: 1, KeyLength: 32, Salt: params.Salt[:4]},
+	}
+
+	for i, p := range invalid_params {
+		_, err = DecodeKeyDerivationParams(p.Encode())
+
+		if !errors.Is(err, ErrInvalidData) {
+			t.Errorf("Case %d: Expected ErrInvalidData, but got (%v)", i, err)
+		}
+
+		_, err = DeriveKeyFromPassword(password, &p)
+
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Case %d: Expected ErrInvalidArgument, but got (%v)", i, err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Keyring, to encrypt with an active key and decrypt with any of the keys
+
+package encrypted_storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Set of keys, identified by their key ID
+// One of them is the active key, used to encrypt. Any of them can be used to decrypt.
+// The data encrypted with a keyring contains the ID of the key (see KEY_ID_WRAPPER),
+// so the right key is found without trying all of them.
+// It is safe for concurrent use
+type Keyring struct {
+	mu sync.RWMutex // Mutex
+
+	keys       map[KeyID][]byte // Keys, by ID
+	order      []KeyID          // Key IDs, in the order they were added
+	active     KeyID            // ID of the active key
+	has_active bool             // True if there is an active key
+}
+
+// Creates an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys:  make(map[KeyID][]byte),
+		order: make([]KeyID, 0),
+	}
+}
+
+// Adds a key to the keyring
+// If there is no active key, the key becomes the active one
+// key - The key (it is copied)
+// Returns the key ID
+func (kr *Keyring) Add(key []byte) (KeyID, error) {
+	if len(key) == 0 {
+		return KeyID{}, ErrInvalidArgument
+	}
+
+	id := ComputeKeyID(key)
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, exists := kr.keys[id]; !exists {
+		kr.keys[id] = append([]byte(nil), key...)
+		kr.order = append(kr.order, id)
+	}
+
+	if !kr.has_active {
+		kr.active = id
+		kr.has_active = true
+	}
+
+	return id, nil
+}
+
+// Removes a key from the keyring
+// If it was the active key, there will be no active key until SetActive is called
+// id - Key ID
+func (kr *Keyring) Remove(id KeyID) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, exists := kr.keys[id]; !exists {
+		return
+	}
+
+	delete(kr.keys, id)
+
+	for i, oid := range kr.order {
+		if oid == id {
+			kr.order = append(kr.order[:i], kr.order[i+1:]...)
+			break
+		}
+	}
+
+	if kr.has_active && kr.active == id {
+		kr.has_active = false
+	}
+}
+
+// Sets the active key, used to encrypt
+// id - Key ID. The key must be in the keyring
+func (kr *Keyring) SetActive(id KeyID) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, exists := kr.keys[id]; !exists {
+		return ErrKeyNotFound
+	}
+
+	kr.active = id
+	kr.has_active = true
+
+	return nil
+}
+
+// Returns the ID of the active key, and true if there is an active key
+func (kr *Keyring) ActiveKeyID() (KeyID, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return kr.active, kr.has_active
+}
+
+// Finds a key
+// id - Key ID
+// Returns the key (it must not be modified), and true if it was found
+func (kr *Keyring) Get(id KeyID) ([]byte, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, ok := kr.keys[id]
+
+	return key, ok
+}
+
+// Returns the IDs of the keys, in the order they were added
+func (kr *Keyring) KeyIDs() []KeyID {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return append([]KeyID(nil), kr.order...)
+}
+
+// Returns the active key and its ID
+// Returns ErrKeyNotFound if there is no active key
+func (kr *Keyring) active_key() (KeyID, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	if !kr.has_active {
+		return KeyID{}, nil, ErrKeyNotFound
+	}
+
+	return kr.active, kr.keys[kr.active], nil
+}
+
+// Returns all the keys, starting with the active one
+func (kr *Keyring) keys_to_try() [][]byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	result := make([][]byte, 0, len(kr.order))
+
+	if kr.has_active {
+		result = append(result, kr.keys[kr.active])
+	}
+
+	for _, id := range kr.order {
+		if !kr.has_active || id != kr.active {
+			result = append(result, kr.keys[id])
+		}
+	}
+
+	return result
+}
+
+// Encrypts file contents with the active key of a keyring
+// The cipher text uses the KEY_ID_WRAPPER method, containing the ID of the key
+// data - File data
+// method - algorithm to use
+// keyring - Keyring
+// Returns the cipher text, or an error
+func EncryptFileContentsWithKeyring(data []byte, method FileEncryptionMethod, keyring *Keyring) ([]byte, error) {
+	return EncryptFileContentsWithKeyringOptions(data, method, keyring, EncryptOptions{})
+}
+
+// Encrypts file contents with the active key of a keyring, with options
+// data - File data
+// method - algorithm to use
+// keyring - Keyring
+// options - Encryption options
+// Returns the cipher text, or an error
+func EncryptFileContentsWithKeyringOptions(data []byte, method FileEncryptionMethod, keyring *Keyring, options EncryptOptions) ([]byte, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	if options.Signer != nil {
+		signer := options.Signer
+		options.Signer = nil
+
+		cipher_text, err := EncryptFileContentsWithKeyringOptions(data, method, keyring, options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return SignFileContents(cipher_text, signer)
+	}
+
+	id, key, err := keyring.active_key()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypt_with_key_id(make([]byte, 0), data, method, key, id, options, nil)
+}
+
+// Decrypts file contents with a keyring
+// data - Cipher text
+// keyring - Keyring
+// Returns the original file data, or an error
+func DecryptFileContentsWithKeyring(data []byte, keyring *Keyring) ([]byte, error) {
+	return DecryptFileContentsWithKeyringOptions(data, keyring, DecryptOptions{})
+}
+
+// Decrypts file contents with a keyring, with options
+// If the cipher text contains the key ID, the key is taken from the keyring (ErrKeyNotFound is returned if it is not there).
+// Otherwise, every key is tried, starting with the active one, and the result of the first one not failing is returned.
+// This is only reliable for authenticated methods, since the rest do not always fail when using a wrong key.
+// data - Cipher text
+// keyring - Keyring
+// options - Decryption options
+// Returns the original file data, or an error
+func DecryptFileContentsWithKeyringOptions(data []byte, keyring *Keyring, options DecryptOptions) ([]byte, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	if options.MaxCiphertextSize > 0 && int64(len(data)) > options.MaxCiphertextSize {
+		return nil, &SizeLimitError{Limit: options.MaxCiphertextSize, Ciphertext: true}
+	}
+
+	data, err := strip_signature(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= 2 && FileEncryptionMethod(binary.BigEndian.Uint16(data[:2])) == KEY_ID_WRAPPER {
+		if len(data) < 2+KEY_ID_SIZE {
+			return nil, ErrTruncatedData
+		}
+
+		var id KeyID
+		copy(id[:], data[2:2+KEY_ID_SIZE])
+
+		key, ok := keyring.Get(id)
+
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+
+		return DecryptFileContentsWithOptions(data, key, options)
+	}
+
+	// No key ID, try every key
+
+	keys := keyring.keys_to_try()
+
+	if len(keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	var first_err error
+
+	for _, key := range keys {
+		plaintext, err := DecryptFileContentsWithOptions(data, key, options)
+
+		if err == nil {
+			return plaintext, nil
+		}
+
+		if errors.Is(err, ErrSizeLimitExceeded) {
+			// The key is right, but the data is too large
+			return nil, err
+		}
+
+		if first_err == nil {
+			first_err = err
+		}
+	}
+
+	return nil, first_err
+}
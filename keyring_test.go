@@ -0,0 +1,333 @@
+// Keyring (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func test_random_key() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+func TestKeyring(t *testing.T) {
+	key1 := test_random_key()
+	key2 := test_random_key()
+
+	original := []byte("Test data for the keyring")
+
+	keyring := NewKeyring()
+
+	_, err := EncryptFileContentsWithKeyring(original, AES256_GCM, keyring)
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for an empty keyring, but got (%v)", err)
+	}
+
+	id1, err := keyring.Add(key1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if id1 != ComputeKeyID(key1) {
+		t.Errorf("Expected the key ID to be the fingerprint of the key")
+	}
+
+	active, ok := keyring.ActiveKeyID()
+
+	if !ok || active != id1 {
+		t.Errorf("Expected the first key to be the active one")
+	}
+
+	encrypted1, err := EncryptFileContentsWithKeyring(original, AES256_GCM, keyring)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Rotate the key
+
+	id2, err := keyring.Add(key2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = keyring.SetActive(id2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted2, err := EncryptFileContentsWithKeyring(original, AES256_ZIP, keyring)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, encrypted := range [][]byte{encrypted1, encrypted2} {
+		decrypted, err := DecryptFileContentsWithKeyring(encrypted, keyring)
+
+		if err != nil {
+			t.Errorf("Case %d: %v", i, err)
+		} else if !bytes.Equal(decrypted, original) {
+			t.Errorf("Case %d: Decrypted data does not match the original data", i)
+		}
+	}
+
+	// The wrapper also works with a single key
+
+	decrypted, err := DecryptFileContents(encrypted2, key2)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	_, err = DecryptFileContents(encrypted2, key1)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a wrong key, but got (%v)", err)
+	}
+
+	// Removed key
+
+	keyring.Remove(id1)
+
+	_, err = DecryptFileContentsWithKeyring(encrypted1, keyring)
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound after removing the key, but got (%v)", err)
+	}
+
+	if len(keyring.KeyIDs()) != 1 {
+		t.Errorf("Expected 1 key, but got %d", len(keyring.KeyIDs()))
+	}
+
+	// Cipher text without key ID, every key is tried
+
+	_, err = keyring.Add(key1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	legacy, err := EncryptFileContents(original, AES256_GCM, key1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err = DecryptFileContentsWithKeyring(legacy, keyring)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	// Direct use of the wrapper method
+
+	encrypted, err := EncryptFileContents(original, KEY_ID_WRAPPER, key1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err = DecryptFileContentsWithKeyring(encrypted, keyring)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	// Associated data is passed to the wrapped method
+
+	encrypted, err = EncryptFileContentsWithKeyringOptions(original, XCHACHA20_POLY1305, keyring, EncryptOptions{AssociatedData: []byte("context")})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = DecryptFileContentsWithKeyringOptions(encrypted, keyring, DecryptOptions{AssociatedData: []byte("other context")})
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for a different associated data, but got (%v)", err)
+	}
+
+	_, err = EncryptFileContentsWithKeyring(original, KEY_ID_WRAPPER, keyring)
+
+	if !errors.Is(err, ErrInvalidMethod) {
+		t.Errorf("Expected ErrInvalidMethod for nested wrappers, but got (%v)", err)
+	}
+}
+
+func TestKeyringStreams(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_block_file := path.Join(test_path_base, "test_block_file_keyring")
+	test_pack_file := path.Join(test_path_base, "test_multi_file_pack_keyring")
+
+	defer os.Remove(test_block_file)
+	defer os.Remove(test_pack_file)
+
+	keyring := NewKeyring()
+	old_id, _ := keyring.Add(test_random_key())
+
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Block-encrypted file
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_block_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithOptions(int64(len(original)), 300, nil, FileBlockEncryptOptions{Authenticated: true, Keyring: keyring})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Multi-file pack
+
+	pw, err := CreateMultiFilePackWriteStream(test_pack_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pw.InitializeWithOptions(1, MultiFilePackOptions{Keyring: keyring})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pw.PutFile(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pw.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Rotate the key, the files must still be readable
+
+	new_id, _ := keyring.Add(test_random_key())
+	keyring.SetActive(new_id)
+
+	rs, err := CreateFileBlockEncryptReadStreamWithKeyring(test_block_file, keyring, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := io.ReadAll(rs)
+
+	rs.Close()
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	pr, err := CreateMultiFilePackReadStreamWithKeyring(test_pack_file, keyring, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err = pr.GetFile(0)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	pr.Close()
+
+	// Without the old key
+
+	keyring.Remove(old_id)
+
+	rs, err = CreateFileBlockEncryptReadStreamWithKeyring(test_block_file, keyring, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = io.ReadAll(rs)
+
+	rs.Close()
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, but got (%v)", err)
+	}
+}
@@ -0,0 +1,171 @@
+// AEAD encryption methods (AES-256-GCM, XChaCha20-Poly1305)
+
+package encrypted_storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+const (
+	AES_GCM_NONCE_SIZE = 12 // Size of the nonce for AES-GCM, in bytes
+	AES_GCM_TAG_SIZE   = 16 // Size of the authentication tag for AES-GCM, in bytes
+
+	AES_GCM_MAX_SIZE            = ((1 << 32) - 2) * 16 // Max size of the data encrypted with AES-GCM, in bytes
+	XCHACHA20_POLY1305_MAX_SIZE = (1 << 38) - 64       // Max size of the data encrypted with XChaCha20-Poly1305, in bytes
+)
+
+// AEAD method, with a random nonce
+// Header: Nonce (nonce_size bytes)
+// Body: Cipher text + Authentication tag
+// The method ID (and the associated data, if any) is authenticated as additional data
+type aead_method struct {
+	id          FileEncryptionMethod                  // Method ID
+	compression compression_algorithm                 // Compression algorithm applied before encrypting the data
+	nonce_size  int                                   // Size of the nonce, in bytes
+	new_aead    func(key []byte) (cipher.AEAD, error) // Creates the AEAD instance for a key
+	max_size    uint64                                // Max size of the data to encrypt, in bytes
+}
+
+func (m *aead_method) ID() FileEncryptionMethod {
+	return m.id
+}
+
+func (m *aead_method) HeaderSize() int {
+	return m.nonce_size
+}
+
+func (m *aead_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithLevel(data, key, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *aead_method) EncryptWithLevel(data []byte, key []byte, level int) ([]byte, []byte, error) {
+	return m.EncryptWithAD(data, key, nil, level)
+}
+
+func (m *aead_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	result, err := m.encrypt_append(nil, data, key, ad, level, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result[:m.nonce_size], result[m.nonce_size:], nil
+}
+
+func (m *aead_method) encrypt_append(dst []byte, data []byte, key []byte, ad []byte, level int, cache *cipher_cache) ([]byte, error) {
+	final_data := data
+
+	if m.compression != compression_none {
+		// Compress the data
+		buf := get_buffer()
+		defer put_buffer(buf)
+
+		compressed, err := compress_data_append(*buf, m.compression, data, level)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*buf = compressed
+		final_data = compressed
+	}
+
+	if uint64(len(final_data)) > m.max_size {
+		return nil, ErrDataTooLarge
+	}
+
+	aead, err := cache.get_aead(m.id, key, m.new_aead)
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	// Generate nonce
+	start := len(dst)
+	dst = append(dst, make([]byte, m.nonce_size)...)
+	nonce := dst[start:]
+
+	_, err = rand.Read(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt, binding the method ID and the associated data to the cipher text
+	return aead.Seal(dst, nonce, final_data, m.additional_data(ad)), nil
+}
+
+func (m *aead_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptLimited(header, body, key, 0)
+}
+
+func (m *aead_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *aead_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	return m.decrypt_append(nil, header, body, key, ad, max_size, nil)
+}
+
+func (m *aead_method) decrypt_append(dst []byte, header []byte, body []byte, key []byte, ad []byte, max_size int64, cache *cipher_cache) ([]byte, error) {
+	aead, err := cache.get_aead(m.id, key, m.new_aead)
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	if len(body) < aead.Overhead() {
+		return nil, ErrTruncatedData
+	}
+
+	if m.compression == compression_none {
+		if max_size > 0 && int64(len(body)-aead.Overhead()) > max_size {
+			return nil, &SizeLimitError{Limit: max_size}
+		}
+
+		// Decrypt and check the authentication tag
+		result, err := aead.Open(dst, header, body, m.additional_data(ad))
+
+		if err != nil {
+			return nil, ErrAuthenticationFailed
+		}
+
+		return result, nil
+	}
+
+	buf := get_buffer()
+	defer put_buffer(buf)
+
+	// Decrypt and check the authentication tag
+	plaintext, err := aead.Open(*buf, header, body, m.additional_data(ad))
+
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	*buf = plaintext
+
+	// Decompress the data
+	return decompress_data_append(dst, m.compression, plaintext, max_size)
+}
+
+// Returns the additional data to authenticate (the method ID, followed by the associated data)
+// ad - Associated data
+func (m *aead_method) additional_data(ad []byte) []byte {
+	result := make([]byte, 2+len(ad))
+	binary.BigEndian.PutUint16(result, uint16(m.id))
+	copy(result[2:], ad)
+	return result
+}
+
+// Creates an AES-256-GCM AEAD instance
+// key - Encryption key
+func new_aes_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
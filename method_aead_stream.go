@@ -0,0 +1,443 @@
+// Segmented AEAD encryption methods, supporting streaming
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	STREAM_SEGMENT_SIZE     = 64 * 1024        // Size of the plaintext segments for the streaming methods, in bytes
+	STREAM_SEGMENT_SIZE_MAX = 16 * 1024 * 1024 // Max segment size accepted when decrypting, in bytes
+	STREAM_SALT_SIZE        = 16               // Size of the salt used to derive the segment key, in bytes
+)
+
+// Segmented AEAD method
+// Header: Segment size (4 bytes) + Salt (16 bytes)
+// Body: Sequence of segments, each one: Cipher text (up to segment size) + Authentication tag
+// Every segment is full-size, except for the last one (that may be empty).
+// A key is derived for each stream from the key and the salt.
+// The nonce of each segment is its index, and a flag indicating if it is the last one,
+// so segments cannot be reordered, removed or truncated.
+type aead_stream_method struct {
+	id       FileEncryptionMethod                  // Method ID
+	compress bool                                  // True to compress the data with ZLIB before encrypting it
+	new_aead func(key []byte) (cipher.AEAD, error) // Creates the AEAD instance for a key (12 bytes nonce)
+}
+
+func (m *aead_stream_method) ID() FileEncryptionMethod {
+	return m.id
+}
+
+func (m *aead_stream_method) HeaderSize() int {
+	return 4 + STREAM_SALT_SIZE
+}
+
+func (m *aead_stream_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithLevel(data, key, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *aead_stream_method) EncryptWithLevel(data []byte, key []byte, level int) ([]byte, []byte, error) {
+	return m.EncryptWithAD(data, key, nil, level)
+}
+
+func (m *aead_stream_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	var b bytes.Buffer
+
+	w, err := m.encrypt_stream(&b, key, ad, level)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = w.Write(data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := b.Bytes()
+
+	return result[:m.HeaderSize()], result[m.HeaderSize():], nil
+}
+
+func (m *aead_stream_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptLimited(header, body, key, 0)
+}
+
+func (m *aead_stream_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *aead_stream_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	r, err := m.decrypt_stream(io.MultiReader(bytes.NewReader(header), bytes.NewReader(body)), key, ad)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return read_all_limited(r, max_size, func(err error) error { return err })
+}
+
+func (m *aead_stream_method) EncryptStream(w io.Writer, key []byte) (io.WriteCloser, error) {
+	return m.encrypt_stream(w, key, nil, COMPRESSION_LEVEL_DEFAULT)
+}
+
+// Creates a writer to encrypt data incrementally
+// w - Writer to write the header and body into
+// key - Encryption key
+// ad - Associated data (may be empty)
+// level - Compression level
+func (m *aead_stream_method) encrypt_stream(w io.Writer, key []byte, ad []byte, level int) (io.WriteCloser, error) {
+	if level < COMPRESSION_LEVEL_DEFAULT || level > COMPRESSION_LEVEL_BEST {
+		return nil, ErrInvalidArgument
+	}
+
+	header := make([]byte, m.HeaderSize())
+	binary.BigEndian.PutUint32(header[:4], uint32(STREAM_SEGMENT_SIZE))
+
+	// Generate salt
+	_, err := rand.Read(header[4:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := m.derive_aead(key, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sw := &aead_stream_writer{
+		w:            w,
+		aead:         aead,
+		ad:           m.additional_data(header, ad),
+		segment_size: STREAM_SEGMENT_SIZE,
+		buf:          make([]byte, 0, STREAM_SEGMENT_SIZE),
+	}
+
+	if !m.compress {
+		return sw, nil
+	}
+
+	zw, err := zlib.NewWriterLevel(sw, flate_level(level))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &zlib_stream_writer{
+		zw:    zw,
+		inner: sw,
+	}, nil
+}
+
+func (m *aead_stream_method) DecryptStream(r io.Reader, key []byte) (io.Reader, error) {
+	return m.decrypt_stream(r, key, nil)
+}
+
+// Creates a reader to decrypt data incrementally
+// r - Reader to read the header and body from
+// key - Decryption key
+// ad - Associated data (may be empty)
+func (m *aead_stream_method) decrypt_stream(r io.Reader, key []byte, ad []byte) (io.Reader, error) {
+	header := make([]byte, m.HeaderSize())
+	_, err := io.ReadFull(r, header)
+
+	if err != nil {
+		return nil, read_full_error(err)
+	}
+
+	segment_size := int(binary.BigEndian.Uint32(header[:4]))
+
+	if segment_size <= 0 || segment_size > STREAM_SEGMENT_SIZE_MAX {
+		return nil, ErrInvalidData
+	}
+
+	aead, err := m.derive_aead(key, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &aead_stream_reader{
+		r:            r,
+		aead:         aead,
+		ad:           m.additional_data(header, ad),
+		segment_size: segment_size,
+		enc:          make([]byte, segment_size+aead.Overhead()),
+	}
+
+	if !m.compress {
+		return sr, nil
+	}
+
+	zr, err := zlib.NewReader(sr)
+
+	if err != nil {
+		if errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrTruncatedData) || errors.Is(err, ErrSizeLimitExceeded) {
+			return nil, err
+		}
+
+		return nil, invalid_data_error(err)
+	}
+
+	return &zlib_stream_reader{
+		zr:    zr,
+		inner: sr,
+	}, nil
+}
+
+// Derives the key for a stream, and creates the AEAD instance
+// The stream key is always of 32 bytes, so keys of 16 and 24 bytes are also accepted
+// key - Encryption key
+// header - Stream header, containing the salt
+func (m *aead_stream_method) derive_aead(key []byte, header []byte) (cipher.AEAD, error) {
+	if !is_valid_key_size(len(key)) {
+		return nil, invalid_key_error(fmt.Errorf("invalid key size %d", len(key)))
+	}
+
+	stream_key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, header[4:], []byte("encrypted-storage stream segment key")), stream_key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := m.new_aead(stream_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	return aead, nil
+}
+
+// Returns the additional data to authenticate for every segment (method ID + header + associated data)
+// header - Stream header
+// ad - Associated data (may be empty)
+func (m *aead_stream_method) additional_data(header []byte, ad []byte) []byte {
+	result := make([]byte, 2+len(header)+len(ad))
+	binary.BigEndian.PutUint16(result, uint16(m.id))
+	copy(result[2:], header)
+	copy(result[2+len(header):], ad)
+	return result
+}
+
+// Computes the nonce for a segment
+// counter - Index of the segment
+// last - True if it is the last segment
+func stream_segment_nonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// Writer for segmented AEAD streams
+type aead_stream_writer struct {
+	w            io.Writer   // Destination
+	aead         cipher.AEAD // AEAD instance
+	ad           []byte      // Additional data
+	segment_size int         // Segment size
+	counter      uint64      // Index of the next segment
+	buf          []byte      // Pending plaintext
+	out          []byte      // Buffer for the encrypted segments
+	closed       bool        // True if closed
+}
+
+func (sw *aead_stream_writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, ErrClosed
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		n := sw.segment_size - len(sw.buf)
+
+		if n > len(p) {
+			n = len(p)
+		}
+
+		sw.buf = append(sw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(sw.buf) == sw.segment_size {
+			// Full segment, the last one is always smaller
+			err := sw.flush(false)
+
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (sw *aead_stream_writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+
+	sw.closed = true
+
+	return sw.flush(true)
+}
+
+// Encrypts and writes the pending plaintext as a segment
+// last - True if it is the last segment
+func (sw *aead_stream_writer) flush(last bool) error {
+	sw.out = sw.aead.Seal(sw.out[:0], stream_segment_nonce(sw.counter, last), sw.buf, sw.ad)
+	sw.buf = sw.buf[:0]
+	sw.counter++
+
+	_, err := sw.w.Write(sw.out)
+
+	return err
+}
+
+// Reader for segmented AEAD streams
+type aead_stream_reader struct {
+	r            io.Reader   // Source
+	aead         cipher.AEAD // AEAD instance
+	ad           []byte      // Additional data
+	segment_size int         // Segment size
+	counter      uint64      // Index of the next segment
+	enc          []byte      // Buffer for the encrypted segment
+	plain        []byte      // Current decrypted segment
+	pos          int         // Position in the current segment
+	done         bool        // True after the last segment was decrypted
+}
+
+func (sr *aead_stream_reader) Read(p []byte) (int, error) {
+	for sr.pos >= len(sr.plain) {
+		if sr.done {
+			return 0, io.EOF
+		}
+
+		err := sr.next_segment()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.plain[sr.pos:])
+	sr.pos += n
+
+	return n, nil
+}
+
+// Reads and decrypts the next segment
+func (sr *aead_stream_reader) next_segment() error {
+	n, err := io.ReadFull(sr.r, sr.enc)
+
+	last := false
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Only the last segment is smaller
+		last = true
+	} else if err != nil {
+		return err
+	}
+
+	if n < sr.aead.Overhead() {
+		return ErrTruncatedData
+	}
+
+	plain, err := sr.aead.Open(sr.plain[:0], stream_segment_nonce(sr.counter, last), sr.enc[:n], sr.ad)
+
+	if err != nil {
+		return ErrAuthenticationFailed
+	}
+
+	sr.plain = plain
+	sr.pos = 0
+	sr.counter++
+	sr.done = last
+
+	return nil
+}
+
+// Writer compressing data before writing it into a segmented stream
+type zlib_stream_writer struct {
+	zw    *zlib.Writer        // Compressor
+	inner *aead_stream_writer // Segmented stream
+}
+
+func (w *zlib_stream_writer) Write(p []byte) (int, error) {
+	return w.zw.Write(p)
+}
+
+func (w *zlib_stream_writer) Close() error {
+	err := w.zw.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return w.inner.Close()
+}
+
+// Reader decompressing data from a segmented stream
+// Once the compressed data ends, the rest of the stream is verified
+type zlib_stream_reader struct {
+	zr    io.ReadCloser       // Decompressor
+	inner *aead_stream_reader // Segmented stream
+}
+
+func (r *zlib_stream_reader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+
+	if err == io.EOF {
+		// Make sure the stream ends here, and it was not truncated
+		extra, err := io.Copy(io.Discard, r.inner)
+
+		if err != nil {
+			return n, err
+		}
+
+		if extra > 0 {
+			return n, ErrInvalidData
+		}
+
+		return n, io.EOF
+	}
+
+	if err != nil && !errors.Is(err, ErrAuthenticationFailed) && !errors.Is(err, ErrTruncatedData) && !errors.Is(err, ErrSizeLimitExceeded) {
+		// Compressed data is corrupted
+		return n, invalid_data_error(err)
+	}
+
+	return n, err
+}
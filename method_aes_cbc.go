@@ -0,0 +1,416 @@
+// AES-256-CBC encryption methods
+
+package encrypted_storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// AES-256-CBC method, without authentication
+// Header: Pre-encryption size (size_bytes bytes) + IV (16 bytes)
+type aes_cbc_method struct {
+	id          FileEncryptionMethod  // Method ID
+	compression compression_algorithm // Compression algorithm applied before encrypting the data
+	size_bytes  int                   // Size of the pre-encryption size field (4 or 8 bytes)
+}
+
+func (m *aes_cbc_method) ID() FileEncryptionMethod {
+	return m.id
+}
+
+func (m *aes_cbc_method) HeaderSize() int {
+	return m.size_bytes + aes.BlockSize
+}
+
+func (m *aes_cbc_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithLevel(data, key, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *aes_cbc_method) EncryptWithLevel(data []byte, key []byte, level int) ([]byte, []byte, error) {
+	result, err := m.encrypt_append(nil, data, key, nil, level, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result[:m.HeaderSize()], result[m.HeaderSize():], nil
+}
+
+func (m *aes_cbc_method) encrypt_append(dst []byte, data []byte, key []byte, ad []byte, level int, cache *cipher_cache) ([]byte, error) {
+	if len(ad) > 0 {
+		return nil, ErrUnsupported
+	}
+
+	final_data := data
+
+	if m.compression != compression_none {
+		// Compress the data
+		buf := get_buffer()
+		defer put_buffer(buf)
+
+		compressed, err := compress_data_append(*buf, m.compression, data, level)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*buf = compressed
+		final_data = compressed
+	}
+
+	block, err := cache.get_aes_block(key)
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	// Header: pre-encryption size and IV
+	start := len(dst)
+	dst = append(dst, make([]byte, m.HeaderSize())...)
+
+	err = put_size_field(dst[start:start+m.size_bytes], len(final_data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rand.Read(dst[start+m.size_bytes:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Pad the data, and encrypt it in place
+	body_start := len(dst)
+	dst = append(dst, final_data...)
+	dst = append_padding(dst, len(final_data), aes.BlockSize)
+
+	mode := cipher.NewCBCEncrypter(block, dst[start+m.size_bytes:body_start])
+	mode.CryptBlocks(dst[body_start:], dst[body_start:])
+
+	return dst, nil
+}
+
+func (m *aes_cbc_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptLimited(header, body, key, 0)
+}
+
+func (m *aes_cbc_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.decrypt_append(nil, header, body, key, nil, max_size, nil)
+}
+
+func (m *aes_cbc_method) decrypt_append(dst []byte, header []byte, body []byte, key []byte, ad []byte, max_size int64, cache *cipher_cache) ([]byte, error) {
+	if len(ad) > 0 {
+		return nil, ErrUnsupported
+	}
+
+	if len(body) == 0 {
+		return nil, ErrTruncatedData
+	}
+
+	if len(body)%aes.BlockSize != 0 {
+		return nil, ErrInvalidData
+	}
+
+	// Read params
+	pre_encoded_data_length, ok := read_size_field(header[:m.size_bytes], len(body))
+	iv := header[m.size_bytes:]
+
+	if !ok {
+		return nil, ErrInvalidData
+	}
+
+	if m.compression == compression_none && max_size > 0 && int64(pre_encoded_data_length) > max_size {
+		return nil, &SizeLimitError{Limit: max_size}
+	}
+
+	block, err := cache.get_aes_block(key)
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+
+	if m.compression == compression_none {
+		// Decrypt in place, and remove padding
+		start := len(dst)
+		dst = append(dst, body...)
+		mode.CryptBlocks(dst[start:], dst[start:])
+
+		return dst[:start+pre_encoded_data_length], nil
+	}
+
+	buf := get_buffer()
+	defer put_buffer(buf)
+
+	// Decrypt in place, and remove padding
+	*buf = append(*buf, body...)
+	mode.CryptBlocks(*buf, *buf)
+
+	plaintext := (*buf)[:pre_encoded_data_length]
+
+	// Decompress the data
+	return decompress_data_append(dst, m.compression, plaintext, max_size)
+}
+
+// AES-256-CBC method, authenticated with HMAC-SHA256 (Encrypt-then-MAC)
+// Header: Pre-encryption size (4 bytes) + IV (16 bytes) + MAC (32 bytes)
+type aes_cbc_hmac_method struct {
+	id          FileEncryptionMethod  // Method ID
+	compression compression_algorithm // Compression algorithm applied before encrypting the data
+}
+
+func (m *aes_cbc_hmac_method) ID() FileEncryptionMethod {
+	return m.id
+}
+
+func (m *aes_cbc_hmac_method) HeaderSize() int {
+	return 52
+}
+
+func (m *aes_cbc_hmac_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithLevel(data, key, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *aes_cbc_hmac_method) EncryptWithLevel(data []byte, key []byte, level int) ([]byte, []byte, error) {
+	return m.EncryptWithAD(data, key, nil, level)
+}
+
+func (m *aes_cbc_hmac_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	// Compress the data
+	final_data, err := compress_data(m.compression, data, level)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Header: pre-encryption size, IV and MAC
+	header := make([]byte, 52)
+	err = put_size_field(header[:4], len(final_data))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Encrypt
+	iv, cipher_text, err := encrypt_aes_cbc(final_data, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copy(header[4:20], iv)
+
+	// Compute the MAC over method ID, size, IV, associated data and cipher text
+	mac := compute_cbc_hmac(key, m.id, header[:20], cipher_text, ad)
+	copy(header[20:52], mac)
+
+	return header, cipher_text, nil
+}
+
+func (m *aes_cbc_hmac_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptLimited(header, body, key, 0)
+}
+
+func (m *aes_cbc_hmac_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *aes_cbc_hmac_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	if len(body) < aes.BlockSize {
+		return nil, ErrTruncatedData
+	}
+
+	// Read params
+	size_and_iv := header[:20]
+	mac := header[20:52]
+
+	// Verify the MAC before touching the cipher text
+	expected_mac := compute_cbc_hmac(key, m.id, size_and_iv, body, ad)
+
+	if !hmac.Equal(mac, expected_mac) {
+		return nil, ErrAuthenticationFailed
+	}
+
+	if len(body)%aes.BlockSize != 0 {
+		return nil, ErrInvalidData
+	}
+
+	pre_encoded_data_length := int(binary.BigEndian.Uint32(size_and_iv[:4]))
+
+	// Padding is always between 1 and a full block
+	if pre_encoded_data_length >= len(body) || pre_encoded_data_length < len(body)-aes.BlockSize {
+		return nil, ErrInvalidData
+	}
+
+	if m.compression == compression_none && max_size > 0 && int64(pre_encoded_data_length) > max_size {
+		return nil, &SizeLimitError{Limit: max_size}
+	}
+
+	// Decrypt
+	plaintext, err := decrypt_aes_cbc(body, key, size_and_iv[4:20])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove padding
+	plaintext = plaintext[:pre_encoded_data_length]
+
+	// Decompress the data
+	return decompress_data(m.compression, plaintext, max_size)
+}
+
+// Stores the pre-encryption size into a header field
+// field - Header field (4 or 8 bytes)
+// size - Size to store
+// Returns an error if the size does not fit in the field
+func put_size_field(field []byte, size int) error {
+	if len(field) == 8 {
+		binary.BigEndian.PutUint64(field, uint64(size))
+		return nil
+	}
+
+	if uint64(size) > math.MaxUint32 {
+		return ErrDataTooLarge
+	}
+
+	binary.BigEndian.PutUint32(field, uint32(size))
+
+	return nil
+}
+
+// Reads the pre-encryption size from a header field
+// field - Header field (4 or 8 bytes)
+// max_size - Max valid size
+// Returns the size, and true if it was valid
+func read_size_field(field []byte, max_size int) (int, bool) {
+	var size uint64
+
+	if len(field) == 8 {
+		size = binary.BigEndian.Uint64(field)
+	} else {
+		size = uint64(binary.BigEndian.Uint32(field))
+	}
+
+	if size > uint64(max_size) {
+		return 0, false
+	}
+
+	return int(size), true
+}
+
+// Pads and encrypts data using AES-256-CBC with a random IV
+// data - Data to encrypt
+// key - Encryption key
+// Returns the IV and the cipher text
+func encrypt_aes_cbc(data []byte, key []byte) (iv []byte, cipher_text []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, invalid_key_error(err)
+	}
+
+	// Pad data
+	final_data := add_padding(data, aes.BlockSize)
+
+	// Generate IV
+	iv = make([]byte, aes.BlockSize)
+	_, err = rand.Read(iv)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipher_text = make([]byte, len(final_data))
+	mode := cipher.NewCBCEncrypter(block, iv)
+	mode.CryptBlocks(cipher_text, final_data)
+
+	return iv, cipher_text, nil
+}
+
+// Decrypts data using AES-256-CBC, without removing the padding
+// cipher_text - Cipher text. Its length must be a multiple of the block size
+// key - Decryption key
+// iv - Initialization vector
+// Returns the padded plaintext
+func decrypt_aes_cbc(cipher_text []byte, key []byte, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+	plaintext := make([]byte, len(cipher_text))
+	mode.CryptBlocks(plaintext, cipher_text)
+
+	return plaintext, nil
+}
+
+// Computes the HMAC-SHA256 for the CBC+HMAC methods
+// The MAC key is derived from the encryption key, so the same key is never used for both purposes
+// If there is associated data, a different MAC key is derived, and the associated data is included, prefixed by its length
+// key - Encryption key
+// method - Method ID
+// header - Size and IV fields of the header
+// cipher_text - Cipher text
+// ad - Associated data (may be empty)
+// Returns the MAC (32 bytes)
+func compute_cbc_hmac(key []byte, method FileEncryptionMethod, header []byte, cipher_text []byte, ad []byte) []byte {
+	key_mac := hmac.New(sha256.New, key)
+
+	if len(ad) > 0 {
+		key_mac.Write([]byte("encrypted-storage cbc-hmac-sha256 mac key with associated data"))
+	} else {
+		key_mac.Write([]byte("encrypted-storage cbc-hmac-sha256 mac key"))
+	}
+
+	mac_key := key_mac.Sum(nil)
+
+	method_bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(method_bytes, uint16(method))
+
+	mac := hmac.New(sha256.New, mac_key)
+	mac.Write(method_bytes)
+	mac.Write(header)
+
+	if len(ad) > 0 {
+		ad_length := make([]byte, 8)
+		binary.BigEndian.PutUint64(ad_length, uint64(len(ad)))
+
+		mac.Write(ad_length)
+		mac.Write(ad)
+	}
+
+	mac.Write(cipher_text)
+
+	return mac.Sum(nil)
+}
+
+// Add padding to the data, so a block cipher can encrypt it
+// The data is copied, so the caller's slice is never modified
+// cipher_text - data to pad
+// blockSize - Size of the blocks to encrypt
+// Returns the padded data
+func add_padding(cipher_text []byte, blockSize int) []byte {
+	return append_padding(append(make([]byte, 0, len(cipher_text)+blockSize), cipher_text...), len(cipher_text), blockSize)
+}
+
+// Appends the padding for data of a given length
+// dst - Buffer ending with the data to pad
+// data_length - Length of the data
+// blockSize - Size of the blocks to encrypt
+// Returns the buffer with the padding appended
+func append_padding(dst []byte, data_length int, blockSize int) []byte {
+	padding := (blockSize - data_length%blockSize)
+
+	for i := 0; i < padding; i++ {
+		dst = append(dst, byte(padding))
+	}
+
+	return dst
+}
@@ -0,0 +1,289 @@
+// Deterministic encryption method (AES-SIV, RFC 5297)
+// The IV is derived from the key, the associated data and the plaintext,
+// so the same data encrypted with the same key always produces the same cipher text.
+
+package encrypted_storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	AES_SIV_IV_SIZE = 16 // Size of the synthetic IV, in bytes
+)
+
+// AES-SIV method
+// Header: Synthetic IV (16 bytes)
+// Body: Cipher text (same size as the plaintext)
+// The method ID (and the associated data, if any) is authenticated as an associated data component.
+// The 64-byte AES-SIV key (AES-256 for both S2V and CTR) is derived from the key with HKDF-SHA256.
+type aes_siv_method struct {
+	id          FileEncryptionMethod  // Method ID
+	compression compression_algorithm // Compression algorithm applied before encrypting the data
+}
+
+func (m *aes_siv_method) ID() FileEncryptionMethod {
+	return m.id
+}
+
+func (m *aes_siv_method) HeaderSize() int {
+	return AES_SIV_IV_SIZE
+}
+
+func (m *aes_siv_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithLevel(data, key, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *aes_siv_method) EncryptWithLevel(data []byte, key []byte, level int) ([]byte, []byte, error) {
+	return m.EncryptWithAD(data, key, nil, level)
+}
+
+func (m *aes_siv_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	// Compress the data
+	final_data, err := compress_data(m.compression, data, level)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	siv_key, err := derive_aes_siv_key(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv, cipher_text, err := aes_siv_seal(siv_key, final_data, m.additional_data(ad))
+
+	if err != nil {
+		return nil, nil, invalid_key_error(err)
+	}
+
+	return iv, cipher_text, nil
+}
+
+func (m *aes_siv_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptLimited(header, body, key, 0)
+}
+
+func (m *aes_siv_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *aes_siv_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	if m.compression == compression_none && max_size > 0 && int64(len(body)) > max_size {
+		return nil, &SizeLimitError{Limit: max_size}
+	}
+
+	siv_key, err := derive_aes_siv_key(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aes_siv_open(siv_key, header, body, m.additional_data(ad))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress the data
+	return decompress_data(m.compression, plaintext, max_size)
+}
+
+// Returns the additional data to authenticate (the method ID, followed by the associated data)
+// ad - Associated data
+func (m *aes_siv_method) additional_data(ad []byte) []byte {
+	result := make([]byte, 2+len(ad))
+	binary.BigEndian.PutUint16(result, uint16(m.id))
+	copy(result[2:], ad)
+	return result
+}
+
+// Derives the AES-SIV key (64 bytes) from a key
+// key - Encryption key (16, 24 or 32 bytes)
+func derive_aes_siv_key(key []byte) ([]byte, error) {
+	if !is_valid_key_size(len(key)) {
+		return nil, ErrInvalidKey
+	}
+
+	siv_key := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("encrypted-storage aes-siv key")), siv_key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return siv_key, nil
+}
+
+// Encrypts with AES-SIV (RFC 5297)
+// key - AES-SIV key (32, 48 or 64 bytes). The first half is used for S2V, the second half for CTR
+// plaintext - Data to encrypt
+// ad - Associated data components
+// Returns the synthetic IV and the cipher text
+func aes_siv_seal(key []byte, plaintext []byte, ad ...[]byte) ([]byte, []byte, error) {
+	mac_block, ctr_block, err := new_aes_siv_ciphers(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := aes_siv_s2v(mac_block, append(append([][]byte{}, ad...), plaintext))
+
+	cipher_text := make([]byte, len(plaintext))
+	aes_siv_ctr(ctr_block, iv).XORKeyStream(cipher_text, plaintext)
+
+	return iv, cipher_text, nil
+}
+
+// Decrypts with AES-SIV (RFC 5297)
+// key - AES-SIV key (32, 48 or 64 bytes)
+// iv - Synthetic IV
+// cipher_text - Cipher text
+// ad - Associated data components
+// Returns the plaintext, or ErrAuthenticationFailed
+func aes_siv_open(key []byte, iv []byte, cipher_text []byte, ad ...[]byte) ([]byte, error) {
+	if len(iv) != AES_SIV_IV_SIZE {
+		return nil, ErrTruncatedData
+	}
+
+	mac_block, ctr_block, err := new_aes_siv_ciphers(key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	plaintext := make([]byte, len(cipher_text))
+	aes_siv_ctr(ctr_block, iv).XORKeyStream(plaintext, cipher_text)
+
+	expected_iv := aes_siv_s2v(mac_block, append(append([][]byte{}, ad...), plaintext))
+
+	if subtle.ConstantTimeCompare(iv, expected_iv) != 1 {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
+// Creates the block ciphers for S2V and CTR
+// key - AES-SIV key
+func new_aes_siv_ciphers(key []byte) (cipher.Block, cipher.Block, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, nil, aes.KeySizeError(len(key))
+	}
+
+	mac_block, err := aes.NewCipher(key[:len(key)/2])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctr_block, err := aes.NewCipher(key[len(key)/2:])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mac_block, ctr_block, nil
+}
+
+// Creates the CTR stream, using the synthetic IV with the bits 31 and 63 cleared as initial counter
+// block - Block cipher
+// iv - Synthetic IV
+func aes_siv_ctr(block cipher.Block, iv []byte) cipher.Stream {
+	counter := make([]byte, AES_SIV_IV_SIZE)
+	copy(counter, iv)
+
+	counter[8] &= 0x7f
+	counter[12] &= 0x7f
+
+	return cipher.NewCTR(block, counter)
+}
+
+// S2V: Computes the synthetic IV of a vector of strings
+// block - Block cipher for CMAC
+// strings - Strings (associated data components, followed by the plaintext)
+func aes_siv_s2v(block cipher.Block, strings [][]byte) []byte {
+	d := aes_cmac(block, make([]byte, aes.BlockSize))
+
+	for _, s := range strings[:len(strings)-1] {
+		d = aes_cmac_dbl(d)
+		subtle.XORBytes(d, d, aes_cmac(block, s))
+	}
+
+	last := strings[len(strings)-1]
+
+	var t []byte
+
+	if len(last) >= aes.BlockSize {
+		// XOR the last 16 bytes with D
+		t = make([]byte, len(last))
+		copy(t, last)
+		subtle.XORBytes(t[len(t)-aes.BlockSize:], t[len(t)-aes.BlockSize:], d)
+	} else {
+		// Pad and XOR with dbl(D)
+		t = aes_cmac_dbl(d)
+		subtle.XORBytes(t[:len(last)], t[:len(last)], last)
+		t[len(last)] ^= 0x80
+	}
+
+	return aes_cmac(block, t)
+}
+
+// Computes AES-CMAC (RFC 4493)
+// block - Block cipher
+// data - Data
+func aes_cmac(block cipher.Block, data []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = aes_cmac_dbl(k1)
+
+	mac := make([]byte, aes.BlockSize)
+
+	// Every block except the last one
+	for len(data) > aes.BlockSize {
+		subtle.XORBytes(mac, mac, data[:aes.BlockSize])
+		block.Encrypt(mac, mac)
+		data = data[aes.BlockSize:]
+	}
+
+	last := make([]byte, aes.BlockSize)
+	copy(last, data)
+
+	if len(data) == aes.BlockSize {
+		subtle.XORBytes(last, last, k1)
+	} else {
+		// Incomplete block: pad it, and use the second subkey
+		last[len(data)] = 0x80
+		subtle.XORBytes(last, last, aes_cmac_dbl(k1))
+	}
+
+	subtle.XORBytes(mac, mac, last)
+	block.Encrypt(mac, mac)
+
+	return mac
+}
+
+// Doubles a value in GF(2^128)
+// b - Value (16 bytes)
+// Returns the result, in a new slice
+func aes_cmac_dbl(b []byte) []byte {
+	result := make([]byte, aes.BlockSize)
+
+	carry := b[0] >> 7
+
+	for i := 0; i < aes.BlockSize-1; i++ {
+		result[i] = b[i]<<1 | b[i+1]>>7
+	}
+
+	result[aes.BlockSize-1] = b[aes.BlockSize-1]<<1 ^ (0x87 * carry)
+
+	return result
+}
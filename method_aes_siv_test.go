@@ -0,0 +1,203 @@
+// Deterministic encryption method (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func test_hex(s string) []byte {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestAESCMAC(t *testing.T) {
+	// RFC 4493, section 4
+	block, err := aes.NewCipher(test_hex("2b7e151628aed2a6abf7158809cf4f3c"))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vectors := []struct {
+		message string
+		mac     string
+	}{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411", "dfa66747de9ae63030ca32611497c827"},
+	}
+
+	for i, v := range vectors {
+		mac := aes_cmac(block, test_hex(v.message))
+
+		if !bytes.Equal(mac, test_hex(v.mac)) {
+			t.Errorf("Vector %d: Expected (%s), but got (%x)", i, v.mac, mac)
+		}
+	}
+}
+
+func TestAESSIVVectors(t *testing.T) {
+	// RFC 5297, appendix A.1 (deterministic authenticated encryption)
+	key := test_hex("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad := test_hex("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := test_hex("112233445566778899aabbccddee")
+	expected := test_hex("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+
+	iv, cipher_text, err := aes_siv_seal(key, plaintext, ad)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(append(iv, cipher_text...), expected) {
+		t.Errorf("A.1: Expected (%x), but got (%x%x)", expected, iv, cipher_text)
+	}
+
+	decrypted, err := aes_siv_open(key, expected[:AES_SIV_IV_SIZE], expected[AES_SIV_IV_SIZE:], ad)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("A.1: Decrypted data does not match the plaintext")
+	}
+
+	// RFC 5297, appendix A.2 (nonce-based authenticated encryption)
+	key = test_hex("7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f")
+	ad1 := test_hex("00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100")
+	ad2 := test_hex("102030405060708090a0")
+	nonce := test_hex("09f911029d74e35bd84156c5635688c0")
+	plaintext = test_hex("7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553")
+	expected = test_hex("7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d")
+
+	iv, cipher_text, err = aes_siv_seal(key, plaintext, ad1, ad2, nonce)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(append(iv, cipher_text...), expected) {
+		t.Errorf("A.2: Expected (%x), but got (%x%x)", expected, iv, cipher_text)
+	}
+}
+
+func TestFileEncryptionDeterministic(t *testing.T) {
+	key := test_random_key()
+	original := bytes.Repeat([]byte("Deterministic encryption for deduplication. "), 20)
+
+	for _, method := range []FileEncryptionMethod{AES256_SIV, AES256_SIV_ZIP} {
+		encrypted, err := EncryptFileContents(original, method, key)
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		encrypted_2, err := EncryptFileContents(original, method, key)
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		if !bytes.Equal(encrypted, encrypted_2) {
+			t.Errorf("Method %d: Expected the same cipher text for the same data", method)
+		}
+
+		// Different associated data or key produce a different cipher text
+
+		encrypted_ad, err := EncryptFileContentsWithAD(original, method, key, []byte("context"))
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		if bytes.Equal(encrypted, encrypted_ad) {
+			t.Errorf("Method %d: Expected a different cipher text with associated data", method)
+		}
+
+		encrypted_other_key, err := EncryptFileContents(original, method, test_random_key())
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		if bytes.Equal(encrypted, encrypted_other_key) {
+			t.Errorf("Method %d: Expected a different cipher text with another key", method)
+		}
+
+		decrypted, err := DecryptFileContents(encrypted, key)
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if !bytes.Equal(decrypted, original) {
+			t.Errorf("Method %d: Decrypted data does not match the original data", method)
+		}
+
+		decrypted, err = DecryptFileContentsWithAD(encrypted_ad, key, []byte("context"))
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if !bytes.Equal(decrypted, original) {
+			t.Errorf("Method %d: Decrypted data does not match the original data (associated data)", method)
+		}
+
+		// Tampering
+
+		modified := bytes.Clone(encrypted)
+		modified[len(modified)-1] ^= 0x01
+
+		_, err = DecryptFileContents(modified, key)
+
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed, but got (%v)", method, err)
+		}
+
+		_, err = DecryptFileContentsWithAD(encrypted_ad, key, []byte("other"))
+
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed with other associated data, but got (%v)", method, err)
+		}
+	}
+
+	// Keys of 16 and 24 bytes are accepted, like for the other methods
+
+	for _, size := range []int{16, 24} {
+		short_key := test_random_key()[:size]
+
+		encrypted, err := EncryptFileContents(original, AES256_SIV, short_key)
+
+		if err != nil {
+			t.Errorf("Key size %d: %v", size, err)
+			continue
+		}
+
+		decrypted, err := DecryptFileContents(encrypted, short_key)
+
+		if err != nil {
+			t.Errorf("Key size %d: %v", size, err)
+		} else if !bytes.Equal(decrypted, original) {
+			t.Errorf("Key size %d: Decrypted data does not match the original data", size)
+		}
+	}
+
+	_, err := EncryptFileContents(original, AES256_SIV, make([]byte, 20))
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a key of 20 bytes, but got (%v)", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Key ID wrapper method
+
+package encrypted_storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	KEY_ID_SIZE = 8 // Size of the key identifiers, in bytes
+
+	key_id_default_method = AES256_GCM // Method used by the wrapper when it is directly used to encrypt
+)
+
+// Identifier of a key: a fingerprint of the key, so it does not need to be stored
+type KeyID [KEY_ID_SIZE]byte
+
+// Returns the key ID as an hexadecimal string
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Computes the identifier of a key
+// The identifier is derived with HMAC-SHA256, so it does not reveal anything about the key
+// key - The key
+// Returns the key ID
+func ComputeKeyID(key []byte) KeyID {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("encrypted-storage key id"))
+
+	var id KeyID
+	copy(id[:], mac.Sum(nil))
+
+	return id
+}
+
+// Key ID wrapper method
+// Header: Key ID (8 bytes)
+// Body: Cipher text of another method (method ID + header + body)
+// Allows to find the key to decrypt the data (see Keyring), and to detect a wrong key before decrypting
+type key_id_method struct{}
+
+func (m *key_id_method) ID() FileEncryptionMethod {
+	return KEY_ID_WRAPPER
+}
+
+func (m *key_id_method) HeaderSize() int {
+	return KEY_ID_SIZE
+}
+
+func (m *key_id_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return m.EncryptWithAD(data, key, nil, COMPRESSION_LEVEL_DEFAULT)
+}
+
+func (m *key_id_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	id := ComputeKeyID(key)
+
+	body, err := EncryptFileContentsWithOptions(data, key_id_default_method, key, EncryptOptions{CompressionLevel: level, AssociatedData: ad})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return id[:], body, nil
+}
+
+func (m *key_id_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, 0)
+}
+
+func (m *key_id_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *key_id_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	id := ComputeKeyID(key)
+
+	if !hmac.Equal(id[:], header) {
+		return nil, invalid_key_error(fmt.Errorf("the data was encrypted with the key %x", header))
+	}
+
+	if len(body) >= 2 && FileEncryptionMethod(binary.BigEndian.Uint16(body[:2])) == KEY_ID_WRAPPER {
+		// Do not allow nested wrappers
+		return nil, ErrInvalidData
+	}
+
+	return DecryptFileContentsWithOptions(body, key, DecryptOptions{MaxPlaintextSize: max_size, AssociatedData: ad})
+}
+
+// Encrypts data with a method, wrapping it with the key ID
+// dst - Buffer to append the cipher text
+// data - Data to encrypt
+// method - Method to use
+// key - Encryption key
+// id - Key ID
+// options - Encryption options
+// cache - Cache of cipher instances (may be nil)
+// Returns the buffer with the cipher text appended
+func encrypt_with_key_id(dst []byte, data []byte, method FileEncryptionMethod, key []byte, id KeyID, options EncryptOptions, cache *cipher_cache) ([]byte, error) {
+	if method == KEY_ID_WRAPPER {
+		return nil, ErrInvalidMethod
+	}
+
+	if len(data) == 0 && len(options.AssociatedData) == 0 {
+		// Empty data
+		return dst, nil
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(KEY_ID_WRAPPER))
+	dst = append(dst, id[:]...)
+
+	return encrypt_file_contents(dst, data, method, key, options, cache)
+}
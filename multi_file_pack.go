@@ -8,25 +8,76 @@
 //      - File length (Long unsigned big endian) (8 bytes)
 //  - Body: Files data, consistent with the files table
 
+// Encrypted file structure (version 2)
+//  - Header (32 bytes):
+//      - Magic (0xFF 'E' 'M' 'P') (4 bytes). Since the first byte is 0xFF, it is never a valid number of files of the first format.
+//      - Version (2) (1 byte)
+//      - Flags (reserved, 0) (1 byte)
+//      - Extensions length (Short unsigned big endian) (2 bytes)
+//      - Number of files (Long unsigned big endian) (8 bytes)
+//      - Pack ID (random) (16 bytes)
+//  - Extensions (reserved, skipped when reading)
+//  - Files table (same as the first format)
+//  - Body: Files data, each file encrypted with an authenticated method, using the header (32 bytes)
+//    and the file index (Long unsigned big endian) as associated data,
+//    so files cannot be modified, reordered or copied from another pack.
+
 package encrypted_storage
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
-	"errors"
+	"io"
 	"io/fs"
 	"os"
 )
 
+const (
+	MULTI_FILE_PACK_HEADER_SIZE           = 8  // Size of the header of the packs, in bytes
+	MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE = 32 // Size of the fixed header of the encrypted packs, in bytes
+
+	multi_file_pack_encrypted_version = 2              // Version of the encrypted format
+	multi_file_pack_encrypted_method  = AES256_GCM_ZIP // Method used for the files of the encrypted format
+)
+
+// Magic number of the encrypted packs
+var multi_file_pack_encrypted_magic = []byte{0xFF, 'E', 'M', 'P'}
+
+// Options for packs
+type MultiFilePackOptions struct {
+	// Encryption key. If set, the encrypted format (version 2) is used: files are encrypted with AES256_GCM_ZIP
+	// and bound to the pack and their position, so they cannot be modified, reordered or copied from another pack.
+	Key []byte
+
+	// Keyring. If set, the encrypted format is used with the active key instead of Key, and every file contains the ID of the key (see KEY_ID_WRAPPER).
+	// Read the pack with CreateMultiFilePackReadStreamWithKeyring.
+	Keyring *Keyring
+}
+
 //////////////////////////
 //     WRITE STREAM    //
 /////////////////////////
 
 // Write stream data
 type MultiFilePackWriteStream struct {
-	f                   *os.File // File descriptor
-	file_count          int64    // Number of files contained in the file
-	current_write_index int64    // Index of the current file being written
-	current_write_pt    int64    // Position of the cursor to write the next file
+	w                   io.WriterAt      // Destination
+	f                   *io.OffsetWriter // Destination, with a cursor
+	closer              io.Closer        // File closed with the stream (nil if it was provided by the caller)
+	file_count          int64            // Number of files contained in the file
+	current_write_index int64            // Index of the current file being written
+	current_write_pt    int64            // Position of the cursor to write the next file
+
+	key         []byte     // Encryption key (nil for the non-encrypted format)
+	key_id      *KeyID     // ID of the key, if it was taken from a keyring
+	secret_key  *SecretKey // Secret key the key was taken from, checked before every file (nil if not used)
+	header_size int64      // Size of the header (including extensions), in bytes
+	ad_header   []byte     // Header used as associated data for the files (nil for the non-encrypted format)
+
+	cache     cipher_cache // Cipher instances reused for every file
+	enc_buf   []byte       // Buffer reused to encrypt the files
+	ad_buf    []byte       // Buffer reused for the associated data of the files
+	entry_buf [8]byte      // Buffer reused to write the entries of the files table
 }
 
 // Creates stream to write multiple files in a packed file
@@ -39,43 +90,164 @@ func CreateMultiFilePackWriteStream(file string, perm fs.FileMode) (*MultiFilePa
 		return nil, err
 	}
 
+	i := NewMultiFilePackWriteStream(f)
+	i.closer = f
+
+	return i, nil
+}
+
+// Creates stream to write multiple files into an already open file, a buffer, or a file of a storage backend
+// The data is written from the start. If the destination has a Truncate method, it is truncated on Initialize.
+// It is not closed with the stream
+// w - Destination
+func NewMultiFilePackWriteStream(w io.WriterAt) *MultiFilePackWriteStream {
 	i := MultiFilePackWriteStream{
-		f:                   f,
+		w:                   w,
+		f:                   io.NewOffsetWriter(w, 0),
 		file_count:          0,
 		current_write_index: 0,
 	}
 
-	return &i, nil
+	return &i
+}
+
+// Creates stream to write multiple files, creating the file in a storage backend. The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+func OpenMultiFilePackWriteStream(backend Backend, name string) (*MultiFilePackWriteStream, error) {
+	f, err := backend.Create(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := NewMultiFilePackWriteStream(f)
+	i.closer = f
+
+	return i, nil
 }
 
 // Initializes write stream (must be called before writing any files)
 // file_count - Number of files to write
 func (file *MultiFilePackWriteStream) Initialize(file_count int64) error {
-	file.file_count = file_count
+	return file.InitializeWithOptions(file_count, MultiFilePackOptions{})
+}
+
+// Initializes write stream, encrypted with a secret key (must be called before writing any files)
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, writing fails with ErrInvalidKey.
+// file_count - Number of files to write
+// key - Secret key. Ignored if options.Keyring is set
+// options - Options (options.Key is ignored)
+func (file *MultiFilePackWriteStream) InitializeWithSecretKey(file_count int64, key *SecretKey, options MultiFilePackOptions) error {
+	if key == nil {
+		return ErrInvalidKey
+	}
+
+	key_bytes, err := key.acquire()
 
-	// Set the size of the file
-	err := file.f.Truncate(8 + (16)*file_count)
 	if err != nil {
 		return err
 	}
 
-	// Rewind to the start of the file
-	_, err = file.f.Seek(0, 0)
+	defer key.release()
+
+	options.Key = key_bytes
+
+	err = file.InitializeWithOptions(file_count, options)
 
 	if err != nil {
 		return err
 	}
 
-	// Write size
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, uint64(file_count))
+	if file.key_id == nil {
+		// The files are encrypted with the secret key
+		file.secret_key = key
+	}
+
+	return nil
+}
+
+// Initializes write stream, with options (must be called before writing any files)
+// file_count - Number of files to write
+// options - Options
+func (file *MultiFilePackWriteStream) InitializeWithOptions(file_count int64, options MultiFilePackOptions) error {
+	if file_count < 0 {
+		return ErrInvalidArgument
+	}
+
+	file.file_count = file_count
+	file.key_id = nil
+	file.secret_key = nil
+
+	if options.Keyring != nil {
+		id, active_key, err := options.Keyring.active_key()
+
+		if err != nil {
+			return err
+		}
+
+		options.Key = active_key
+		file.key_id = &id
+	}
+
+	if options.Key != nil && !is_valid_key_size(len(options.Key)) {
+		return ErrInvalidKey
+	}
+
+	// Build the header
+
+	var header []byte
+
+	if options.Key != nil {
+		header = make([]byte, MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE)
+
+		copy(header[0:4], multi_file_pack_encrypted_magic)
+		header[4] = multi_file_pack_encrypted_version
+		header[5] = 0                              // Flags
+		binary.BigEndian.PutUint16(header[6:8], 0) // Extensions length
+		binary.BigEndian.PutUint64(header[8:16], uint64(file_count))
+
+		// Random pack ID
+		_, err := rand.Read(header[16:32])
+
+		if err != nil {
+			return err
+		}
+
+		file.key = options.Key
+		file.ad_header = header
+	} else {
+		header = make([]byte, MULTI_FILE_PACK_HEADER_SIZE)
+		binary.BigEndian.PutUint64(header, uint64(file_count))
+
+		file.key = nil
+		file.ad_header = nil
+	}
+
+	file.header_size = int64(len(header))
+
+	// Set the size of the file
+	if t, ok := file.w.(truncater); ok {
+		err := t.Truncate(file.header_size + (16)*file_count)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Rewind to the start of the file
+	_, err := file.f.Seek(0, 0)
 
-	_, err = file.f.Write(b)
 	if err != nil {
 		return err
 	}
 
-	binary.BigEndian.PutUint64(b, 0)
+	// Write header
+	_, err = file.f.Write(header)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 8)
 
 	// Write default values for each file
 
@@ -92,36 +264,74 @@ func (file *MultiFilePackWriteStream) Initialize(file_count int64) error {
 	}
 
 	file.current_write_index = 0
-	file.current_write_pt = 8 + (16)*file_count
+	file.current_write_pt = file.header_size + (16)*file_count
 
 	return nil
 }
 
 // Writes a file into the packed file
+// If the pack is encrypted, the content is encrypted before writing it
 // content - Content of the file
 // Calling this increases the current file index
 func (file *MultiFilePackWriteStream) PutFile(content []byte) error {
+	if file.current_write_index >= file.file_count {
+		return ErrFileCountExceeded
+	}
+
+	if file.ad_header != nil {
+		if file.secret_key != nil {
+			// Prevent the key from being destroyed while the file is encrypted
+			_, err := file.secret_key.acquire()
+
+			if err != nil {
+				return &PackFileError{FileIndex: file.current_write_index, Offset: file.current_write_pt, Err: err}
+			}
+
+			defer file.secret_key.release()
+		}
+
+		file.ad_buf = append_indexed_associated_data(file.ad_buf[:0], file.ad_header, file.current_write_index)
+		options := EncryptOptions{AssociatedData: file.ad_buf}
+
+		var encrypted []byte
+		var err error
+
+		if file.key_id != nil {
+			encrypted, err = encrypt_with_key_id(file.enc_buf[:0], content, multi_file_pack_encrypted_method, file.key, *file.key_id, options, &file.cache)
+		} else {
+			encrypted, err = encrypt_file_contents(file.enc_buf[:0], content, multi_file_pack_encrypted_method, file.key, options, &file.cache)
+		}
+
+		if err != nil {
+			return &PackFileError{FileIndex: file.current_write_index, Offset: file.current_write_pt, Err: err}
+		}
+
+		file.enc_buf = encrypted
+		content = encrypted
+	}
+
 	// Save metadata
-	_, err := file.f.Seek(8+file.current_write_index*16, 0)
+	entry_pt := file.header_size + file.current_write_index*16
+	_, err := file.f.Seek(entry_pt, 0)
 
 	if err != nil {
-		return err
+		return &PackFileError{FileIndex: file.current_write_index, Offset: entry_pt, Err: err}
 	}
 
-	b := make([]byte, 8)
+	b := file.entry_buf[:]
 
 	// Write start pointer
 	binary.BigEndian.PutUint64(b, uint64(file.current_write_pt))
 	_, err = file.f.Write(b)
 	if err != nil {
-		return err
+		return &PackFileError{FileIndex: file.current_write_index, Offset: entry_pt, Err: err}
 	}
 
 	// Write length
 	binary.BigEndian.PutUint64(b, uint64(len(content)))
 	_, err = file.f.Write(b)
 	if err != nil {
-		return err
+		return &PackFileError{FileIndex: file.current_write_index, Offset: entry_pt, Err: err}
 	}
 
 	// Write data
@@ -129,12 +339,12 @@ func (file *MultiFilePackWriteStream) PutFile(content []byte) error {
 	_, err = file.f.Seek(file.current_write_pt, 0)
 
 	if err != nil {
-		return err
+		return &PackFileError{FileIndex: file.current_write_index, Offset: file.current_write_pt, Err: err}
 	}
 
 	_, err = file.f.Write(content)
 	if err != nil {
-		return err
+		return &PackFileError{FileIndex: file.current_write_index, Offset: file.current_write_pt, Err: err}
 	}
 
 	file.current_write_index++
@@ -145,7 +355,14 @@ func (file *MultiFilePackWriteStream) PutFile(content []byte) error {
 
 // Closes the stream
 func (file *MultiFilePackWriteStream) Close() error {
-	return file.f.Close()
+	// Drop the references to the key
+	file.key = nil
+	file.key_id = nil
+	file.secret_key = nil
+	file.cache.clear()
+	clear(file.enc_buf)
+
+	return close_storage(file.closer)
 }
 
 //////////////////////////
@@ -154,34 +371,277 @@ func (file *MultiFilePackWriteStream) Close() error {
 
 // Read stream to retrieve files from a packed file
 type MultiFilePackReadStream struct {
-	f          *os.File // File descriptor
-	file_count int64    // Number of files inside the packed file
+	f          *io.SectionReader // Source
+	f_size     int64             // Size of the packed file in bytes
+	closer     io.Closer         // File closed with the stream (nil if it was provided by the caller)
+	file_count int64             // Number of files inside the packed file
+
+	key         []byte     // Decryption key (nil for the non-encrypted format)
+	keyring     *Keyring   // Keyring to find the decryption key of each file (nil to use the key)
+	secret_key  *SecretKey // Secret key the key was taken from, checked before every file (nil if not used)
+	header_size int64      // Size of the header (including extensions), in bytes
+	ad_header   []byte     // Header used as associated data for the files (nil for the non-encrypted format)
+
+	cache     cipher_cache // Cipher instances reused for every file
+	read_buf  []byte       // Buffer reused to read the encrypted files
+	ad_buf    []byte       // Buffer reused for the associated data of the files
+	entry_buf [16]byte     // Buffer reused to read the entries of the files table
 }
 
 // Creates read stream to get files from a packed file
+// For encrypted packs, use CreateMultiFilePackReadStreamWithKey
 // file - path to the file
 // perm - File mode
 func CreateMultiFilePackReadStream(file string, perm fs.FileMode) (*MultiFilePackReadStream, error) {
-	f, err := os.OpenFile(file, os.O_RDONLY, perm)
+	return CreateMultiFilePackReadStreamWithKey(file, nil, perm)
+}
+
+// Creates read stream to get files from an encrypted packed file
+// file - path to the file
+// key - Decryption key. If set, the pack must be encrypted (ErrInvalidData is returned otherwise). If nil, the pack must not be encrypted (ErrInvalidKey is returned otherwise)
+// perm - File mode
+func CreateMultiFilePackReadStreamWithKey(file string, key []byte, perm fs.FileMode) (*MultiFilePackReadStream, error) {
+	return open_multi_file_pack_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithKey(r, size, key)
+	})
+}
+
+// Creates read stream to get files from an encrypted packed file, with a secret key
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// file - path to the file
+// key - Secret key. The pack must be encrypted (ErrInvalidData is returned otherwise)
+// perm - File mode
+func CreateMultiFilePackReadStreamWithSecretKey(file string, key *SecretKey, perm fs.FileMode) (*MultiFilePackReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	return open_multi_file_pack_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithSecretKey(r, size, key)
+	})
+}
+
+// Creates read stream to get files from an encrypted packed file, finding the decryption key of each file in a keyring
+// file - path to the file
+// keyring - Keyring
+// perm - File mode
+func CreateMultiFilePackReadStreamWithKeyring(file string, keyring *Keyring, perm fs.FileMode) (*MultiFilePackReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	return open_multi_file_pack_read_stream_file(storage_file_opener(file, perm), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithKeyring(r, size, keyring)
+	})
+}
+
+// Creates read stream to get files from a packed file, opening a file in a storage backend
+// For encrypted packs, use OpenMultiFilePackReadStreamWithKey
+// The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+func OpenMultiFilePackReadStream(backend Backend, name string) (*MultiFilePackReadStream, error) {
+	return OpenMultiFilePackReadStreamWithKey(backend, name, nil)
+}
+
+// Creates read stream to get files from an encrypted packed file, opening a file in a storage backend
+// The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+// key - Decryption key. If set, the pack must be encrypted (ErrInvalidData is returned otherwise). If nil, the pack must not be encrypted (ErrInvalidKey is returned otherwise)
+func OpenMultiFilePackReadStreamWithKey(backend Backend, name string, key []byte) (*MultiFilePackReadStream, error) {
+	return open_multi_file_pack_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithKey(r, size, key)
+	})
+}
+
+// Creates read stream to get files from an encrypted packed file with a secret key, opening a file in a storage backend
+// The file is closed with the stream.
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// backend - Backend
+// name - Name of the file
+// key - Secret key. The pack must be encrypted (ErrInvalidData is returned otherwise)
+func OpenMultiFilePackReadStreamWithSecretKey(backend Backend, name string, key *SecretKey) (*MultiFilePackReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	return open_multi_file_pack_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithSecretKey(r, size, key)
+	})
+}
+
+// Creates read stream to get files from an encrypted packed file, finding the decryption key of each file in a keyring,
+// opening a file in a storage backend
+// The file is closed with the stream
+// backend - Backend
+// name - Name of the file
+// keyring - Keyring
+func OpenMultiFilePackReadStreamWithKeyring(backend Backend, name string, keyring *Keyring) (*MultiFilePackReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	return open_multi_file_pack_read_stream_file(backend_file_opener(backend, name), func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+		return NewMultiFilePackReadStreamWithKeyring(r, size, keyring)
+	})
+}
+
+// Opens a file, and creates a read stream for it. The file is closed with the stream
+// open - Function to open the file
+// create - Function to create the read stream
+func open_multi_file_pack_read_stream_file(open storage_opener, create func(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error)) (*MultiFilePackReadStream, error) {
+	f, size, err := open()
 
 	if err != nil {
 		return nil, err
 	}
 
-	i := MultiFilePackReadStream{
-		f: f,
+	i, err := create(f, size)
+
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
-	b := make([]byte, 8)
+	i.closer = f
+
+	return i, nil
+}
+
+// Creates read stream to get files from a packed file, reading from an already open file, a buffer, or a file of a storage backend
+// For encrypted packs, use NewMultiFilePackReadStreamWithKey
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+func NewMultiFilePackReadStream(r io.ReaderAt, size int64) (*MultiFilePackReadStream, error) {
+	return NewMultiFilePackReadStreamWithKey(r, size, nil)
+}
+
+// Creates read stream to get files from an encrypted packed file, reading from an already open file, a buffer,
+// or a file of a storage backend
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+// key - Decryption key (see CreateMultiFilePackReadStreamWithKey)
+func NewMultiFilePackReadStreamWithKey(r io.ReaderAt, size int64, key []byte) (*MultiFilePackReadStream, error) {
+	return open_multi_file_pack_read_stream(r, size, key, nil)
+}
 
-	_, err = f.Read(b)
+// Creates read stream to get files from an encrypted packed file with a secret key, reading from an already open file,
+// a buffer, or a file of a storage backend
+// The source is not closed with the stream.
+// The stream keeps a reference to the secret key until it is closed. If the key is destroyed before, reading fails with ErrInvalidKey.
+// r - Source
+// size - Size of the source, in bytes
+// key - Secret key. The pack must be encrypted (ErrInvalidData is returned otherwise)
+func NewMultiFilePackReadStreamWithSecretKey(r io.ReaderAt, size int64, key *SecretKey) (*MultiFilePackReadStream, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	key_bytes, err := key.acquire()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer key.release()
+
+	rs, err := open_multi_file_pack_read_stream(r, size, key_bytes, nil)
 
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
 
-	i.file_count = int64(binary.BigEndian.Uint64(b))
+	rs.secret_key = key
+
+	return rs, nil
+}
+
+// Creates read stream to get files from an encrypted packed file finding the decryption key of each file in a keyring,
+// reading from an already open file, a buffer, or a file of a storage backend
+// The source is not closed with the stream
+// r - Source
+// size - Size of the source, in bytes
+// keyring - Keyring
+func NewMultiFilePackReadStreamWithKeyring(r io.ReaderAt, size int64, keyring *Keyring) (*MultiFilePackReadStream, error) {
+	if keyring == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	return open_multi_file_pack_read_stream(r, size, nil, keyring)
+}
+
+// Opens a read stream
+// r - Source
+// size - Size of the source, in bytes
+// key - Decryption key
+// keyring - Keyring (if set, key is ignored)
+func open_multi_file_pack_read_stream(r io.ReaderAt, size int64, key []byte, keyring *Keyring) (*MultiFilePackReadStream, error) {
+	encrypted := key != nil || keyring != nil
+
+	if keyring == nil && key != nil && !is_valid_key_size(len(key)) {
+		return nil, ErrInvalidKey
+	}
+
+	if size < 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	f := io.NewSectionReader(r, 0, size)
+
+	i := MultiFilePackReadStream{
+		f:      f,
+		f_size: size,
+	}
+
+	header := make([]byte, MULTI_FILE_PACK_HEADER_SIZE)
+
+	_, err := io.ReadFull(f, header)
+
+	if err != nil {
+		return nil, read_full_error(err)
+	}
+
+	if bytes.Equal(header[0:4], multi_file_pack_encrypted_magic) {
+		// Encrypted format
+		if !encrypted {
+			return nil, ErrInvalidKey
+		}
+
+		header = append(header, make([]byte, MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE-MULTI_FILE_PACK_HEADER_SIZE)...)
+
+		_, err = io.ReadFull(f, header[MULTI_FILE_PACK_HEADER_SIZE:])
+
+		if err != nil {
+			return nil, read_full_error(err)
+		}
+
+		if header[4] != multi_file_pack_encrypted_version {
+			return nil, ErrInvalidData
+		}
+
+		extensions_length := int64(binary.BigEndian.Uint16(header[6:8]))
+
+		i.file_count = int64(binary.BigEndian.Uint64(header[8:16]))
+		i.header_size = MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE + extensions_length
+		i.key = key
+		i.keyring = keyring
+		i.ad_header = header
+	} else {
+		if encrypted {
+			// Do not accept non-encrypted packs in place of encrypted ones
+			return nil, ErrInvalidData
+		}
+
+		i.file_count = int64(binary.BigEndian.Uint64(header))
+		i.header_size = MULTI_FILE_PACK_HEADER_SIZE
+	}
+
+	if i.file_count < 0 {
+		return nil, ErrInvalidData
+	}
 
 	return &i, nil
 }
@@ -191,58 +651,129 @@ func (file *MultiFilePackReadStream) FileCount() int64 {
 	return file.file_count
 }
 
+// Returns true if the pack uses the encrypted format
+func (file *MultiFilePackReadStream) Encrypted() bool {
+	return file.ad_header != nil
+}
+
 // Gets a file
 // index - file index
 // Returns the file data
 func (file *MultiFilePackReadStream) GetFile(index int64) ([]byte, error) {
+	return file.GetFileTo(nil, index)
+}
+
+// Gets a file, appending its data to a buffer
+// Reuse the buffer between calls to avoid allocations
+// dst - Buffer to append the file data (may be nil)
+// index - file index
+// Returns the buffer with the file data appended
+func (file *MultiFilePackReadStream) GetFileTo(dst []byte, index int64) ([]byte, error) {
 	if index < 0 || index >= file.file_count {
-		return nil, errors.New("Index out of bounds")
+		return nil, &PackFileError{FileIndex: index, Offset: -1, Err: ErrIndexOutOfBounds}
 	}
 
 	// Fetch metadata of the file
-	_, err := file.f.Seek(8+index*16, 0)
+	table_pt := file.header_size + index*16
+
+	_, err := file.f.Seek(table_pt, 0)
 
 	if err != nil {
-		return nil, err
+		return nil, &PackFileError{FileIndex: index, Offset: table_pt, Err: err}
 	}
 
-	ptBytes := make([]byte, 8)
-	lenBytes := make([]byte, 8)
-
-	_, err = file.f.Read(ptBytes)
+	_, err = io.ReadFull(file.f, file.entry_buf[:])
 
 	if err != nil {
-		return nil, err
+		return nil, &PackFileError{FileIndex: index, Offset: table_pt, Err: read_full_error(err)}
 	}
 
-	_, err = file.f.Read(lenBytes)
+	pt := int64(binary.BigEndian.Uint64(file.entry_buf[0:8]))
+	l := int64(binary.BigEndian.Uint64(file.entry_buf[8:16]))
 
-	if err != nil {
-		return nil, err
+	if pt < 0 || l < 0 {
+		return nil, &PackFileError{FileIndex: index, Offset: table_pt, Err: ErrInvalidData}
 	}
 
-	pt := int64(binary.BigEndian.Uint64(ptBytes))
+	if pt > file.f_size || l > file.f_size-pt {
+		// Do not allocate more than the file size
+		return nil, &PackFileError{FileIndex: index, Offset: pt, Err: ErrTruncatedData}
+	}
 
 	_, err = file.f.Seek(pt, 0)
 
 	if err != nil {
-		return nil, err
+		return nil, &PackFileError{FileIndex: index, Offset: pt, Err: err}
+	}
+
+	if file.ad_header == nil {
+		// Not encrypted, read it directly into the buffer
+		start := len(dst)
+		dst = append(dst, make([]byte, l)...)
+
+		_, err = io.ReadFull(file.f, dst[start:])
+
+		if err != nil {
+			return nil, &PackFileError{FileIndex: index, Offset: pt, Err: read_full_error(err)}
+		}
+
+		return dst, nil
 	}
 
-	l := int64(binary.BigEndian.Uint64(lenBytes))
+	if int64(cap(file.read_buf)) < l {
+		file.read_buf = make([]byte, l)
+	}
 
-	data := make([]byte, l)
+	data := file.read_buf[:l]
 
-	_, err = file.f.Read(data)
+	_, err = io.ReadFull(file.f, data)
 
 	if err != nil {
-		return nil, err
+		return nil, &PackFileError{FileIndex: index, Offset: pt, Err: read_full_error(err)}
 	}
 
-	return data, nil
+	if file.secret_key != nil {
+		// Prevent the key from being destroyed while the file is decrypted
+		_, err := file.secret_key.acquire()
+
+		if err != nil {
+			return nil, &PackFileError{FileIndex: index, Offset: pt, Err: err}
+		}
+
+		defer file.secret_key.release()
+	}
+
+	file.ad_buf = append_indexed_associated_data(file.ad_buf[:0], file.ad_header, index)
+	options := DecryptOptions{AssociatedData: file.ad_buf}
+
+	var result []byte
+
+	if file.keyring != nil {
+		result, err = DecryptFileContentsWithKeyringOptions(data, file.keyring, options)
+
+		if err == nil {
+			result = append(dst, result...)
+		}
+	} else {
+		result, err = decrypt_file_contents(dst, data, file.key, options, &file.cache)
+	}
+
+	if err != nil {
+		return nil, &PackFileError{FileIndex: index, Offset: pt, Err: err}
+	}
+
+	return result, nil
 }
 
 // Closes the read stream
 func (file *MultiFilePackReadStream) Close() {
-	file.f.Close()
+	close_storage(file.closer)
+
+	file.cache.clear()
+	clear(file.read_buf)
+
+	// Drop the references to the key
+	file.key = nil
+	file.keyring = nil
+	file.secret_key = nil
 }
@@ -3,6 +3,9 @@
 package encrypted_storage
 
 import (
+	"bytes"
+	"crypto/rand"
+	"errors"
 	"os"
 	"path"
 	"testing"
@@ -159,3 +162,212 @@ func TestMultiFilePack(t *testing.T) {
 
 	os.Remove(test_file)
 }
+
+func TestMultiFilePackEncrypted(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_multi_file_pack_enc")
+	defer os.Remove(test_file)
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	files := [][]byte{
+		[]byte("File contents 1 (AABB)"),
+		[]byte(""),
+		[]byte("File contents 3 (AAAAAAAA)"),
+	}
+
+	// Write file
+
+	file, err := CreateMultiFilePackWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = file.InitializeWithOptions(int64(len(files)), MultiFilePackOptions{Key: key})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, f := range files {
+		err = file.PutFile(f)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = file.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Read file
+
+	rf, err := CreateMultiFilePackReadStreamWithKey(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !rf.Encrypted() {
+		t.Errorf("Expected the pack to be encrypted")
+	}
+
+	if rf.FileCount() != int64(len(files)) {
+		t.Errorf("Expected file_count = %d, but got %d", len(files), rf.FileCount())
+	}
+
+	for i, f := range files {
+		b, err := rf.GetFile(int64(i))
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if !bytes.Equal(b, f) {
+			t.Errorf("Expected GetFile(%d) = (%s), but got (%s)", i, string(f), string(b))
+		}
+	}
+
+	rf.Close()
+
+	// Wrong key
+
+	wrong_key := make([]byte, 32)
+
+	rf, err = CreateMultiFilePackReadStreamWithKey(test_file, wrong_key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = rf.GetFile(0)
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for a wrong key, but got (%v)", err)
+	}
+
+	rf.Close()
+
+	// No key
+
+	_, err = CreateMultiFilePackReadStream(test_file, 0600)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey without a key, but got (%v)", err)
+	}
+
+	// Swap files 0 and 2
+
+	contents, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	swapped := bytes.Clone(contents)
+	copy(swapped[MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE:], contents[MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE+2*16:MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE+3*16])
+	copy(swapped[MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE+2*16:], contents[MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE:MULTI_FILE_PACK_ENCRYPTED_HEADER_SIZE+16])
+
+	err = os.WriteFile(test_file, swapped, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rf, err = CreateMultiFilePackReadStreamWithKey(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = rf.GetFile(0)
+
+	var file_err *PackFileError
+
+	if !errors.Is(err, ErrAuthenticationFailed) || !errors.As(err, &file_err) || file_err.FileIndex != 0 {
+		t.Errorf("Expected ErrAuthenticationFailed for file 0 after swapping files, but got (%v)", err)
+	}
+
+	rf.Close()
+}
+
+// Destination failing the writes from a position
+type test_failing_writer_at struct {
+	*MemoryFile
+	fail_from int64 // Writes from this position fail (-1 to accept all writes)
+}
+
+var test_write_error = errors.New("write failed")
+
+func (w *test_failing_writer_at) WriteAt(p []byte, off int64) (int, error) {
+	if w.fail_from >= 0 && off+int64(len(p)) > w.fail_from {
+		return 0, test_write_error
+	}
+
+	return w.MemoryFile.WriteAt(p, off)
+}
+
+func TestMultiFilePackWriteError(t *testing.T) {
+	table_end := int64(MULTI_FILE_PACK_HEADER_SIZE + 2*16)
+
+	tests := []struct {
+		fail_from int64 // Position from which the writes fail
+		offset    int64 // Expected offset of the error
+	}{
+		{0, MULTI_FILE_PACK_HEADER_SIZE}, // Table entry
+		{table_end, table_end},           // Data
+	}
+
+	for _, test := range tests {
+		w := &test_failing_writer_at{MemoryFile: NewMemoryFile("pack", nil), fail_from: -1}
+		wp := NewMultiFilePackWriteStream(w)
+
+		err := wp.Initialize(2)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.fail_from = test.fail_from
+
+		err = wp.PutFile([]byte("File contents"))
+
+		var file_err *PackFileError
+
+		if !errors.Is(err, test_write_error) || !errors.As(err, &file_err) {
+			t.Errorf("Expected a PackFileError wrapping the write error, but got (%v)", err)
+		} else if file_err.FileIndex != 0 || file_err.Offset != test.offset {
+			t.Errorf("Expected the error for file 0 at offset %d, but got (%v)", test.offset, err)
+		}
+
+		wp.Close()
+	}
+}
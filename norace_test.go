@@ -0,0 +1,8 @@
+// Race detector (Test)
+
+//go:build !race
+
+package encrypted_storage
+
+// True if the race detector is enabled. sync.Pool drops items on purpose in that case, so allocations cannot be counted
+const race_enabled = false
@@ -0,0 +1,220 @@
+// ML-KEM-768 + X25519 hybrid recipients
+
+package encrypted_storage
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+)
+
+const (
+	RECIPIENT_MLKEM768_X25519 RecipientType = 2 // ML-KEM-768 + X25519 hybrid (post-quantum)
+
+	MLKEM768_X25519_PUBLIC_KEY_SIZE  = mlkem.EncapsulationKeySize768 + X25519_KEY_SIZE                              // Size of the hybrid public keys, in bytes
+	MLKEM768_X25519_PRIVATE_KEY_SIZE = mlkem.SeedSize + X25519_KEY_SIZE                                             // Size of the hybrid private keys, in bytes
+	MLKEM768_X25519_STANZA_SIZE      = mlkem.CiphertextSize768 + X25519_KEY_SIZE + FILE_KEY_SIZE + AES_GCM_TAG_SIZE // Size of the hybrid stanzas, in bytes
+)
+
+// ML-KEM-768 + X25519 hybrid recipient (public key)
+// Public key: ML-KEM-768 encapsulation key (1184 bytes) + X25519 public key (32 bytes)
+// Stanza: ML-KEM-768 cipher text (1088 bytes) + Ephemeral X25519 public key (32 bytes) + File key encrypted with AES-256-GCM (32 bytes) + Authentication tag (16 bytes)
+// The wrapping key is derived with HKDF-SHA256 from both shared secrets, so the file key is protected
+// as long as any of the two algorithms is not broken. The cipher texts and public keys are used as salt.
+// Since the wrapping key is never reused, the nonce is all zeros.
+type MLKEM768X25519Recipient struct {
+	mlkem_key  *mlkem.EncapsulationKey768 // ML-KEM-768 encapsulation key
+	x25519_key *ecdh.PublicKey            // X25519 public key
+}
+
+// ML-KEM-768 + X25519 hybrid identity (private key)
+type MLKEM768X25519Identity struct {
+	mlkem_key  *mlkem.DecapsulationKey768 // ML-KEM-768 decapsulation key
+	x25519_key *ecdh.PrivateKey           // X25519 private key
+}
+
+// Generates a new random ML-KEM-768 + X25519 hybrid identity
+// Returns the identity. Call Recipient to get the public key.
+func GenerateMLKEM768X25519Identity() (*MLKEM768X25519Identity, error) {
+	mlkem_key, err := mlkem.GenerateKey768()
+
+	if err != nil {
+		return nil, err
+	}
+
+	x25519_key, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MLKEM768X25519Identity{mlkem_key: mlkem_key, x25519_key: x25519_key}, nil
+}
+
+// Loads an ML-KEM-768 + X25519 hybrid identity
+// private_key - Private key (96 bytes), as returned by MLKEM768X25519Identity.Bytes
+func NewMLKEM768X25519Identity(private_key []byte) (*MLKEM768X25519Identity, error) {
+	if len(private_key) != MLKEM768_X25519_PRIVATE_KEY_SIZE {
+		return nil, ErrInvalidKey
+	}
+
+	mlkem_key, err := mlkem.NewDecapsulationKey768(private_key[:mlkem.SeedSize])
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	x25519_key, err := ecdh.X25519().NewPrivateKey(private_key[mlkem.SeedSize:])
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	return &MLKEM768X25519Identity{mlkem_key: mlkem_key, x25519_key: x25519_key}, nil
+}
+
+// Loads an ML-KEM-768 + X25519 hybrid recipient
+// public_key - Public key (1216 bytes), as returned by MLKEM768X25519Recipient.Bytes
+func NewMLKEM768X25519Recipient(public_key []byte) (*MLKEM768X25519Recipient, error) {
+	if len(public_key) != MLKEM768_X25519_PUBLIC_KEY_SIZE {
+		return nil, ErrInvalidKey
+	}
+
+	mlkem_key, err := mlkem.NewEncapsulationKey768(public_key[:mlkem.EncapsulationKeySize768])
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	x25519_key, err := ecdh.X25519().NewPublicKey(public_key[mlkem.EncapsulationKeySize768:])
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	return &MLKEM768X25519Recipient{mlkem_key: mlkem_key, x25519_key: x25519_key}, nil
+}
+
+// Returns the private key (96 bytes): ML-KEM-768 seed (64 bytes) + X25519 private key (32 bytes)
+func (i *MLKEM768X25519Identity) Bytes() []byte {
+	result := make([]byte, 0, MLKEM768_X25519_PRIVATE_KEY_SIZE)
+	result = append(result, i.mlkem_key.Bytes()...)
+	result = append(result, i.x25519_key.Bytes()...)
+
+	return result
+}
+
+// Returns the recipient for the identity (its public key)
+func (i *MLKEM768X25519Identity) Recipient() *MLKEM768X25519Recipient {
+	return &MLKEM768X25519Recipient{mlkem_key: i.mlkem_key.EncapsulationKey(), x25519_key: i.x25519_key.PublicKey()}
+}
+
+func (i *MLKEM768X25519Identity) Type() RecipientType {
+	return RECIPIENT_MLKEM768_X25519
+}
+
+func (i *MLKEM768X25519Identity) UnwrapFileKey(stanza []byte) ([]byte, error) {
+	if len(stanza) != MLKEM768_X25519_STANZA_SIZE {
+		// Malformed stanza. Other stanzas may match
+		return nil, ErrKeyNotFound
+	}
+
+	mlkem_ciphertext := stanza[:mlkem.CiphertextSize768]
+	ephemeral_public := stanza[mlkem.CiphertextSize768 : mlkem.CiphertextSize768+X25519_KEY_SIZE]
+
+	mlkem_shared, err := i.mlkem_key.Decapsulate(mlkem_ciphertext)
+
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeral_public)
+
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	x25519_shared, err := i.x25519_key.ECDH(ephemeral)
+
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	aead, err := mlkem768_x25519_wrapping_aead(mlkem_shared, x25519_shared, mlkem_ciphertext, ephemeral_public, i.x25519_key.PublicKey().Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	file_key, err := aead.Open(nil, make([]byte, AES_GCM_NONCE_SIZE), stanza[mlkem.CiphertextSize768+X25519_KEY_SIZE:], nil)
+
+	if err != nil {
+		// The stanza is for another recipient
+		return nil, ErrKeyNotFound
+	}
+
+	return file_key, nil
+}
+
+// Returns the public key (1216 bytes): ML-KEM-768 encapsulation key (1184 bytes) + X25519 public key (32 bytes)
+func (r *MLKEM768X25519Recipient) Bytes() []byte {
+	result := make([]byte, 0, MLKEM768_X25519_PUBLIC_KEY_SIZE)
+	result = append(result, r.mlkem_key.Bytes()...)
+	result = append(result, r.x25519_key.Bytes()...)
+
+	return result
+}
+
+func (r *MLKEM768X25519Recipient) Type() RecipientType {
+	return RECIPIENT_MLKEM768_X25519
+}
+
+func (r *MLKEM768X25519Recipient) WrapFileKey(file_key []byte) ([]byte, error) {
+	mlkem_shared, mlkem_ciphertext := r.mlkem_key.Encapsulate()
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	x25519_shared, err := ephemeral.ECDH(r.x25519_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	ephemeral_public := ephemeral.PublicKey().Bytes()
+
+	aead, err := mlkem768_x25519_wrapping_aead(mlkem_shared, x25519_shared, mlkem_ciphertext, ephemeral_public, r.x25519_key.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	stanza := make([]byte, 0, MLKEM768_X25519_STANZA_SIZE)
+	stanza = append(stanza, mlkem_ciphertext...)
+	stanza = append(stanza, ephemeral_public...)
+
+	return aead.Seal(stanza, make([]byte, AES_GCM_NONCE_SIZE), file_key, nil), nil
+}
+
+// Derives the key to wrap the file key from both shared secrets, and creates the AEAD instance
+// mlkem_shared - ML-KEM-768 shared secret
+// x25519_shared - X25519 shared secret
+// mlkem_ciphertext - ML-KEM-768 cipher text
+// ephemeral_public - Ephemeral X25519 public key
+// recipient_public - X25519 public key of the recipient
+func mlkem768_x25519_wrapping_aead(mlkem_shared []byte, x25519_shared []byte, mlkem_ciphertext []byte, ephemeral_public []byte, recipient_public []byte) (cipher.AEAD, error) {
+	secret := make([]byte, 0, len(mlkem_shared)+len(x25519_shared))
+	secret = append(secret, mlkem_shared...)
+	secret = append(secret, x25519_shared...)
+
+	salt := make([]byte, 0, len(mlkem_ciphertext)+2*X25519_KEY_SIZE)
+	salt = append(salt, mlkem_ciphertext...)
+	salt = append(salt, ephemeral_public...)
+	salt = append(salt, recipient_public...)
+
+	return derive_wrapping_aead(secret, salt, "encrypted-storage mlkem768x25519 file key")
+}
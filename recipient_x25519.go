@@ -0,0 +1,161 @@
+// X25519 recipients
+
+package encrypted_storage
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+)
+
+const (
+	RECIPIENT_X25519 RecipientType = 1 // X25519 (ephemeral ECDH + HKDF-SHA256 + AES-256-GCM)
+
+	X25519_KEY_SIZE    = 32                                                 // Size of the X25519 public and private keys, in bytes
+	X25519_STANZA_SIZE = X25519_KEY_SIZE + FILE_KEY_SIZE + AES_GCM_TAG_SIZE // Size of the X25519 stanzas, in bytes
+)
+
+// X25519 recipient (public key)
+// Stanza: Ephemeral public key (32 bytes) + File key encrypted with AES-256-GCM (32 bytes) + Authentication tag (16 bytes)
+// The wrapping key is derived with HKDF-SHA256 from the shared secret, using the ephemeral and recipient public keys as salt.
+// Since the wrapping key is never reused, the nonce is all zeros.
+type X25519Recipient struct {
+	public_key *ecdh.PublicKey // Public key
+}
+
+// X25519 identity (private key)
+type X25519Identity struct {
+	private_key *ecdh.PrivateKey // Private key
+}
+
+// Generates a new random X25519 identity
+// Returns the identity. Call Recipient to get the public key.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	private_key, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &X25519Identity{private_key: private_key}, nil
+}
+
+// Loads an X25519 identity
+// private_key - Private key (32 bytes), as returned by X25519Identity.Bytes
+func NewX25519Identity(private_key []byte) (*X25519Identity, error) {
+	k, err := ecdh.X25519().NewPrivateKey(private_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	return &X25519Identity{private_key: k}, nil
+}
+
+// Loads an X25519 recipient
+// public_key - Public key (32 bytes), as returned by X25519Recipient.Bytes
+func NewX25519Recipient(public_key []byte) (*X25519Recipient, error) {
+	k, err := ecdh.X25519().NewPublicKey(public_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	return &X25519Recipient{public_key: k}, nil
+}
+
+// Returns the private key (32 bytes)
+func (i *X25519Identity) Bytes() []byte {
+	return i.private_key.Bytes()
+}
+
+// Returns the recipient for the identity (its public key)
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{public_key: i.private_key.PublicKey()}
+}
+
+func (i *X25519Identity) Type() RecipientType {
+	return RECIPIENT_X25519
+}
+
+func (i *X25519Identity) UnwrapFileKey(stanza []byte) ([]byte, error) {
+	if len(stanza) != X25519_STANZA_SIZE {
+		// Malformed stanza. Other stanzas may match
+		return nil, ErrKeyNotFound
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(stanza[:X25519_KEY_SIZE])
+
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	shared, err := i.private_key.ECDH(ephemeral)
+
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+
+	aead, err := x25519_wrapping_aead(shared, stanza[:X25519_KEY_SIZE], i.private_key.PublicKey().Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	file_key, err := aead.Open(nil, make([]byte, AES_GCM_NONCE_SIZE), stanza[X25519_KEY_SIZE:], nil)
+
+	if err != nil {
+		// The stanza is for another recipient
+		return nil, ErrKeyNotFound
+	}
+
+	return file_key, nil
+}
+
+// Returns the public key (32 bytes)
+func (r *X25519Recipient) Bytes() []byte {
+	return r.public_key.Bytes()
+}
+
+func (r *X25519Recipient) Type() RecipientType {
+	return RECIPIENT_X25519
+}
+
+func (r *X25519Recipient) WrapFileKey(file_key []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(r.public_key)
+
+	if err != nil {
+		return nil, invalid_key_error(err)
+	}
+
+	ephemeral_public := ephemeral.PublicKey().Bytes()
+
+	aead, err := x25519_wrapping_aead(shared, ephemeral_public, r.public_key.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	stanza := make([]byte, X25519_KEY_SIZE, X25519_STANZA_SIZE)
+	copy(stanza, ephemeral_public)
+
+	return aead.Seal(stanza, make([]byte, AES_GCM_NONCE_SIZE), file_key, nil), nil
+}
+
+// Derives the key to wrap the file key, and creates the AEAD instance
+// shared - ECDH shared secret
+// ephemeral_public - Ephemeral public key
+// recipient_public - Public key of the recipient
+func x25519_wrapping_aead(shared []byte, ephemeral_public []byte, recipient_public []byte) (cipher.AEAD, error) {
+	salt := make([]byte, 0, 2*X25519_KEY_SIZE)
+	salt = append(salt, ephemeral_public...)
+	salt = append(salt, recipient_public...)
+
+	return derive_wrapping_aead(shared, salt, "encrypted-storage x25519 file key")
+}
@@ -0,0 +1,340 @@
+// Public-key encryption to recipients
+// The data is encrypted with a random file key, and the file key is wrapped for each recipient
+// ---
+// Recipients header:
+//   - Number of stanzas (uint16 big endian) (2 bytes)
+//   - For each recipient, a stanza:
+//       - Recipient type (uint16 big endian) (2 bytes)
+//       - Length (uint16 big endian) (2 bytes)
+//       - Value: The file key, wrapped for the recipient (Length bytes)
+
+package encrypted_storage
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Type of recipient
+type RecipientType uint16
+
+const (
+	FILE_KEY_SIZE = 32 // Size of the file keys, in bytes
+
+	RECIPIENTS_MAX = 1024 // Max number of recipients
+)
+
+// Recipient of encrypted data, able to wrap the file key so only the matching Identity can unwrap it
+type Recipient interface {
+	// Returns the type of recipient
+	Type() RecipientType
+
+	// Wraps a file key for the recipient
+	// file_key - File key (FILE_KEY_SIZE bytes)
+	// Returns the stanza to store in the header
+	WrapFileKey(file_key []byte) (stanza []byte, err error)
+}
+
+// Identity able to unwrap the file keys wrapped for its Recipient
+type Identity interface {
+	// Returns the type of recipient this identity can unwrap stanzas for
+	Type() RecipientType
+
+	// Unwraps a file key
+	// stanza - Stanza of a recipient with the same type
+	// Returns the file key. If the stanza is not for this identity, or it is malformed, must return ErrKeyNotFound,
+	// so the rest of the stanzas are tried
+	UnwrapFileKey(stanza []byte) (file_key []byte, err error)
+}
+
+// Generates a random file key, and wraps it for each recipient
+// recipients - Recipients
+// Returns the file key and the recipients header
+func generate_file_key_for_recipients(recipients []Recipient) (file_key []byte, header []byte, err error) {
+	if len(recipients) == 0 || len(recipients) > RECIPIENTS_MAX {
+		return nil, nil, ErrInvalidArgument
+	}
+
+	file_key = make([]byte, FILE_KEY_SIZE)
+	_, err = rand.Read(file_key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header = make([]byte, 2)
+	binary.BigEndian.PutUint16(header, uint16(len(recipients)))
+
+	for _, r := range recipients {
+		if r == nil {
+			return nil, nil, ErrInvalidArgument
+		}
+
+		stanza, err := r.WrapFileKey(file_key)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(stanza) > 0xFFFF {
+			return nil, nil, ErrDataTooLarge
+		}
+
+		entry := make([]byte, 4)
+		binary.BigEndian.PutUint16(entry[0:2], uint16(r.Type()))
+		binary.BigEndian.PutUint16(entry[2:4], uint16(len(stanza)))
+
+		header = append(header, entry...)
+		header = append(header, stanza...)
+	}
+
+	return file_key, header, nil
+}
+
+// Reads the recipients header, and unwraps the file key with the first matching identity
+// data - Data starting with the recipients header
+// identities - Identities
+// Returns the file key, and the size of the header. If no identity matches, returns ErrKeyNotFound
+func unwrap_file_key_for_identities(data []byte, identities []Identity) (file_key []byte, header_size int, err error) {
+	if len(data) < 2 {
+		return nil, 0, ErrTruncatedData
+	}
+
+	count := int(binary.BigEndian.Uint16(data[0:2]))
+
+	if count == 0 || count > RECIPIENTS_MAX {
+		return nil, 0, ErrInvalidData
+	}
+
+	offset := 2
+
+	for i := 0; i < count; i++ {
+		if offset+4 > len(data) {
+			return nil, 0, ErrTruncatedData
+		}
+
+		t := RecipientType(binary.BigEndian.Uint16(data[offset : offset+2]))
+		l := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+
+		if offset+4+l > len(data) {
+			return nil, 0, ErrTruncatedData
+		}
+
+		stanza := data[offset+4 : offset+4+l]
+		offset += 4 + l
+
+		if file_key != nil {
+			continue
+		}
+
+		for _, identity := range identities {
+			if identity == nil || identity.Type() != t {
+				continue
+			}
+
+			key, err := identity.UnwrapFileKey(stanza)
+
+			if err == nil {
+				if len(key) != FILE_KEY_SIZE {
+					return nil, 0, ErrInvalidData
+				}
+
+				file_key = key
+				break
+			} else if !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrInvalidData) {
+				// Malformed stanzas are skipped, so they do not prevent the rest of the recipients from decrypting
+				return nil, 0, err
+			}
+		}
+	}
+
+	if file_key == nil {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	return file_key, offset, nil
+}
+
+// Recipients wrapper method
+// Header: None (the recipients header has a variable size, so it is included in the body)
+// Body: Recipients header + Cipher text of another method, encrypted with the file key
+// It cannot be used with a key, use EncryptFileContentsToRecipients and DecryptFileContentsWithIdentities
+type recipients_method struct{}
+
+func (m *recipients_method) ID() FileEncryptionMethod {
+	return RECIPIENTS_WRAPPER
+}
+
+func (m *recipients_method) HeaderSize() int {
+	return 0
+}
+
+func (m *recipients_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupported
+}
+
+func (m *recipients_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// Derives the key to wrap a file key with HKDF-SHA256, and creates the AEAD instance (AES-256-GCM)
+// secret - Shared secret
+// salt - Salt, binding the key to the public keys involved
+// info - Label of the recipient type
+func derive_wrapping_aead(secret []byte, salt []byte, info string) (cipher.AEAD, error) {
+	wrapping_key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), wrapping_key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new_aes_gcm(wrapping_key)
+}
+
+// Derives the key of the blocks of a block-encrypted file for recipients from the file key
+// The key is bound to the recipients header (used as salt), so the list of recipients cannot be modified
+// without failing to decrypt the blocks, like the associated data of the recipients method
+// file_key - File key
+// recipients_header - Recipients header
+func derive_recipients_block_key(file_key []byte, recipients_header []byte) ([]byte, error) {
+	block_key := make([]byte, KEY_SIZE)
+	_, err := io.ReadFull(hkdf.New(sha256.New, file_key, recipients_header, []byte("encrypted-storage recipients block key")), block_key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return block_key, nil
+}
+
+// Returns the associated data for the cipher text wrapped by the recipients method
+// recipients_header - Method ID and recipients header
+// ad - Associated data provided by the caller
+func recipients_associated_data(recipients_header []byte, ad []byte) []byte {
+	label := []byte("encrypted-storage recipients")
+
+	result := make([]byte, 0, len(label)+len(recipients_header)+len(ad))
+	result = append(result, label...)
+	result = append(result, recipients_header...)
+	result = append(result, ad...)
+
+	return result
+}
+
+// Encrypts file contents for one or more recipients
+// A random file key is used to encrypt the data, and it is wrapped for each recipient.
+// The cipher text uses the RECIPIENTS_WRAPPER method.
+// data - File data
+// method - algorithm to use. Must implement AssociatedDataEncryptionMethod (AES256_GCM, XCHACHA20_POLY1305, etc)
+// recipients - Recipients
+// Returns the cipher text, or an error
+func EncryptFileContentsToRecipients(data []byte, method FileEncryptionMethod, recipients []Recipient) ([]byte, error) {
+	return EncryptFileContentsToRecipientsWithOptions(data, method, recipients, EncryptOptions{})
+}
+
+// Encrypts file contents for one or more recipients, with options
+// data - File data
+// method - algorithm to use. Must implement AssociatedDataEncryptionMethod
+// recipients - Recipients
+// options - Encryption options
+// Returns the cipher text, or an error
+func EncryptFileContentsToRecipientsWithOptions(data []byte, method FileEncryptionMethod, recipients []Recipient, options EncryptOptions) ([]byte, error) {
+	if method == RECIPIENTS_WRAPPER || method == KEY_ID_WRAPPER || method == SIGNATURE_WRAPPER {
+		return nil, ErrInvalidMethod
+	}
+
+	if options.Signer != nil {
+		signer := options.Signer
+		options.Signer = nil
+
+		cipher_text, err := EncryptFileContentsToRecipientsWithOptions(data, method, recipients, options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return SignFileContents(cipher_text, signer)
+	}
+
+	file_key, header, err := generate_file_key_for_recipients(recipients)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 2, 2+len(header))
+	binary.BigEndian.PutUint16(result, uint16(RECIPIENTS_WRAPPER))
+	result = append(result, header...)
+
+	// The recipients header is authenticated with the file key
+	options.AssociatedData = recipients_associated_data(result, options.AssociatedData)
+
+	inner, err := EncryptFileContentsWithOptions(data, method, file_key, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, inner...), nil
+}
+
+// Decrypts file contents encrypted for recipients
+// data - Cipher text
+// identities - Identities. Any of them can be used to decrypt
+// Returns the original file data, or an error. If no identity can decrypt the data, returns ErrKeyNotFound
+func DecryptFileContentsWithIdentities(data []byte, identities []Identity) ([]byte, error) {
+	return DecryptFileContentsWithIdentitiesAndOptions(data, identities, DecryptOptions{})
+}
+
+// Decrypts file contents encrypted for recipients, with options
+// data - Cipher text
+// identities - Identities. Any of them can be used to decrypt
+// options - Decryption options
+// Returns the original file data, or an error. If no identity can decrypt the data, returns ErrKeyNotFound
+func DecryptFileContentsWithIdentitiesAndOptions(data []byte, identities []Identity, options DecryptOptions) ([]byte, error) {
+	if options.MaxCiphertextSize > 0 && int64(len(data)) > options.MaxCiphertextSize {
+		return nil, &SizeLimitError{Limit: options.MaxCiphertextSize, Ciphertext: true}
+	}
+
+	data, err := strip_signature(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 2 {
+		return nil, ErrTruncatedData
+	}
+
+	if FileEncryptionMethod(binary.BigEndian.Uint16(data[:2])) != RECIPIENTS_WRAPPER {
+		return nil, ErrInvalidMethod
+	}
+
+	file_key, header_size, err := unwrap_file_key_for_identities(data[2:], identities)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inner := data[2+header_size:]
+
+	if len(inner) >= 2 {
+		inner_method := FileEncryptionMethod(binary.BigEndian.Uint16(inner[:2]))
+
+		if inner_method == RECIPIENTS_WRAPPER || inner_method == KEY_ID_WRAPPER || inner_method == SIGNATURE_WRAPPER {
+			return nil, ErrInvalidData
+		}
+	}
+
+	options.AssociatedData = recipients_associated_data(data[:2+header_size], options.AssociatedData)
+	options.MaxCiphertextSize = 0
+
+	return DecryptFileContentsWithOptions(inner, file_key, options)
+}
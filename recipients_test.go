@@ -0,0 +1,368 @@
+// Public-key encryption to recipients (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecipientsX25519(t *testing.T) {
+	owner, err := GenerateX25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	backup, err := GenerateX25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := GenerateX25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Load the keys from their bytes, as they would be stored
+
+	owner_recipient, err := NewX25519Recipient(owner.Recipient().Bytes())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	backup_loaded, err := NewX25519Identity(backup.Bytes())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recipients := []Recipient{owner_recipient, backup.Recipient()}
+
+	original := []byte("Test data for the recipients")
+
+	for _, method := range []FileEncryptionMethod{AES256_GCM, XCHACHA20_POLY1305_ZIP, AES256_GCM_STREAM} {
+		encrypted, err := EncryptFileContentsToRecipients(original, method, recipients)
+
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		for i, identity := range []Identity{owner, backup_loaded} {
+			decrypted, err := DecryptFileContentsWithIdentities(encrypted, []Identity{identity})
+
+			if err != nil {
+				t.Errorf("Method %d, identity %d: %v", method, i, err)
+			} else if !bytes.Equal(decrypted, original) {
+				t.Errorf("Method %d, identity %d: Decrypted data does not match the original data", method, i)
+			}
+		}
+
+		_, err = DecryptFileContentsWithIdentities(encrypted, []Identity{other})
+
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Method %d: Expected ErrKeyNotFound for another identity, but got (%v)", method, err)
+		}
+
+		// The recipients header is authenticated: remove the second recipient
+
+		header_size := 2 + 2 + 2*(4+X25519_STANZA_SIZE)
+		modified := append([]byte{}, encrypted[:4]...)
+		modified[3] = 1 // 1 recipient
+		modified = append(modified, encrypted[4:4+4+X25519_STANZA_SIZE]...)
+		modified = append(modified, encrypted[header_size:]...)
+
+		_, err = DecryptFileContentsWithIdentities(modified, []Identity{owner})
+
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Method %d: Expected ErrAuthenticationFailed after modifying the recipients, but got (%v)", method, err)
+		}
+
+		// It cannot be decrypted with a key
+
+		_, err = DecryptFileContents(encrypted, make([]byte, 32))
+
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Method %d: Expected ErrUnsupported, but got (%v)", method, err)
+		}
+	}
+
+	_, err = EncryptFileContentsToRecipients(original, AES256_GCM, nil)
+
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument without recipients, but got (%v)", err)
+	}
+
+	_, err = NewX25519Recipient([]byte{1, 2, 3})
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for an invalid public key, but got (%v)", err)
+	}
+
+	// Malformed stanzas are skipped: wrong length, and a low-order ephemeral key
+
+	encrypted, err := EncryptFileContentsToRecipients(original, AES256_GCM, []Recipient{
+		&test_fixed_recipient{t: RECIPIENT_X25519, stanza: []byte{1, 2, 3}},
+		&test_fixed_recipient{t: RECIPIENT_X25519, stanza: make([]byte, X25519_STANZA_SIZE)},
+		owner_recipient,
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err := DecryptFileContentsWithIdentities(encrypted, []Identity{owner})
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data (malformed stanzas)")
+	}
+
+	_, err = DecryptFileContentsWithIdentities(encrypted, []Identity{other})
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for another identity, but got (%v)", err)
+	}
+}
+
+// Recipient producing a fixed stanza, to test malformed stanzas
+type test_fixed_recipient struct {
+	t      RecipientType // Type
+	stanza []byte        // Stanza
+}
+
+func (r *test_fixed_recipient) Type() RecipientType {
+	return r.t
+}
+
+func (r *test_fixed_recipient) WrapFileKey(file_key []byte) ([]byte, error) {
+	return r.stanza, nil
+}
+
+func TestRecipientsFileBlockEncrypt(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_recipients")
+	defer os.Remove(test_file)
+
+	owner, _ := GenerateX25519Identity()
+	backup, _ := GenerateX25519Identity()
+	other, _ := GenerateX25519Identity()
+
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithOptions(int64(len(original)), 256, nil, FileBlockEncryptOptions{Recipients: []Recipient{owner.Recipient(), backup.Recipient()}})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, identity := range []Identity{owner, backup} {
+		rs, err := CreateFileBlockEncryptReadStreamWithIdentities(test_file, []Identity{identity}, 0600)
+
+		if err != nil {
+			t.Errorf("Identity %d: %v", i, err)
+			continue
+		}
+
+		data, err := io.ReadAll(rs)
+		rs.Close()
+
+		if err != nil {
+			t.Errorf("Identity %d: %v", i, err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Identity %d: Decrypted data does not match the original data", i)
+		}
+	}
+
+	_, err = CreateFileBlockEncryptReadStreamWithIdentities(test_file, []Identity{other}, 0600)
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for another identity, but got (%v)", err)
+	}
+
+	_, err = CreateFileBlockEncryptReadStream(test_file, make([]byte, 32), 0600)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey when reading with a key, but got (%v)", err)
+	}
+
+	// A recipient cannot modify the list of recipients: replace the stanza of the owner with one for another identity
+
+	data, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recipients_header, offset, ok := find_header_extension(data[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE:], FILE_BLOCK_EXTENSION_RECIPIENTS)
+
+	if !ok {
+		t.Errorf("Expected a recipients header")
+		return
+	}
+
+	file_key, _, err := unwrap_file_key_for_identities(recipients_header, []Identity{backup})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stanza, err := other.Recipient().WrapFileKey(file_key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Count (2 bytes) + type and length of the first stanza (4 bytes)
+	copy(data[FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+offset+6:], stanza)
+
+	rs, err := NewFileBlockEncryptReadStreamWithIdentities(bytes.NewReader(data), int64(len(data)), []Identity{other})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = io.ReadAll(rs)
+	rs.Close()
+
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrAuthenticationFailed for a modified recipients header, but got (%v)", err)
+	}
+}
+
+func TestRecipientsMLKEM768X25519(t *testing.T) {
+	hybrid, err := GenerateMLKEM768X25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	classic, err := GenerateX25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := GenerateMLKEM768X25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Load the keys from their bytes, as they would be stored
+
+	hybrid_recipient, err := NewMLKEM768X25519Recipient(hybrid.Recipient().Bytes())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	hybrid_loaded, err := NewMLKEM768X25519Identity(hybrid.Bytes())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := []byte("Test data for the post-quantum recipients")
+
+	encrypted, err := EncryptFileContentsToRecipients(original, AES256_GCM_ZIP, []Recipient{classic.Recipient(), hybrid_recipient})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, identity := range []Identity{hybrid_loaded, classic} {
+		decrypted, err := DecryptFileContentsWithIdentities(encrypted, []Identity{identity})
+
+		if err != nil {
+			t.Errorf("Identity %d: %v", i, err)
+		} else if !bytes.Equal(decrypted, original) {
+			t.Errorf("Identity %d: Decrypted data does not match the original data", i)
+		}
+	}
+
+	_, err = DecryptFileContentsWithIdentities(encrypted, []Identity{other})
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for another identity, but got (%v)", err)
+	}
+
+	// Modify the ML-KEM cipher text of the stanza
+
+	stanza_offset := 2 + 2 + (4 + X25519_STANZA_SIZE) + 4
+	modified := bytes.Clone(encrypted)
+	modified[stanza_offset] ^= 0x01
+
+	_, err = DecryptFileContentsWithIdentities(modified, []Identity{hybrid})
+
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound after modifying the stanza, but got (%v)", err)
+	}
+
+	_, err = NewMLKEM768X25519Recipient(classic.Recipient().Bytes())
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for an invalid public key, but got (%v)", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Secret keys, validated on creation and kept in protected memory
+
+package encrypted_storage
+
+import (
+	"crypto/rand"
+	"sync"
+)
+
+const (
+	KEY_SIZE = 32 // Size of the encryption keys, in bytes
+)
+
+// Checks the size of a key provided as []byte
+// Keys of 16 and 24 bytes are accepted for compatibility (AES-128, AES-192), even if KEY_SIZE is recommended.
+// Secret keys are always of KEY_SIZE bytes
+// size - Size of the key, in bytes
+func is_valid_key_size(size int) bool {
+	return size == 16 || size == 24 || size == KEY_SIZE
+}
+
+// Encryption key, kept in memory allocated outside of the Go heap.
+// On Linux, the memory is locked (mlock), so it is not swapped to disk.
+// Call Destroy to wipe it when it is no longer needed (the memory is not released otherwise).
+// After that, any stream using it fails with ErrInvalidKey.
+// It is safe for concurrent use
+type SecretKey struct {
+	mu sync.RWMutex // Mutex. Held for reading while the key is being used, so Destroy waits for it
+
+	mem    []byte // Allocated memory (nil after Destroy)
+	data   []byte // Key bytes (nil after Destroy)
+	locked bool   // True if the memory is locked
+}
+
+// Creates a secret key from its bytes
+// key - The key (32 bytes). It is copied, so you should wipe it after calling this
+// Returns the secret key, or ErrInvalidKey if the length is not valid
+func NewSecretKey(key []byte) (*SecretKey, error) {
+	if len(key) != KEY_SIZE {
+		return nil, ErrInvalidKey
+	}
+
+	mem, locked, err := alloc_key_memory(len(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	k := &SecretKey{
+		mem:    mem,
+		data:   mem[:len(key)],
+		locked: locked,
+	}
+
+	copy(k.data, key)
+
+	return k, nil
+}
+
+// Generates a random secret key
+func GenerateSecretKey() (*SecretKey, error) {
+	mem, locked, err := alloc_key_memory(KEY_SIZE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k := &SecretKey{
+		mem:    mem,
+		data:   mem[:KEY_SIZE],
+		locked: locked,
+	}
+
+	_, err = rand.Read(k.data)
+
+	if err != nil {
+		k.Destroy()
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Calls a function with the bytes of the key, to use them with the functions accepting keys as []byte
+// The key cannot be destroyed while the function runs (Destroy waits for it).
+// The slice must not be modified, or kept after the function returns, since the memory is released by Destroy
+// f - Function. Its error is returned
+// Returns ErrInvalidKey if the key was destroyed, or the error returned by f
+func (k *SecretKey) Use(f func(key []byte) error) error {
+	key, err := k.acquire()
+
+	if err != nil {
+		return err
+	}
+
+	defer k.release()
+
+	return f(key)
+}
+
+// Returns true if the memory of the key is locked, so it cannot be swapped to disk
+// It is only supported on Linux, and may fail if the limit of locked memory (RLIMIT_MEMLOCK) is reached
+func (k *SecretKey) Locked() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.locked
+}
+
+// Returns true if the key was destroyed
+func (k *SecretKey) Destroyed() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.data == nil
+}
+
+// Wipes the key from memory, and releases it
+// Waits for any block being encrypted or decrypted with the key to finish
+// Calling it more than once has no effect
+func (k *SecretKey) Destroy() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.mem == nil {
+		return
+	}
+
+	free_key_memory(k.mem, k.locked)
+
+	k.mem = nil
+	k.data = nil
+	k.locked = false
+}
+
+// Prevents the key from being destroyed while it is being used. Call release after using it
+// Returns the bytes of the key, or ErrInvalidKey if it was destroyed (release must not be called in that case)
+func (k *SecretKey) acquire() ([]byte, error) {
+	k.mu.RLock()
+
+	if k.data == nil {
+		k.mu.RUnlock()
+		return nil, ErrInvalidKey
+	}
+
+	return k.data, nil
+}
+
+// Releases the key after using it (see acquire)
+func (k *SecretKey) release() {
+	k.mu.RUnlock()
+}
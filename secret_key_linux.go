@@ -0,0 +1,45 @@
+// Memory for secret keys (Linux)
+
+//go:build linux
+
+package encrypted_storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Allocates memory for a key, outside of the Go heap, locking it so it is not swapped to disk
+// size - Size of the key, in bytes
+// Returns the memory (rounded up to the page size), and true if it was locked
+func alloc_key_memory(size int) ([]byte, bool, error) {
+	page_size := os.Getpagesize()
+	mem_size := ((size + page_size - 1) / page_size) * page_size
+
+	mem, err := syscall.Mmap(-1, 0, mem_size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Locking fails if the limit of locked memory (RLIMIT_MEMLOCK) is reached. The key can still be used
+	locked := syscall.Mlock(mem) == nil
+
+	// Do not copy the key to child processes
+	_ = syscall.Madvise(mem, syscall.MADV_DONTFORK)
+
+	return mem, locked, nil
+}
+
+// Wipes and releases the memory of a key
+// mem - Memory returned by alloc_key_memory
+// locked - True if the memory was locked
+func free_key_memory(mem []byte, locked bool) {
+	clear(mem)
+
+	if locked {
+		_ = syscall.Munlock(mem)
+	}
+
+	_ = syscall.Munmap(mem)
+}
@@ -0,0 +1,20 @@
+// Memory for secret keys (other systems)
+
+//go:build !linux
+
+package encrypted_storage
+
+// Allocates memory for a key
+// Memory locking is not supported on this system, so the memory is never locked
+// size - Size of the key, in bytes
+// Returns the memory, and false (not locked)
+func alloc_key_memory(size int) ([]byte, bool, error) {
+	return make([]byte, size), false, nil
+}
+
+// Wipes the memory of a key
+// mem - Memory returned by alloc_key_memory
+// locked - Ignored
+func free_key_memory(mem []byte, locked bool) {
+	clear(mem)
+}
@@ -0,0 +1,300 @@
+// Secret keys (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSecretKey(t *testing.T) {
+	_, err := NewSecretKey(make([]byte, 16))
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a key of 16 bytes, but got (%v)", err)
+	}
+
+	raw := test_random_key()
+
+	key, err := NewSecretKey(raw)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := []byte("Test data encrypted with a secret key")
+
+	var encrypted []byte
+
+	err = key.Use(func(key_bytes []byte) error {
+		if !bytes.Equal(key_bytes, raw) {
+			t.Errorf("The bytes of the key do not match")
+		}
+
+		encrypted, err = EncryptFileContents(original, AES256_GCM, key_bytes)
+
+		return err
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err := DecryptFileContents(encrypted, raw)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	key.Destroy()
+	key.Destroy()
+
+	if !key.Destroyed() || key.Locked() {
+		t.Errorf("Expected the key to be destroyed")
+	}
+
+	err = key.Use(func(key_bytes []byte) error {
+		t.Errorf("The function must not be called after destroying the key")
+		return nil
+	})
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey after destroying the key, but got (%v)", err)
+	}
+
+	generated, err := GenerateSecretKey()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer generated.Destroy()
+
+	err = generated.Use(func(key_bytes []byte) error {
+		if len(key_bytes) != KEY_SIZE || bytes.Equal(key_bytes, make([]byte, KEY_SIZE)) {
+			t.Errorf("Expected a random key of %d bytes", KEY_SIZE)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSecretKeyStreams(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_secret_key")
+	defer os.Remove(test_file)
+
+	test_pack := path.Join(test_path_base, "test_pack_secret_key")
+	defer os.Remove(test_pack)
+
+	key, err := GenerateSecretKey()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := bytes.Repeat([]byte("Test data encrypted with a secret key. "), 30)
+
+	// Invalid keys are rejected on initialization
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Initialize(int64(len(original)), 256, make([]byte, 20))
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a key of 20 bytes, but got (%v)", err)
+	}
+
+	// AES-128 and AES-192 keys are still accepted as []byte
+
+	for _, size := range []int{16, 24} {
+		short_key := make([]byte, size)
+		_, err = rand.Read(short_key)
+
+		if err != nil {
+			panic(err)
+		}
+
+		err = ws.Initialize(int64(len(original)), 256, short_key)
+
+		if err == nil {
+			_, err = ws.Write(original)
+		}
+
+		if err == nil {
+			err = ws.Close()
+		}
+
+		if err != nil {
+			t.Errorf("Expected a key of %d bytes to be accepted, but got (%v)", size, err)
+			continue
+		}
+
+		rs, err := CreateFileBlockEncryptReadStream(test_file, short_key, 0600)
+
+		if err != nil {
+			t.Errorf("Expected a key of %d bytes to be accepted, but got (%v)", size, err)
+			continue
+		}
+
+		data, err := io.ReadAll(rs)
+		rs.Close()
+
+		if err != nil || !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data (key of %d bytes)", size)
+		}
+
+		ws, err = CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Block-encrypted file
+
+	err = ws.InitializeWithSecretKey(int64(len(original)), 256, key, FileBlockEncryptOptions{Authenticated: true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ws.key != nil || ws.secret_key != nil {
+		t.Errorf("Expected the write stream to drop the key on Close")
+	}
+
+	rs, err := CreateFileBlockEncryptReadStreamWithSecretKey(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := io.ReadAll(rs)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	rs.Close()
+
+	if rs.key != nil || rs.secret_key != nil {
+		t.Errorf("Expected the read stream to drop the key on Close")
+	}
+
+	// Pack
+
+	pws, err := CreateMultiFilePackWriteStream(test_pack, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pws.InitializeWithSecretKey(1, key, MultiFilePackOptions{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pws.PutFile(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	prs, err := CreateMultiFilePackReadStreamWithSecretKey(test_pack, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer prs.Close()
+
+	// Destroying the key makes the streams fail
+
+	rs, err = CreateFileBlockEncryptReadStreamWithSecretKey(test_file, key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer rs.Close()
+
+	key.Destroy()
+
+	_, err = rs.Read(make([]byte, 10))
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey after destroying the key, but got (%v)", err)
+	}
+
+	_, err = prs.GetFile(0)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey after destroying the key (pack), but got (%v)", err)
+	}
+
+	_, err = CreateFileBlockEncryptReadStreamWithSecretKey(test_file, key, 0600)
+
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for a destroyed key, but got (%v)", err)
+	}
+}
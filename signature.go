@@ -0,0 +1,344 @@
+// Ed25519 signatures, to prove which signer produced the encrypted data
+// ---
+// Signed cipher text (SIGNATURE_WRAPPER):
+//   - Method ID (19) (uint16 big endian) (2 bytes)
+//   - Header: Public key of the signer (32 bytes)
+//   - Body: Cipher text of another method (method ID + header + body)
+//   - Signature trailer (64 bytes)
+// The signature covers a label, the method ID, the public key and the wrapped cipher text.
+// ---
+// Signed block-encrypted files (authenticated format), signature extension:
+//   - Public key of the signer (32 bytes)
+//   - Signature (64 bytes)
+// The signature covers a label, the public key, the fixed header (40 bytes),
+// the SHA-256 hash of the block index and the SHA-256 hash of the blocks.
+// If the block index is stored in a footer, the hash of the footer (including its length) is used instead of the hash of the block index.
+// The rest of the extensions are not covered, so the data key can be wrapped again (see RewrapFileBlockEncryptKey).
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	SIGNATURE_PUBLIC_KEY_SIZE = ed25519.PublicKeySize // Size of the public keys of the signers, in bytes
+	SIGNATURE_SIZE            = ed25519.SignatureSize // Size of the signatures, in bytes
+
+	FILE_BLOCK_SIGNATURE_SIZE = SIGNATURE_PUBLIC_KEY_SIZE + SIGNATURE_SIZE // Size of the signature extension of block-encrypted files, in bytes
+)
+
+// Signature wrapper method
+// Header: Public key of the signer (32 bytes)
+// Body: Cipher text of another method + Signature (64 bytes)
+// When decrypting, the signature is checked against the public key in the header, so it detects modifications,
+// but does not prove who signed the data. Use VerifyFileContentsSignature with the trusted public keys for that.
+type signature_method struct{}
+
+func (m *signature_method) ID() FileEncryptionMethod {
+	return SIGNATURE_WRAPPER
+}
+
+func (m *signature_method) HeaderSize() int {
+	return SIGNATURE_PUBLIC_KEY_SIZE
+}
+
+func (m *signature_method) Encrypt(data []byte, key []byte) ([]byte, []byte, error) {
+	// It requires a private key, use EncryptOptions.Signer or SignFileContents
+	return nil, nil, ErrUnsupported
+}
+
+func (m *signature_method) Decrypt(header []byte, body []byte, key []byte) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, 0)
+}
+
+func (m *signature_method) DecryptLimited(header []byte, body []byte, key []byte, max_size int64) ([]byte, error) {
+	return m.DecryptWithAD(header, body, key, nil, max_size)
+}
+
+func (m *signature_method) EncryptWithAD(data []byte, key []byte, ad []byte, level int) ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupported
+}
+
+func (m *signature_method) DecryptWithAD(header []byte, body []byte, key []byte, ad []byte, max_size int64) ([]byte, error) {
+	inner, err := verify_signed_body(header, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptFileContentsWithOptions(inner, key, DecryptOptions{MaxPlaintextSize: max_size, AssociatedData: ad})
+}
+
+// Returns the message signed for a cipher text
+// public_key - Public key of the signer
+// inner - Wrapped cipher text
+func signature_message(public_key []byte, inner []byte) []byte {
+	label := []byte("encrypted-storage signature")
+
+	message := make([]byte, 0, len(label)+2+len(public_key)+len(inner))
+	message = append(message, label...)
+	message = binary.BigEndian.AppendUint16(message, uint16(SIGNATURE_WRAPPER))
+	message = append(message, public_key...)
+	message = append(message, inner...)
+
+	return message
+}
+
+// Checks the signature of a signed cipher text, using the public key in its header
+// header - Header (public key of the signer)
+// body - Body (wrapped cipher text + signature)
+// Returns the wrapped cipher text
+func verify_signed_body(header []byte, body []byte) ([]byte, error) {
+	if len(body) < SIGNATURE_SIZE {
+		return nil, ErrTruncatedData
+	}
+
+	inner := body[:len(body)-SIGNATURE_SIZE]
+	signature := body[len(body)-SIGNATURE_SIZE:]
+
+	if !ed25519.Verify(ed25519.PublicKey(header), signature_message(header, inner), signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	if len(inner) >= 2 && FileEncryptionMethod(binary.BigEndian.Uint16(inner[:2])) == SIGNATURE_WRAPPER {
+		// Do not allow nested signatures
+		return nil, ErrInvalidData
+	}
+
+	return inner, nil
+}
+
+// Removes the signature from a signed cipher text, after checking it
+// data - Cipher text. If it is not signed, it is returned as it is
+// Returns the wrapped cipher text
+func strip_signature(data []byte) ([]byte, error) {
+	if len(data) < 2 || FileEncryptionMethod(binary.BigEndian.Uint16(data[:2])) != SIGNATURE_WRAPPER {
+		return data, nil
+	}
+
+	if len(data) < 2+SIGNATURE_PUBLIC_KEY_SIZE {
+		return nil, ErrTruncatedData
+	}
+
+	return verify_signed_body(data[2:2+SIGNATURE_PUBLIC_KEY_SIZE], data[2+SIGNATURE_PUBLIC_KEY_SIZE:])
+}
+
+// Checks a signer is trusted
+// public_key - Public key of the signer
+// trusted - Trusted public keys
+// Returns the trusted public key, or ErrUntrustedSigner
+func find_trusted_signer(public_key []byte, trusted []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	for _, t := range trusted {
+		if len(t) == len(public_key) && subtle.ConstantTimeCompare(t, public_key) == 1 {
+			return t, nil
+		}
+	}
+
+	return nil, ErrUntrustedSigner
+}
+
+// Signs a cipher text, adding the public key of the signer and a signature trailer (SIGNATURE_WRAPPER method)
+// The signed cipher text can be decrypted the same way as the original one.
+// cipher_text - Cipher text returned by any of the encryption functions. Must not be already signed.
+// private_key - Private key of the signer
+// Returns the signed cipher text
+func SignFileContents(cipher_text []byte, private_key ed25519.PrivateKey) ([]byte, error) {
+	if len(private_key) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	if len(cipher_text) >= 2 && FileEncryptionMethod(binary.BigEndian.Uint16(cipher_text[:2])) == SIGNATURE_WRAPPER {
+		return nil, ErrInvalidMethod
+	}
+
+	public_key := private_key.Public().(ed25519.PublicKey)
+
+	signature := ed25519.Sign(private_key, signature_message(public_key, cipher_text))
+
+	result := make([]byte, 2, 2+SIGNATURE_PUBLIC_KEY_SIZE+len(cipher_text)+SIGNATURE_SIZE)
+	binary.BigEndian.PutUint16(result, uint16(SIGNATURE_WRAPPER))
+
+	result = append(result, public_key...)
+	result = append(result, cipher_text...)
+	result = append(result, signature...)
+
+	return result, nil
+}
+
+// Verifies the signature of a cipher text, without decrypting it
+// data - Signed cipher text
+// trusted - Public keys of the trusted signers
+// Returns the public key of the signer.
+// If the data is not signed, returns ErrNotSigned. If the signature is not valid, returns ErrInvalidSignature.
+// If the signer is not trusted, returns ErrUntrustedSigner.
+func VerifyFileContentsSignature(data []byte, trusted []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	if len(data) < 2 || FileEncryptionMethod(binary.BigEndian.Uint16(data[:2])) != SIGNATURE_WRAPPER {
+		return nil, ErrNotSigned
+	}
+
+	_, err := strip_signature(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return find_trusted_signer(data[2:2+SIGNATURE_PUBLIC_KEY_SIZE], trusted)
+}
+
+// Returns the message signed for a block-encrypted file
+// public_key - Public key of the signer
+// header - Fixed header (40 bytes)
+// index_hash - SHA-256 hash of the block index
+// blocks_hash - SHA-256 hash of the blocks
+func file_block_signature_message(public_key []byte, header []byte, index_hash []byte, blocks_hash []byte) []byte {
+	label := []byte("encrypted-storage block file signature")
+
+	message := make([]byte, 0, len(label)+len(public_key)+len(header)+len(index_hash)+len(blocks_hash))
+	message = append(message, label...)
+	message = append(message, public_key...)
+	message = append(message, header...)
+	message = append(message, index_hash...)
+	message = append(message, blocks_hash...)
+
+	return message
+}
+
+// Verifies the signature of a block-encrypted file, without decrypting it
+// file - Path to the file
+// trusted - Public keys of the trusted signers
+// Returns the public key of the signer.
+// If the file is not signed, returns ErrNotSigned. If the signature is not valid, returns ErrInvalidSignature.
+// If the signer is not trusted, returns ErrUntrustedSigner.
+func VerifyFileBlockEncryptSignature(file string, trusted []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	f, size, err := open_storage_file(file, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return VerifyFileBlockEncryptSignatureFrom(f, size, trusted)
+}
+
+// Verifies the signature of a block-encrypted file, without decrypting it,
+// reading from an already open file, a buffer, or a file of a storage backend
+// r - Source
+// size - Size of the source, in bytes
+// trusted - Public keys of the trusted signers
+// Returns the public key of the signer, or an error (see VerifyFileBlockEncryptSignature)
+func VerifyFileBlockEncryptSignatureFrom(r io.ReaderAt, size int64, trusted []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	if size < 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	f := io.NewSectionReader(r, 0, size)
+
+	header := make([]byte, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE)
+
+	_, err := io.ReadFull(f, header)
+
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Too small for the authenticated format
+			return nil, ErrNotSigned
+		}
+
+		return nil, err
+	}
+
+	if !bytes.Equal(header[0:4], file_block_authenticated_magic) {
+		// Only the authenticated format can be signed
+		return nil, ErrNotSigned
+	}
+
+	if header[4] != file_block_authenticated_version {
+		return nil, ErrInvalidData
+	}
+
+	extensions := make([]byte, binary.BigEndian.Uint16(header[6:8]))
+
+	_, err = io.ReadFull(f, extensions)
+
+	if err != nil {
+		return nil, read_full_error(err)
+	}
+
+	value, _, ok := find_header_extension(extensions, FILE_BLOCK_EXTENSION_SIGNATURE)
+
+	if !ok {
+		return nil, ErrNotSigned
+	}
+
+	if len(value) != FILE_BLOCK_SIGNATURE_SIZE {
+		return nil, ErrInvalidData
+	}
+
+	public_key := value[:SIGNATURE_PUBLIC_KEY_SIZE]
+	signature := value[SIGNATURE_PUBLIC_KEY_SIZE:]
+
+	index_hash := sha256.New()
+	blocks_hash := sha256.New()
+
+	if header[5]&FILE_BLOCK_FLAG_FOOTER_INDEX != 0 {
+		// Hash the blocks, and the footer (rest of the file)
+		footer_pt, err := find_file_block_footer(f, size, FILE_BLOCK_AUTHENTICATED_HEADER_SIZE+int64(len(extensions)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.CopyN(blocks_hash, f, footer_pt-FILE_BLOCK_AUTHENTICATED_HEADER_SIZE-int64(len(extensions)))
+
+		if err != nil {
+			return nil, read_full_error(err)
+		}
+
+		_, err = io.Copy(index_hash, f)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		file_size := int64(binary.BigEndian.Uint64(header[8:16]))
+		block_size := int64(binary.BigEndian.Uint64(header[16:24]))
+
+		if file_size < 0 || block_size <= 0 {
+			return nil, ErrInvalidData
+		}
+
+		block_count := file_size / block_size
+
+		if file_size%block_size != 0 {
+			block_count++
+		}
+
+		// Hash the block index, and the blocks (rest of the file)
+
+		_, err = io.CopyN(index_hash, f, block_count*16)
+
+		if err != nil {
+			return nil, read_full_error(err)
+		}
+
+		_, err = io.Copy(blocks_hash, f)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	message := file_block_signature_message(public_key, header, index_hash.Sum(nil), blocks_hash.Sum(nil))
+
+	if !ed25519.Verify(ed25519.PublicKey(public_key), message, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	return find_trusted_signer(public_key, trusted)
+}
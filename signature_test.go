@@ -0,0 +1,308 @@
+// Signatures (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSignatureFileContents(t *testing.T) {
+	node_public, node_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other_public, _, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := test_random_key()
+	original := []byte("Test data signed by an ingest node")
+	ad := []byte("file-id")
+
+	signed, err := EncryptFileContentsWithOptions(original, AES256_GCM_ZIP, key, EncryptOptions{Signer: node_private, AssociatedData: ad})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	signer, err := VerifyFileContentsSignature(signed, []ed25519.PublicKey{other_public, node_public})
+
+	if err != nil {
+		t.Error(err)
+	} else if !signer.Equal(node_public) {
+		t.Errorf("Expected the signer to be the node")
+	}
+
+	_, err = VerifyFileContentsSignature(signed, []ed25519.PublicKey{other_public})
+
+	if !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("Expected ErrUntrustedSigner, but got (%v)", err)
+	}
+
+	// Signed data is decrypted the same way
+
+	decrypted, err := DecryptFileContentsWithAD(signed, key, ad)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	// Any modification is detected
+
+	modified := bytes.Clone(signed)
+	modified[len(modified)-SIGNATURE_SIZE-1] ^= 0x01
+
+	_, err = VerifyFileContentsSignature(modified, []ed25519.PublicKey{node_public})
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for modified data, but got (%v)", err)
+	}
+
+	_, err = DecryptFileContentsWithAD(modified, key, ad)
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature when decrypting modified data, but got (%v)", err)
+	}
+
+	// Data not signed
+
+	unsigned, err := EncryptFileContents(original, AES256_GCM, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileContentsSignature(unsigned, []ed25519.PublicKey{node_public})
+
+	if !errors.Is(err, ErrNotSigned) {
+		t.Errorf("Expected ErrNotSigned, but got (%v)", err)
+	}
+
+	// Keyring and recipients
+
+	keyring := NewKeyring()
+	_, err = keyring.Add(key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	signed, err = EncryptFileContentsWithKeyringOptions(original, AES256_GCM, keyring, EncryptOptions{Signer: node_private})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err = DecryptFileContentsWithKeyring(signed, keyring)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Keyring: Decrypted data does not match the original data")
+	}
+
+	identity, err := GenerateX25519Identity()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	signed, err = EncryptFileContentsToRecipientsWithOptions(original, AES256_GCM, []Recipient{identity.Recipient()}, EncryptOptions{Signer: node_private})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileContentsSignature(signed, []ed25519.PublicKey{node_public})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	decrypted, err = DecryptFileContentsWithIdentities(signed, []Identity{identity})
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(decrypted, original) {
+		t.Errorf("Recipients: Decrypted data does not match the original data")
+	}
+}
+
+func TestSignatureFileBlockEncrypt(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_signed")
+	defer os.Remove(test_file)
+
+	node_public, node_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := test_random_key()
+	new_key := test_random_key()
+
+	original := make([]byte, 1000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	ws, err := CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithOptions(int64(len(original)), 256, key, FileBlockEncryptOptions{Envelope: true, Signer: node_private})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	signer, err := VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if err != nil {
+		t.Error(err)
+	} else if !signer.Equal(node_public) {
+		t.Errorf("Expected the signer to be the node")
+	}
+
+	// Changing the master key does not invalidate the signature
+
+	err = RewrapFileBlockEncryptKey(test_file, key, new_key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	rs, err := CreateFileBlockEncryptReadStream(test_file, new_key, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := io.ReadAll(rs)
+	rs.Close()
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	// Modify the last block
+
+	contents, err := os.ReadFile(test_file)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	contents[len(contents)-1] ^= 0x01
+
+	err = os.WriteFile(test_file, contents, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a modified file, but got (%v)", err)
+	}
+
+	// File not signed
+
+	ws, err = CreateFileBlockEncryptWriteStream(test_file, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithOptions(int64(len(original)), 256, key, FileBlockEncryptOptions{Authenticated: true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = VerifyFileBlockEncryptSignature(test_file, []ed25519.PublicKey{node_public})
+
+	if !errors.Is(err, ErrNotSigned) {
+		t.Errorf("Expected ErrNotSigned, but got (%v)", err)
+	}
+}
@@ -0,0 +1,628 @@
+// Storage backends, where the encrypted files are stored
+// The streams read and write at any position (io.ReaderAt, io.WriterAt), so they do not depend on the file system:
+// they can use an already open file, a buffer in memory, or any storage supporting random access.
+// A backend creates and opens files by name. OSBackend uses the file system, and MemoryBackend keeps them in memory.
+
+package encrypted_storage
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	MEMORY_FILE_MAX_SIZE = 16 * 1024 * 1024 * 1024 // Max size of a file in memory (16 GiB)
+)
+
+// Storage backend
+type Backend interface {
+	// Creates a file for writing, truncating it if it exists
+	Create(name string) (BackendFile, error)
+
+	// Opens a file for reading. Writing into it fails
+	Open(name string) (BackendFile, error)
+
+	// Opens an existing file for reading and writing, without truncating it
+	OpenRW(name string) (BackendFile, error)
+
+	// Removes a file
+	Remove(name string) error
+
+	// Returns information about a file (fs.ErrNotExist if it does not exist)
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// File of a storage backend (*os.File implements it)
+type BackendFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// Changes the size of the file
+	Truncate(size int64) error
+
+	// Returns information about the file, including its size
+	Stat() (fs.FileInfo, error)
+}
+
+// Reader and writer at any position, to modify the header of a file in place
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Destination that can be truncated (the write streams truncate it on Initialize)
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// Destination of a write stream, written with a cursor, or at any position
+type write_seeker_at interface {
+	io.Writer
+	io.Seeker
+	io.WriterAt
+}
+
+// Source of a read stream, closed with it
+type storage_reader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Function to open the source of a read stream
+// Returns the source and its size
+type storage_opener func() (storage_reader, int64, error)
+
+// Closes a file owned by a stream
+// c - File (nil if the stream does not own it)
+func close_storage(c io.Closer) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.Close()
+}
+
+// Reads from a position, filling the buffer
+// r - Source
+// p - Buffer to fill
+// off - Position
+// Returns ErrTruncatedData if the source ends before filling the buffer
+func read_at(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+
+	if n == len(p) {
+		// The source may return io.EOF along with the last bytes
+		return nil
+	}
+
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return read_full_error(err)
+}
+
+// Opens a file for reading
+// file - Path to the file
+// perm - File mode
+// Returns the file and its size
+func open_storage_file(file string, perm fs.FileMode) (storage_reader, int64, error) {
+	f, err := os.OpenFile(file, os.O_RDONLY, perm)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, stat.Size(), nil
+}
+
+// Returns a function opening a file for reading
+// file - Path to the file
+// perm - File mode
+func storage_file_opener(file string, perm fs.FileMode) storage_opener {
+	return func() (storage_reader, int64, error) {
+		return open_storage_file(file, perm)
+	}
+}
+
+// Returns a function opening a file of a backend for reading
+// backend - Backend
+// name - Name of the file
+func backend_file_opener(backend Backend, name string) storage_opener {
+	return func() (storage_reader, int64, error) {
+		f, err := backend.Open(name)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		stat, err := f.Stat()
+
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+
+		return f, stat.Size(), nil
+	}
+}
+
+//////////////////////////
+//  SEQUENTIAL WRITER  //
+/////////////////////////
+
+// Destination written sequentially, for the streams writing into an io.Writer
+// Positions are relative to the position of the writer when the stream starts writing
+// If the writer implements io.Seeker, any position can be written. Otherwise, only the current one (ErrInvalidArgument is returned for the rest).
+type sequential_writer struct {
+	w io.Writer // Writer
+	s io.Seeker // Writer, if it can seek (nil otherwise)
+
+	has_start bool  // True if start is set
+	start     int64 // Position of the writer where the stream starts (seekable writers only)
+
+	pos int64 // Current position, relative to start
+}
+
+// Creates a sequential destination
+// w - Writer
+func new_sequential_writer(w io.Writer) *sequential_writer {
+	s, _ := w.(io.Seeker)
+
+	return &sequential_writer{
+		w: w,
+		s: s,
+	}
+}
+
+// Returns true if any position can be written
+func (sw *sequential_writer) seekable() bool {
+	return sw.s != nil
+}
+
+// Writes at the current position
+// p - Data to write
+func (sw *sequential_writer) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.pos += int64(n)
+
+	return n, err
+}
+
+// Moves the current position
+// offset - Position
+// whence - Reference of the position (io.SeekStart or io.SeekCurrent)
+func (sw *sequential_writer) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = sw.pos + offset
+	default:
+		return 0, ErrInvalidArgument
+	}
+
+	if pos == sw.pos {
+		return pos, nil
+	}
+
+	if sw.s == nil || pos < 0 {
+		return 0, ErrInvalidArgument
+	}
+
+	err := sw.seek_writer(pos)
+
+	if err != nil {
+		return 0, err
+	}
+
+	sw.pos = pos
+
+	return pos, nil
+}
+
+// Writes at a position, keeping the current one
+// p - Data to write
+// off - Position
+func (sw *sequential_writer) WriteAt(p []byte, off int64) (int, error) {
+	if off == sw.pos {
+		return sw.Write(p)
+	}
+
+	if sw.s == nil || off < 0 {
+		return 0, ErrInvalidArgument
+	}
+
+	err := sw.seek_writer(off)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := sw.w.Write(p)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, sw.seek_writer(sw.pos)
+}
+
+// Moves the position of the writer (seekable writers only)
+// pos - Position, relative to start
+func (sw *sequential_writer) seek_writer(pos int64) error {
+	if !sw.has_start {
+		start, err := sw.s.Seek(0, io.SeekCurrent)
+
+		if err != nil {
+			return err
+		}
+
+		sw.start = start - sw.pos
+		sw.has_start = true
+	}
+
+	_, err := sw.s.Seek(sw.start+pos, io.SeekStart)
+
+	return err
+}
+
+//////////////////////////
+//     OS BACKEND      //
+/////////////////////////
+
+// Backend storing the files in a directory of the file system
+type OSBackend struct {
+	Dir  string      // Directory. Names are relative to it, and cannot contain ".." elements
+	Perm fs.FileMode // File mode for the created files (0600 if not set)
+}
+
+// Returns the path of a file
+// name - Name of the file
+func (b *OSBackend) path(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", ErrInvalidArgument
+	}
+
+	return filepath.Join(b.Dir, filepath.FromSlash(name)), nil
+}
+
+// Creates a file for writing, truncating it if it exists
+// name - Name of the file
+func (b *OSBackend) Create(name string) (BackendFile, error) {
+	p, err := b.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	perm := b.Perm
+
+	if perm == 0 {
+		perm = 0600
+	}
+
+	return os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// Opens a file for reading
+// name - Name of the file
+func (b *OSBackend) Open(name string) (BackendFile, error) {
+	p, err := b.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+// Opens an existing file for reading and writing, without truncating it
+// name - Name of the file
+func (b *OSBackend) OpenRW(name string) (BackendFile, error) {
+	p, err := b.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(p, os.O_RDWR, 0)
+}
+
+// Removes a file
+// name - Name of the file
+func (b *OSBackend) Remove(name string) error {
+	p, err := b.path(name)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+// Returns information about a file
+// name - Name of the file
+func (b *OSBackend) Stat(name string) (fs.FileInfo, error) {
+	p, err := b.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(p)
+}
+
+//////////////////////////
+//   MEMORY BACKEND    //
+/////////////////////////
+
+// Backend keeping the files in memory, for tests or temporary data
+// It is safe for concurrent use
+type MemoryBackend struct {
+	mu    sync.Mutex             // Mutex
+	files map[string]*MemoryFile // Files
+}
+
+// Creates a backend keeping the files in memory
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files: make(map[string]*MemoryFile),
+	}
+}
+
+// Creates a file for writing, replacing it if it exists
+// Files already open keep the previous contents
+// name - Name of the file
+func (b *MemoryBackend) Create(name string) (BackendFile, error) {
+	f := NewMemoryFile(name, nil)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.files[name] = f
+
+	return f, nil
+}
+
+// Opens a file for reading. Writing into it fails with fs.ErrPermission
+// name - Name of the file
+func (b *MemoryBackend) Open(name string) (BackendFile, error) {
+	f, err := b.open(name, "open")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &memory_file_reader{f}, nil
+}
+
+// Opens an existing file for reading and writing, without truncating it
+// Writes are visible to any other user of the file
+// name - Name of the file
+func (b *MemoryBackend) OpenRW(name string) (BackendFile, error) {
+	return b.open(name, "open")
+}
+
+// Finds a file
+// name - Name of the file
+// op - Operation, for the error
+func (b *MemoryBackend) open(name string, op string) (*MemoryFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, ok := b.files[name]
+
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return f, nil
+}
+
+// Removes a file
+// name - Name of the file
+func (b *MemoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	delete(b.files, name)
+
+	return nil
+}
+
+// Returns information about a file
+// name - Name of the file
+func (b *MemoryBackend) Stat(name string) (fs.FileInfo, error) {
+	f, err := b.open(name, "stat")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Stat()
+}
+
+// File in memory
+// It can be used directly with the streams, since it implements io.ReaderAt and io.WriterAt
+// It is safe for concurrent use
+type MemoryFile struct {
+	mu sync.RWMutex // Mutex
+
+	name     string    // Name of the file
+	data     []byte    // Contents
+	mod_time time.Time // Time of the last modification
+}
+
+// Creates a file in memory
+// name - Name of the file, reported by Stat
+// data - Initial contents (copied)
+func NewMemoryFile(name string, data []byte) *MemoryFile {
+	return &MemoryFile{
+		name:     name,
+		data:     append([]byte(nil), data...),
+		mod_time: time.Now(),
+	}
+}
+
+// Returns a copy of the contents of the file
+func (f *MemoryFile) Bytes() []byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return append([]byte(nil), f.data...)
+}
+
+// Returns the size of the file
+func (f *MemoryFile) Size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return int64(len(f.data))
+}
+
+// Reads from a position of the file (implements io.ReaderAt)
+// p - Buffer to fill
+// off - Position
+func (f *MemoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off < 0 {
+		return 0, ErrInvalidArgument
+	}
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Writes at a position of the file (implements io.WriterAt)
+// The file grows if needed, filling any gap with zeros, up to MEMORY_FILE_MAX_SIZE
+// p - Data to write
+// off - Position
+func (f *MemoryFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off < 0 || off > math.MaxInt64-int64(len(p)) || off+int64(len(p)) > MEMORY_FILE_MAX_SIZE {
+		return 0, ErrInvalidArgument
+	}
+
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+
+	f.mod_time = time.Now()
+
+	return copy(f.data[off:], p), nil
+}
+
+// Changes the size of the file, filling with zeros if it grows
+// size - New size
+func (f *MemoryFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size < 0 || size > MEMORY_FILE_MAX_SIZE {
+		return ErrInvalidArgument
+	}
+
+	f.resize(size)
+	f.mod_time = time.Now()
+
+	return nil
+}
+
+// Resizes the contents (the mutex must be held)
+// size - New size
+func (f *MemoryFile) resize(size int64) {
+	if size <= int64(len(f.data)) {
+		clear(f.data[size:])
+		f.data = f.data[:size]
+		return
+	}
+
+	if size <= int64(cap(f.data)) {
+		f.data = f.data[:size]
+		return
+	}
+
+	data := make([]byte, size, max(size, min(2*int64(cap(f.data)), MEMORY_FILE_MAX_SIZE)))
+	copy(data, f.data)
+
+	f.data = data
+}
+
+// Returns information about the file
+func (f *MemoryFile) Stat() (fs.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return &memory_file_info{
+		name:     f.name,
+		size:     int64(len(f.data)),
+		mod_time: f.mod_time,
+	}, nil
+}
+
+// Closes the file. The contents are kept until it is removed from the backend
+func (f *MemoryFile) Close() error {
+	return nil
+}
+
+// File in memory, opened for reading
+type memory_file_reader struct {
+	*MemoryFile
+}
+
+// Fails, since the file is opened for reading
+func (f *memory_file_reader) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+// Fails, since the file is opened for reading
+func (f *memory_file_reader) Truncate(size int64) error {
+	return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
+}
+
+// Information about a file in memory (implements fs.FileInfo)
+type memory_file_info struct {
+	name     string    // Name
+	size     int64     // Size
+	mod_time time.Time // Time of the last modification
+}
+
+func (i *memory_file_info) Name() string       { return i.name }
+func (i *memory_file_info) Size() int64        { return i.size }
+func (i *memory_file_info) Mode() fs.FileMode  { return 0600 }
+func (i *memory_file_info) ModTime() time.Time { return i.mod_time }
+func (i *memory_file_info) IsDir() bool        { return false }
+func (i *memory_file_info) Sys() any           { return nil }
@@ -0,0 +1,873 @@
+// Storage backends (Test)
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMemoryFile(t *testing.T) {
+	f := NewMemoryFile("test", []byte("0123456789"))
+
+	_, err := f.WriteAt([]byte("AB"), 12)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(f.Bytes(), []byte("0123456789\x00\x00AB")) {
+		t.Errorf("Unexpected contents: %q", f.Bytes())
+	}
+
+	buf := make([]byte, 4)
+	n, err := f.ReadAt(buf, 12)
+
+	if n != 2 || err != io.EOF || !bytes.Equal(buf[:n], []byte("AB")) {
+		t.Errorf("Expected to read 2 bytes and io.EOF, but got %d (%v)", n, err)
+	}
+
+	err = f.Truncate(4)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = f.Truncate(6)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		t.Error(err)
+	} else if stat.Name() != "test" || stat.Size() != 6 || !bytes.Equal(f.Bytes(), []byte("0123\x00\x00")) {
+		t.Errorf("Unexpected contents after truncating: %q", f.Bytes())
+	}
+
+	// Writing past the max size fails, without allocating or overflowing the end position
+
+	for _, off := range []int64{-1, MEMORY_FILE_MAX_SIZE, math.MaxInt64 - 1, math.MaxInt64} {
+		_, err = f.WriteAt([]byte("AB"), off)
+
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Offset %d: Expected ErrInvalidArgument, but got (%v)", off, err)
+		}
+	}
+
+	err = f.Truncate(MEMORY_FILE_MAX_SIZE + 1)
+
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument, but got (%v)", err)
+	}
+
+	if f.Size() != 6 {
+		t.Errorf("Expected the size to be unchanged, but got %d", f.Size())
+	}
+
+	// Backend
+
+	backend := NewMemoryBackend()
+
+	_, err = backend.Open("missing")
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, but got (%v)", err)
+	}
+
+	created, err := backend.Create("file")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = created.WriteAt([]byte("data"), 0)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stat, err = backend.Stat("file")
+
+	if err != nil {
+		t.Error(err)
+	} else if stat.Size() != 4 {
+		t.Errorf("Expected a size of 4, but got %d", stat.Size())
+	}
+
+	// Files opened for reading cannot be modified
+
+	read_only, err := backend.Open("file")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_only.WriteAt([]byte("x"), 0)
+
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission, but got (%v)", err)
+	}
+
+	read_write, err := backend.OpenRW("file")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = read_write.WriteAt([]byte("D"), 0)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(created.(*MemoryFile).Bytes(), []byte("Data")) {
+		t.Errorf("Expected the file to be modified in place")
+	}
+
+	_, err = backend.OpenRW("missing")
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, but got (%v)", err)
+	}
+
+	err = backend.Remove("file")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = backend.Stat("file")
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist after removing the file, but got (%v)", err)
+	}
+
+	// OS backend
+
+	os_backend := &OSBackend{Dir: "./temp"}
+
+	_, err = os_backend.Create("../outside")
+
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected ErrInvalidArgument for a name outside the directory, but got (%v)", err)
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	err := os.MkdirAll("./temp", 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := test_random_key()
+	new_key := test_random_key()
+
+	signer_public, signer_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := make([]byte, 5000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, backend := range []Backend{NewMemoryBackend(), &OSBackend{Dir: "./temp"}} {
+		defer backend.Remove("test_backend_block_file")
+		defer backend.Remove("test_backend_pack")
+
+		for _, options := range []FileBlockEncryptOptions{
+			{},
+			{Authenticated: true, Workers: 2},
+			{UnknownSize: true},
+			{Envelope: true, Signer: signer_private},
+		} {
+			// Write a bigger file first, so the stream must truncate it
+			f, err := backend.Create("test_backend_block_file")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			_, err = f.WriteAt(make([]byte, 3*len(original)), 0)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			ws := NewFileBlockEncryptWriteStream(f)
+
+			err = ws.InitializeWithOptions(int64(len(original)), 1000, key, options)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			_, err = ws.Write(original)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			err = ws.Close()
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			// The file is not closed with the stream
+			_, err = f.Stat()
+
+			if err != nil {
+				t.Errorf("Expected the file to be open, but got (%v)", err)
+			}
+
+			f.Close()
+
+			read_key := key
+
+			if options.Envelope {
+				// Files opened with OpenRW can be modified in place
+				err = RewrapFileBlockEncryptKeyInBackend(backend, "test_backend_block_file", key, new_key)
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				read_key = new_key
+			}
+
+			f, err = backend.Open("test_backend_block_file")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			stat, err := f.Stat()
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			rs, err := NewFileBlockEncryptReadStream(f, stat.Size(), read_key)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			data, err := io.ReadAll(rs)
+
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(data, original) {
+				t.Errorf("Decrypted data does not match the original data (%+v)", options)
+			}
+
+			rs.Close()
+
+			if options.Signer != nil {
+				_, err = VerifyFileBlockEncryptSignatureFrom(f, stat.Size(), []ed25519.PublicKey{signer_public})
+
+				if err != nil {
+					t.Errorf("Expected a valid signature, but got (%v)", err)
+				}
+			}
+
+			f.Close()
+		}
+
+		// Pack
+
+		f, err := backend.Create("test_backend_pack")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		pws := NewMultiFilePackWriteStream(f)
+
+		err = pws.InitializeWithOptions(2, MultiFilePackOptions{Key: key})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, content := range [][]byte{[]byte("File 1"), original} {
+			err = pws.PutFile(content)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		err = pws.Close()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		f.Close()
+
+		f, err = backend.Open("test_backend_pack")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		stat, err := f.Stat()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		prs, err := NewMultiFilePackReadStreamWithKey(f, stat.Size(), key)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		data, err := prs.GetFile(1)
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Pack file does not match the original data")
+		}
+
+		prs.Close()
+		f.Close()
+	}
+}
+
+func TestStorageOpenFile(t *testing.T) {
+	test_path_base := "./temp"
+
+	err := os.MkdirAll(test_path_base, 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	test_file := path.Join(test_path_base, "test_block_file_open")
+	defer os.Remove(test_file)
+
+	key := test_random_key()
+	original := []byte("Test data written into an already open file")
+
+	f, err := os.OpenFile(test_file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer f.Close()
+
+	ws := NewFileBlockEncryptWriteStream(f)
+
+	err = ws.Initialize(int64(len(original)), 16, key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ws.Write(original)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The descriptor is still open, so it can be read with the same descriptor
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rs, err := NewFileBlockEncryptReadStream(f, stat.Size(), key)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer rs.Close()
+
+	data, err := io.ReadAll(rs)
+
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(data, original) {
+		t.Errorf("Decrypted data does not match the original data")
+	}
+
+	// Truncated sources are detected
+
+	_, err = NewFileBlockEncryptReadStream(bytes.NewReader(nil), 0, key)
+
+	if !errors.Is(err, ErrTruncatedData) {
+		t.Errorf("Expected ErrTruncatedData for an empty source, but got (%v)", err)
+	}
+}
+
+func TestStorageBackendConstructors(t *testing.T) {
+	err := os.MkdirAll("./temp", 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := test_random_key()
+
+	secret_key, err := NewSecretKey(bytes.Clone(key))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer secret_key.Destroy()
+
+	original := make([]byte, 5000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, backend := range []Backend{NewMemoryBackend(), &OSBackend{Dir: "./temp"}} {
+		defer backend.Remove("test_backend_constructors_block_file")
+		defer backend.Remove("test_backend_constructors_pack")
+
+		ws, err := OpenFileBlockEncryptWriteStream(backend, "test_backend_constructors_block_file")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ws.InitializeWithOptions(int64(len(original)), 1000, key, FileBlockEncryptOptions{Authenticated: true})
+
+		if err == nil {
+			_, err = ws.Write(original)
+		}
+
+		if err != nil {
+			ws.Close()
+			t.Error(err)
+			return
+		}
+
+		err = ws.Close()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, open := range []func() (*FileBlockEncryptReadStream, error){
+			func() (*FileBlockEncryptReadStream, error) {
+				return OpenFileBlockEncryptReadStream(backend, "test_backend_constructors_block_file", key)
+			},
+			func() (*FileBlockEncryptReadStream, error) {
+				return OpenFileBlockEncryptReadStreamWithSecretKey(backend, "test_backend_constructors_block_file", secret_key)
+			},
+		} {
+			rs, err := open()
+
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+
+			data, err := io.ReadAll(rs)
+
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(data, original) {
+				t.Errorf("Decrypted data does not match the original data")
+			}
+
+			rs.Close()
+		}
+
+		_, err = OpenFileBlockEncryptReadStream(backend, "missing", key)
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist, but got (%v)", err)
+		}
+
+		// Pack
+
+		pws, err := OpenMultiFilePackWriteStream(backend, "test_backend_constructors_pack")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = pws.InitializeWithOptions(1, MultiFilePackOptions{Key: key})
+
+		if err == nil {
+			err = pws.PutFile(original)
+		}
+
+		if err != nil {
+			pws.Close()
+			t.Error(err)
+			return
+		}
+
+		err = pws.Close()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		prs, err := OpenMultiFilePackReadStreamWithSecretKey(backend, "test_backend_constructors_pack", secret_key)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		data, err := prs.GetFile(0)
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Pack file does not match the original data")
+		}
+
+		prs.Close()
+	}
+}
+
+func TestFileBlockEncryptSequentialWriteStream(t *testing.T) {
+	err := os.MkdirAll("./temp", 0700)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key := test_random_key()
+
+	signer_public, signer_private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	original := make([]byte, 5000)
+	_, err = rand.Read(original)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Writer that cannot seek
+
+	for _, options := range []FileBlockEncryptOptions{
+		{UnknownSize: true},
+		{UnknownSize: true, Workers: 2, Method: AES256_GCM},
+	} {
+		var buf bytes.Buffer
+
+		ws := NewFileBlockEncryptSequentialWriteStream(&buf)
+
+		err = ws.InitializeWithOptions(0, 1000, key, options)
+
+		if err == nil {
+			_, err = ws.Write(original)
+		}
+
+		if err != nil {
+			ws.Close()
+			t.Error(err)
+			continue
+		}
+
+		err = ws.Close()
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		rs, err := NewFileBlockEncryptReadStream(bytes.NewReader(buf.Bytes()), int64(buf.Len()), key)
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		data, err := io.ReadAll(rs)
+
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data (%+v)", options)
+		}
+
+		rs.Close()
+	}
+
+	for _, options := range []FileBlockEncryptOptions{
+		{},
+		{UnknownSize: true, Signer: signer_private},
+	} {
+		ws := NewFileBlockEncryptSequentialWriteStream(&bytes.Buffer{})
+
+		err = ws.InitializeWithOptions(int64(len(original)), 1000, key, options)
+
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Expected ErrInvalidArgument for a writer that cannot seek, but got (%v)", err)
+		}
+	}
+
+	// Writer that can seek, starting after some data
+
+	test_file := path.Join("./temp", "test_block_file_sequential")
+	defer os.Remove(test_file)
+
+	prefix := []byte("prefix")
+
+	for _, options := range []FileBlockEncryptOptions{
+		{},
+		{UnknownSize: true, Signer: signer_private},
+	} {
+		f, err := os.OpenFile(test_file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = f.Write(prefix)
+
+		if err != nil {
+			f.Close()
+			t.Error(err)
+			return
+		}
+
+		ws := NewFileBlockEncryptSequentialWriteStream(f)
+
+		err = ws.InitializeWithOptions(int64(len(original)), 1000, key, options)
+
+		if err == nil {
+			_, err = ws.Write(original)
+		}
+
+		if err == nil {
+			err = ws.Close()
+		} else {
+			ws.Close()
+		}
+
+		stat, stat_err := f.Stat()
+
+		if err == nil {
+			err = stat_err
+		}
+
+		if err != nil {
+			f.Close()
+			t.Error(err)
+			continue
+		}
+
+		r := io.NewSectionReader(f, int64(len(prefix)), stat.Size()-int64(len(prefix)))
+
+		rs, err := NewFileBlockEncryptReadStream(r, r.Size(), key)
+
+		if err != nil {
+			t.Error(err)
+		} else {
+			data, err := io.ReadAll(rs)
+
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(data, original) {
+				t.Errorf("Decrypted data does not match the original data (%+v)", options)
+			}
+
+			rs.Close()
+		}
+
+		if options.Signer != nil {
+			_, err = VerifyFileBlockEncryptSignatureFrom(r, r.Size(), []ed25519.PublicKey{signer_public})
+
+			if err != nil {
+				t.Errorf("Expected a valid signature, but got (%v)", err)
+			}
+		}
+
+		f.Close()
+	}
+}
+
+// Backend whose files fail to close, like an upload failing to commit
+type test_failing_close_backend struct {
+	*MemoryBackend
+}
+
+var test_close_error = errors.New("close failed")
+
+func (b *test_failing_close_backend) Create(name string) (BackendFile, error) {
+	f, err := b.MemoryBackend.Create(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &test_failing_close_file{f.(*MemoryFile)}, nil
+}
+
+type test_failing_close_file struct {
+	*MemoryFile
+}
+
+func (f *test_failing_close_file) Close() error {
+	return test_close_error
+}
+
+func TestStorageCloseError(t *testing.T) {
+	backend := &test_failing_close_backend{NewMemoryBackend()}
+	key := test_random_key()
+
+	ws, err := OpenFileBlockEncryptWriteStream(backend, "file")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Initialize(10, 16, key)
+
+	if err == nil {
+		_, err = ws.Write(make([]byte, 10))
+	}
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.Close()
+
+	if !errors.Is(err, test_close_error) {
+		t.Errorf("Expected the error closing the file, but got (%v)", err)
+	}
+
+	// The error closing the file is joined with the error of the stream
+
+	secret_key, err := GenerateSecretKey()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, err = OpenFileBlockEncryptWriteStream(backend, "file")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.InitializeWithSecretKey(10, 16, secret_key, FileBlockEncryptOptions{})
+
+	if err == nil {
+		_, err = ws.Write(make([]byte, 10))
+	}
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	secret_key.Destroy()
+
+	err = ws.Close()
+
+	if !errors.Is(err, ErrInvalidKey) || !errors.Is(err, test_close_error) {
+		t.Errorf("Expected ErrInvalidKey and the error closing the file, but got (%v)", err)
+	}
+
+	// Pack
+
+	pws, err := OpenMultiFilePackWriteStream(backend, "pack")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pws.Initialize(0)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = pws.Close()
+
+	if !errors.Is(err, test_close_error) {
+		t.Errorf("Expected the error closing the pack, but got (%v)", err)
+	}
+}
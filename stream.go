@@ -0,0 +1,384 @@
+// Streaming encryption and decryption
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	DECRYPT_READER_MAX_BUFFERED_SIZE = 64 * 1024 * 1024 // Default max size of the data buffered by NewDecryptReader, for methods not supporting streaming (64 MiB)
+)
+
+// Encryption method able to encrypt and decrypt incrementally, with bounded memory
+// Used by NewEncryptWriter and NewDecryptReader
+type StreamEncryptionMethod interface {
+	EncryptionMethod
+
+	// Creates a writer to encrypt data incrementally
+	// The method ID is already written by the caller, the method must write the header and the body
+	// w - Writer to write the header and body into
+	// key - Encryption key
+	// Returns a writer. Closing it must flush any pending data, but must not close w
+	EncryptStream(w io.Writer, key []byte) (io.WriteCloser, error)
+
+	// Creates a reader to decrypt data incrementally
+	// The method ID is already consumed by the caller, the method must read the header and the body
+	// r - Reader to read the header and body from
+	// key - Decryption key
+	// Returns a reader for the original data
+	DecryptStream(r io.Reader, key []byte) (io.Reader, error)
+}
+
+// Creates a writer to encrypt data, producing the same format as EncryptFileContents
+// If the method implements StreamEncryptionMethod, the data is encrypted incrementally, with bounded memory.
+// Otherwise, the data is buffered and encrypted when the writer is closed.
+// w - Writer to write the cipher text into
+// method - algorithm to use
+// key - Encryption key
+// Returns a writer. You must close it to write the pending data. Closing it does not close w.
+func NewEncryptWriter(w io.Writer, method FileEncryptionMethod, key []byte) (io.WriteCloser, error) {
+	return new_encrypt_writer(w, method, key, nil)
+}
+
+// Creates a writer to encrypt data with a secret key, producing the same format as EncryptFileContents
+// The writer keeps a reference to the secret key until it is closed. If the key is destroyed before, writing fails with ErrInvalidKey.
+// w - Writer to write the cipher text into
+// method - algorithm to use
+// key - Secret key
+// Returns a writer. You must close it to write the pending data. Closing it does not close w.
+func NewEncryptWriterWithSecretKey(w io.Writer, method FileEncryptionMethod, key *SecretKey) (io.WriteCloser, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	_, err := key.acquire()
+
+	if err != nil {
+		return nil, err
+	}
+
+	key.release()
+
+	return new_encrypt_writer(w, method, nil, key)
+}
+
+// Creates a writer to encrypt data
+// w - Writer to write the cipher text into
+// method - algorithm to use
+// key - Encryption key (ignored if secret_key is set)
+// secret_key - Secret key (nil if not used)
+func new_encrypt_writer(w io.Writer, method FileEncryptionMethod, key []byte, secret_key *SecretKey) (io.WriteCloser, error) {
+	m, ok := GetEncryptionMethod(method)
+
+	if !ok {
+		return nil, ErrInvalidMethod
+	}
+
+	if sm, ok := m.(StreamEncryptionMethod); ok {
+		if _, builtin := sm.(*aead_stream_method); builtin && secret_key == nil && !is_valid_key_size(len(key)) {
+			// Checked here, since the key is only used once there is data to write
+			return nil, ErrInvalidKey
+		}
+
+		return &stream_encrypt_writer{
+			w:          w,
+			method:     sm,
+			key:        key,
+			secret_key: secret_key,
+		}, nil
+	}
+
+	return &buffered_encrypt_writer{
+		w:          w,
+		method:     method,
+		key:        key,
+		secret_key: secret_key,
+	}, nil
+}
+
+// Creates a reader to decrypt data, accepting the same format as DecryptFileContents
+// If the method implements StreamEncryptionMethod, the data is decrypted incrementally, with bounded memory.
+// Otherwise, the data is fully read and decrypted before returning, up to DECRYPT_READER_MAX_BUFFERED_SIZE
+// (see NewDecryptReaderWithOptions to change the limit).
+// r - Reader to read the cipher text from
+// key - Decryption key
+// Returns a reader for the original data
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	return NewDecryptReaderWithOptions(r, key, DecryptOptions{})
+}
+
+// Creates a reader to decrypt data, with options
+// For methods not supporting streaming, the data is fully read and decrypted before returning, so the size of the cipher text
+// and the original data are limited to DECRYPT_READER_MAX_BUFFERED_SIZE, unless other limits are set in the options.
+// For methods supporting streaming, the limits are only checked if set. The reader returns a *SizeLimitError if they are exceeded.
+// r - Reader to read the cipher text from
+// key - Decryption key
+// options - Decryption options
+// Returns a reader for the original data
+func NewDecryptReaderWithOptions(r io.Reader, key []byte, options DecryptOptions) (io.Reader, error) {
+	method_bytes := make([]byte, 2)
+	_, err := io.ReadFull(r, method_bytes)
+
+	if err == io.EOF {
+		// Empty cipher text
+		return bytes.NewReader(nil), nil
+	} else if err != nil {
+		return nil, read_full_error(err)
+	}
+
+	m, ok := GetEncryptionMethod(FileEncryptionMethod(binary.BigEndian.Uint16(method_bytes)))
+
+	if !ok {
+		return nil, ErrInvalidMethod
+	}
+
+	if sm, ok := m.(StreamEncryptionMethod); ok {
+		if options.MaxCiphertextSize > 0 {
+			// The method ID is part of the cipher text
+			r = &size_limited_reader{r: r, remaining: options.MaxCiphertextSize - 2, err: &SizeLimitError{Limit: options.MaxCiphertextSize, Ciphertext: true}}
+		}
+
+		var plaintext io.Reader
+
+		if am, ok := sm.(*aead_stream_method); ok {
+			plaintext, err = am.decrypt_stream(r, key, options.AssociatedData)
+		} else if options.AssociatedData != nil {
+			return nil, ErrUnsupported
+		} else {
+			plaintext, err = sm.DecryptStream(r, key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if options.MaxPlaintextSize > 0 {
+			plaintext = &size_limited_reader{r: plaintext, remaining: options.MaxPlaintextSize, err: &SizeLimitError{Limit: options.MaxPlaintextSize}}
+		}
+
+		return plaintext, nil
+	}
+
+	// Not a streaming method, read everything
+
+	if options.MaxCiphertextSize <= 0 {
+		options.MaxCiphertextSize = DECRYPT_READER_MAX_BUFFERED_SIZE
+	}
+
+	if options.MaxPlaintextSize <= 0 {
+		options.MaxPlaintextSize = DECRYPT_READER_MAX_BUFFERED_SIZE
+	}
+
+	rest, err := io.ReadAll(&size_limited_reader{r: r, remaining: options.MaxCiphertextSize - 2, err: &SizeLimitError{Limit: options.MaxCiphertextSize, Ciphertext: true}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := DecryptFileContentsWithOptions(append(method_bytes, rest...), key, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
+
+// Creates a reader to decrypt data with a secret key, accepting the same format as DecryptFileContents
+// The key is only used while creating the reader, so it can be destroyed after this function returns.
+// r - Reader to read the cipher text from
+// key - Secret key
+// Returns a reader for the original data
+func NewDecryptReaderWithSecretKey(r io.Reader, key *SecretKey) (io.Reader, error) {
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+
+	key_bytes, err := key.acquire()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer key.release()
+
+	return NewDecryptReader(r, key_bytes)
+}
+
+// Writer for methods supporting streaming
+// The method ID and header are only written once there is data,
+// so empty data produces an empty cipher text, like EncryptFileContents
+type stream_encrypt_writer struct {
+	w          io.Writer              // Destination
+	method     StreamEncryptionMethod // Method
+	key        []byte                 // Encryption key
+	secret_key *SecretKey             // Secret key (if set, key is ignored)
+	inner      io.WriteCloser         // Method writer, nil until the first write
+	closed     bool                   // True if closed
+}
+
+func (sw *stream_encrypt_writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, ErrClosed
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if sw.inner == nil {
+		inner, err := sw.start()
+
+		if err != nil {
+			return 0, err
+		}
+
+		sw.inner = inner
+	}
+
+	return sw.inner.Write(p)
+}
+
+// Writes the method ID and creates the method writer
+func (sw *stream_encrypt_writer) start() (io.WriteCloser, error) {
+	key := sw.key
+
+	if sw.secret_key != nil {
+		// The method writer derives its own key, so the secret key is only needed here
+		key_bytes, err := sw.secret_key.acquire()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer sw.secret_key.release()
+
+		key = key_bytes
+	}
+
+	method_bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(method_bytes, uint16(sw.method.ID()))
+
+	_, err := sw.w.Write(method_bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sw.method.EncryptStream(sw.w, key)
+}
+
+func (sw *stream_encrypt_writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+
+	sw.closed = true
+
+	// Drop the references to the key
+	sw.key = nil
+	sw.secret_key = nil
+
+	if sw.inner == nil {
+		return nil
+	}
+
+	return sw.inner.Close()
+}
+
+// Writer for methods not supporting streaming
+// Buffers the data and encrypts it on close
+type buffered_encrypt_writer struct {
+	w          io.Writer            // Destination
+	method     FileEncryptionMethod // Method
+	key        []byte               // Encryption key
+	secret_key *SecretKey           // Secret key (if set, key is ignored)
+	buf        bytes.Buffer         // Buffered data
+	closed     bool                 // True if closed
+}
+
+func (bw *buffered_encrypt_writer) Write(p []byte) (int, error) {
+	if bw.closed {
+		return 0, ErrClosed
+	}
+
+	return bw.buf.Write(p)
+}
+
+func (bw *buffered_encrypt_writer) Close() error {
+	if bw.closed {
+		return nil
+	}
+
+	bw.closed = true
+
+	cipher_text, err := bw.encrypt()
+
+	// Drop the references to the key
+	bw.key = nil
+	bw.secret_key = nil
+
+	if err != nil {
+		return err
+	}
+
+	bw.buf.Reset()
+
+	_, err = bw.w.Write(cipher_text)
+
+	return err
+}
+
+// Encrypts the buffered data
+func (bw *buffered_encrypt_writer) encrypt() ([]byte, error) {
+	if bw.secret_key == nil {
+		return EncryptFileContents(bw.buf.Bytes(), bw.method, bw.key)
+	}
+
+	key, err := bw.secret_key.acquire()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer bw.secret_key.release()
+
+	return EncryptFileContents(bw.buf.Bytes(), bw.method, key)
+}
+
+// Reader returning an error if the data exceeds a limit
+type size_limited_reader struct {
+	r         io.Reader       // Source
+	remaining int64           // Remaining bytes until the limit
+	err       *SizeLimitError // Error to return if the limit is exceeded
+}
+
+func (lr *size_limited_reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if lr.remaining <= 0 {
+		// Check if there is more data
+		var b [1]byte
+		n, err := lr.r.Read(b[:])
+
+		if n > 0 {
+			return 0, lr.err
+		}
+
+		return 0, err
+	}
+
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+
+	return n, err
+}
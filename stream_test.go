@@ -0,0 +1,360 @@
+// Tests for streaming encryption
+
+package encrypted_storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamEncryption(t *testing.T) {
+	// Generate random key
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	sizes := []int{0, 1, 1000, STREAM_SEGMENT_SIZE, 3*STREAM_SEGMENT_SIZE + 17}
+	methods := []FileEncryptionMethod{AES256_GCM_STREAM, AES256_GCM_ZIP_STREAM, AES256_ZIP, AES256_GCM}
+
+	for _, method := range methods {
+		for _, size := range sizes {
+			original := make([]byte, size)
+			_, err = rand.Read(original)
+			if err != nil {
+				panic(err)
+			}
+
+			// Encrypt in small writes
+			var encrypted bytes.Buffer
+
+			w, err := NewEncryptWriter(&encrypted, method, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for i := 0; i < size; i += 777 {
+				end := i + 777
+				if end > size {
+					end = size
+				}
+
+				_, err = w.Write(original[i:end])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			err = w.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			// Decrypt with the buffer API
+			decrypted, err := DecryptFileContents(encrypted.Bytes(), key)
+			if err != nil {
+				t.Errorf("Method %d, size %d: %v", method, size, err)
+				continue
+			}
+
+			if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+				t.Errorf("Test failed for method = %d, size = %d bytes (DecryptFileContents)", method, size)
+			}
+
+			// Decrypt with the streaming API
+			r, err := NewDecryptReader(bytes.NewReader(encrypted.Bytes()), key)
+			if err != nil {
+				t.Errorf("Method %d, size %d: %v", method, size, err)
+				continue
+			}
+
+			decrypted, err = io.ReadAll(r)
+			if err != nil {
+				t.Errorf("Method %d, size %d: %v", method, size, err)
+				continue
+			}
+
+			if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+				t.Errorf("Test failed for method = %d, size = %d bytes (NewDecryptReader)", method, size)
+			}
+
+			// Encrypted with the buffer API, decrypted with the streaming API
+			encrypted2, err := EncryptFileContents(original, method, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			r, err = NewDecryptReader(bytes.NewReader(encrypted2), key)
+			if err != nil {
+				t.Errorf("Method %d, size %d: %v", method, size, err)
+				continue
+			}
+
+			decrypted, err = io.ReadAll(r)
+			if err != nil {
+				t.Errorf("Method %d, size %d: %v", method, size, err)
+				continue
+			}
+
+			if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+				t.Errorf("Test failed for method = %d, size = %d bytes (EncryptFileContents + NewDecryptReader)", method, size)
+			}
+		}
+	}
+}
+
+func TestStreamEncryptionTruncated(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	original := make([]byte, 2*STREAM_SEGMENT_SIZE+100)
+	_, err = rand.Read(original)
+	if err != nil {
+		panic(err)
+	}
+
+	encrypted, err := EncryptFileContents(original, AES256_GCM_STREAM, key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Cut after the first 2 full segments, or inside a segment
+	segment := STREAM_SEGMENT_SIZE + AES_GCM_TAG_SIZE
+	headerEnd := 2 + 4 + STREAM_SALT_SIZE
+
+	for _, end := range []int{headerEnd + segment, headerEnd + 2*segment, len(encrypted) - 1} {
+		r, err := NewDecryptReader(bytes.NewReader(encrypted[:end]), key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		_, err = io.ReadAll(r)
+		if err == nil {
+			t.Errorf("Expected an error for data truncated to %d bytes", end)
+		}
+	}
+
+	// Swap 2 segments
+	swapped := make([]byte, len(encrypted))
+	copy(swapped, encrypted)
+	copy(swapped[headerEnd:headerEnd+segment], encrypted[headerEnd+segment:headerEnd+2*segment])
+	copy(swapped[headerEnd+segment:headerEnd+2*segment], encrypted[headerEnd:headerEnd+segment])
+
+	_, err = DecryptFileContents(swapped, key)
+	if err != ErrAuthenticationFailed {
+		t.Errorf("Expected authentication failure for swapped segments, but got (%v)", err)
+	}
+}
+
+func TestStreamEncryptionKeySize(t *testing.T) {
+	original := make([]byte, STREAM_SEGMENT_SIZE+100)
+	_, err := rand.Read(original)
+	if err != nil {
+		panic(err)
+	}
+
+	// Keys of 16 and 24 bytes are accepted, like for the other methods
+
+	for _, size := range []int{16, 24, 32} {
+		key := make([]byte, size)
+		_, err = rand.Read(key)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, method := range []FileEncryptionMethod{AES256_GCM_STREAM, AES256_GCM_ZIP_STREAM} {
+			var encrypted bytes.Buffer
+
+			w, err := NewEncryptWriter(&encrypted, method, key)
+			if err != nil {
+				t.Errorf("Method %d, key size %d: %v", method, size, err)
+				continue
+			}
+
+			_, err = w.Write(original)
+			if err != nil {
+				t.Errorf("Method %d, key size %d: %v", method, size, err)
+				continue
+			}
+
+			err = w.Close()
+			if err != nil {
+				t.Errorf("Method %d, key size %d: %v", method, size, err)
+				continue
+			}
+
+			decrypted, err := DecryptFileContents(encrypted.Bytes(), key)
+			if err != nil {
+				t.Errorf("Method %d, key size %d: %v", method, size, err)
+			} else if subtle.ConstantTimeCompare(decrypted, original) != 1 {
+				t.Errorf("Test failed for method = %d, key size = %d", method, size)
+			}
+		}
+	}
+
+	// Invalid keys are rejected when creating the writer, before any write
+
+	for _, size := range []int{0, 8, 31, 33} {
+		var encrypted bytes.Buffer
+
+		_, err = NewEncryptWriter(&encrypted, AES256_GCM_STREAM, make([]byte, size))
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Key size %d: Expected ErrInvalidKey, but got (%v)", size, err)
+		}
+
+		if encrypted.Len() != 0 {
+			t.Errorf("Key size %d: Expected nothing to be written", size)
+		}
+	}
+}
+
+func TestStreamEncryptionWithSecretKey(t *testing.T) {
+	original := []byte("Test data encrypted with a secret key")
+
+	for _, method := range []FileEncryptionMethod{AES256_GCM_STREAM, AES256_ZIP} {
+		key, err := GenerateSecretKey()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var buf bytes.Buffer
+
+		w, err := NewEncryptWriterWithSecretKey(&buf, method, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		_, err = w.Write(original)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		r, err := NewDecryptReaderWithSecretKey(bytes.NewReader(buf.Bytes()), key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		// The key is not needed after creating the reader
+		key.Destroy()
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Decrypted data does not match the original data (method: %d)", method)
+		}
+
+		// Destroyed keys are rejected
+
+		_, err = NewDecryptReaderWithSecretKey(bytes.NewReader(buf.Bytes()), key)
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a destroyed key, but got (%v)", err)
+		}
+
+		_, err = NewEncryptWriterWithSecretKey(&buf, method, key)
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a destroyed key, but got (%v)", err)
+		}
+
+		// Destroying the key before the data is encrypted
+
+		key, err = GenerateSecretKey()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err = NewEncryptWriterWithSecretKey(io.Discard, method, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		key.Destroy()
+
+		_, err = w.Write(original)
+		if err == nil {
+			err = w.Close()
+		}
+
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey after destroying the key, but got (%v)", err)
+		}
+	}
+}
+
+func TestStreamDecryptionLimits(t *testing.T) {
+	key := test_random_key()
+
+	// Compressible data, so the cipher text is much smaller
+	original := make([]byte, 100*1024)
+
+	for _, method := range []FileEncryptionMethod{AES256_ZIP, AES256_GCM_ZIP_STREAM} {
+		encrypted, err := EncryptFileContents(original, method, key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// Exact limits
+
+		r, err := NewDecryptReaderWithOptions(bytes.NewReader(encrypted), key, DecryptOptions{MaxPlaintextSize: int64(len(original)), MaxCiphertextSize: int64(len(encrypted))})
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+			continue
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("Method %d: %v", method, err)
+		} else if !bytes.Equal(data, original) {
+			t.Errorf("Method %d: Decrypted data does not match the original data", method)
+		}
+
+		// Limits exceeded, when creating the reader or reading from it
+
+		for _, options := range []DecryptOptions{
+			{MaxPlaintextSize: int64(len(original)) - 1},
+			{MaxCiphertextSize: int64(len(encrypted)) - 1},
+		} {
+			r, err := NewDecryptReaderWithOptions(bytes.NewReader(encrypted), key, options)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+
+			var limit_err *SizeLimitError
+
+			if !errors.As(err, &limit_err) {
+				t.Errorf("Method %d: Expected a SizeLimitError, but got (%v)", method, err)
+			} else if limit_err.Ciphertext != (options.MaxCiphertextSize > 0) {
+				t.Errorf("Method %d: Unexpected limit: %v", method, limit_err)
+			}
+		}
+	}
+}